@@ -0,0 +1,140 @@
+package tubular
+
+import (
+	"inet.af/netaddr"
+
+	"github.com/cloudflare/tubular/internal"
+)
+
+// Binding redirects traffic for a protocol, prefix and port to a label.
+type Binding struct {
+	Label    string
+	Protocol Protocol
+	Prefix   Prefix
+	// Port zero matches all ports.
+	Port uint16
+	// Owner is an optional identifier of whoever manages the binding,
+	// see Dispatcher.ReplaceOwnedBindings.
+	Owner string
+}
+
+// NewBinding creates a binding.
+//
+// prefix may either be in CIDR notation (::1/128) or a plain IP address.
+// Specifying ::1 is equivalent to passing ::1/128.
+func NewBinding(label string, proto Protocol, prefix string, port uint16) (*Binding, error) {
+	bind, err := internal.NewBinding(label, internal.Protocol(proto), prefix, port)
+	if err != nil {
+		return nil, err
+	}
+	return newBinding(bind), nil
+}
+
+func newBinding(bind *internal.Binding) *Binding {
+	return &Binding{
+		bind.Label,
+		Protocol(bind.Protocol),
+		Prefix{bind.Prefix},
+		bind.Port,
+		bind.Owner,
+	}
+}
+
+func (bind *Binding) internal() *internal.Binding {
+	return &internal.Binding{
+		Label:    bind.Label,
+		Protocol: internal.Protocol(bind.Protocol),
+		Prefix:   bind.Prefix.prefix,
+		Port:     bind.Port,
+		Owner:    bind.Owner,
+	}
+}
+
+func (bind *Binding) String() string {
+	return bind.internal().String()
+}
+
+// Bindings is a list of bindings.
+//
+// They may be sorted using sort.Sort in the order of precedence used by the
+// data plane.
+type Bindings []*Binding
+
+func newBindings(bindings internal.Bindings) Bindings {
+	if bindings == nil {
+		return nil
+	}
+
+	result := make(Bindings, 0, len(bindings))
+	for _, bind := range bindings {
+		result = append(result, newBinding(bind))
+	}
+	return result
+}
+
+func (bindings Bindings) internal() internal.Bindings {
+	if bindings == nil {
+		return nil
+	}
+
+	result := make(internal.Bindings, 0, len(bindings))
+	for _, bind := range bindings {
+		result = append(result, bind.internal())
+	}
+	return result
+}
+
+func (bindings Bindings) Len() int      { return len(bindings) }
+func (bindings Bindings) Swap(i, j int) { bindings[i], bindings[j] = bindings[j], bindings[i] }
+func (bindings Bindings) Less(i, j int) bool {
+	return internal.Bindings{bindings[i].internal(), bindings[j].internal()}.Less(0, 1)
+}
+
+// Prefix is an IPv4 or IPv6 prefix. The zero value isn't a valid prefix.
+//
+// Prefixes can be compared using ==.
+type Prefix struct {
+	prefix netaddr.IPPrefix
+}
+
+// ParsePrefix parses a prefix in CIDR notation or a plain IP address.
+//
+// Specifying ::1 is equivalent to passing ::1/128.
+func ParsePrefix(prefix string) (Prefix, error) {
+	p, err := internal.ParsePrefix(prefix)
+	if err != nil {
+		return Prefix{}, err
+	}
+	return Prefix{p}, nil
+}
+
+// IsZero returns true for the zero value of Prefix.
+func (p Prefix) IsZero() bool {
+	return p.prefix.IsZero()
+}
+
+// Masked returns p with all bits outside of the prefix cleared.
+func (p Prefix) Masked() Prefix {
+	return Prefix{p.prefix.Masked()}
+}
+
+// Overlaps returns true if p and o contain at least one common IP.
+func (p Prefix) Overlaps(o Prefix) bool {
+	return p.prefix.Overlaps(o.prefix)
+}
+
+func (p Prefix) String() string {
+	return p.prefix.String()
+}
+
+// MarshalText encodes p in CIDR notation. The zero prefix is encoded as an
+// empty string.
+func (p Prefix) MarshalText() ([]byte, error) {
+	return p.prefix.MarshalText()
+}
+
+// UnmarshalText parses a prefix in CIDR notation. An empty string results in
+// the zero prefix.
+func (p *Prefix) UnmarshalText(text []byte) error {
+	return p.prefix.UnmarshalText(text)
+}
@@ -0,0 +1,46 @@
+package tubular
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/cloudflare/tubular/internal/fdpass"
+)
+
+// RegisterSocketWithServer registers a socket by passing it to the server
+// listening on path, see tubectl serve -register.
+//
+// Unlike Dispatcher.RegisterSocket this doesn't require any privileges.
+// Returns an error wrapping os.ErrPermission if the server doesn't allow the
+// caller to use label.
+func RegisterSocketWithServer(path, label string, conn syscall.Conn) (*Destination, SocketCookie, error) {
+	c, err := net.Dial(fdpass.Network, path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer c.Close()
+
+	uc := c.(*net.UnixConn)
+	if err := fdpass.WriteRequest(uc, &fdpass.Request{Label: label}, conn); err != nil {
+		return nil, 0, fmt.Errorf("send socket: %w", err)
+	}
+
+	resp, err := fdpass.ReadResponse(uc)
+	if err != nil {
+		return nil, 0, fmt.Errorf("read response: %w", err)
+	}
+
+	switch {
+	case resp.Denied:
+		return nil, 0, fmt.Errorf("register socket: %s: %w", resp.Error, os.ErrPermission)
+	case resp.Error != "":
+		return nil, 0, fmt.Errorf("register socket: %s", resp.Error)
+	case resp.Destination == nil:
+		return nil, 0, errors.New("register socket: server didn't return a destination")
+	}
+
+	return newDestination(resp.Destination), SocketCookie(resp.Cookie), nil
+}
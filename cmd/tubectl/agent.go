@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/tubular"
+	"github.com/cloudflare/tubular/internal/cgroup"
+	"github.com/cloudflare/tubular/internal/pidfd"
+	"github.com/cloudflare/tubular/internal/sysconn"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+// agentJSON is the format of the rules used by register-agent.
+type agentJSON struct {
+	Rules []agentRuleJSON `json:"rules"`
+}
+
+// agentRuleJSON selects processes by exactly one of Exe, Cgroup or Unit.
+type agentRuleJSON struct {
+	Label    string `json:"label"`
+	Exe      string `json:"exe,omitempty"`
+	Cgroup   string `json:"cgroup,omitempty"`
+	Unit     string `json:"unit,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	Port     uint16 `json:"port,omitempty"`
+}
+
+type agentRule struct {
+	label string
+	// Either exe or cgroup is set. cgroup is resolved on every scan, since
+	// the cgroup of a unit only exists while it's running.
+	exe                string
+	cgroup             string
+	protocol, ip, port string
+}
+
+func (r *agentRule) String() string {
+	if r.exe != "" {
+		return fmt.Sprintf("%s (exe %s)", r.label, r.exe)
+	}
+	return fmt.Sprintf("%s (cgroup %s)", r.label, r.cgroup)
+}
+
+func loadAgentRules(path string) ([]agentRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config agentJSON
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s: %s", file.Name(), err)
+	}
+
+	rules, err := newAgentRules(&config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file.Name(), err)
+	}
+	return rules, nil
+}
+
+func newAgentRules(config *agentJSON) ([]agentRule, error) {
+	if len(config.Rules) == 0 {
+		return nil, fmt.Errorf("no rules")
+	}
+
+	var rules []agentRule
+	for i, rj := range config.Rules {
+		if rj.Label == "" {
+			return nil, fmt.Errorf("rule #%d: missing label", i)
+		}
+
+		rule := agentRule{
+			rj.Label,
+			"",
+			"",
+			rj.Protocol,
+			rj.IP,
+			strconv.Itoa(int(rj.Port)),
+		}
+
+		var selectors int
+		if rj.Exe != "" {
+			if !filepath.IsAbs(rj.Exe) {
+				return nil, fmt.Errorf("rule #%d: exe %q isn't an absolute path", i, rj.Exe)
+			}
+			rule.exe = filepath.Clean(rj.Exe)
+			selectors++
+		}
+		if rj.Cgroup != "" {
+			rule.cgroup = rj.Cgroup
+			selectors++
+		}
+		if rj.Unit != "" {
+			rule.cgroup = rj.Unit
+			selectors++
+		}
+		if selectors != 1 {
+			return nil, fmt.Errorf("rule #%d: specify exactly one of exe, cgroup or unit", i)
+		}
+
+		if rule.protocol == "" {
+			rule.protocol = "any"
+		}
+		if rule.ip == "" {
+			rule.ip = "any"
+		}
+
+		if _, err := socketFilter(rule.protocol, rule.ip, rule.port); err != nil {
+			return nil, fmt.Errorf("rule #%d: %s", i, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func registerAgent(e *env, args ...string) error {
+	set := e.newFlagSet("register-agent", "rules")
+	set.Description = func() {
+		example := agentJSON{
+			Rules: []agentRuleJSON{
+				{Label: "foo", Exe: "/usr/sbin/nginx", Protocol: "tcp", IP: "127.0.0.1", Port: 80},
+				{Label: "bar", Unit: "dns.service", Protocol: "udp", IP: "::/0"},
+			},
+		}
+
+		out, _ := json.MarshalIndent(example, "    ", "    ")
+
+		set.Printf(
+			`Periodically register the sockets of processes according to rules.
+
+			The rules are read from a JSON formatted file:
+
+			    %s
+
+			A rule selects processes in the network namespace by exactly
+			one of "exe", "cgroup" or "unit". "exe" is the absolute path
+			of the executable, "cgroup" and "unit" are the same as for
+			register-cgroup. Sockets of selected processes are matched by
+			the optional "protocol", "ip" and "port" fields, which default
+			to "any", "any" and 0. See register-pid for their meaning.
+
+			Matching sockets are registered under the label of the rule
+			unless they already are. A service which restarts and creates a
+			new socket is therefore registered again on the next scan.
+			Destinations whose processes have exited are left alone.
+			Failures are logged and retried on the next scan.
+
+			Examples:
+			  $ tubectl register-agent rules.json
+			  $ tubectl register-agent -interval 10s -metrics 127.0.0.1:8080 rules.json`,
+			string(out),
+		)
+	}
+	interval := set.Duration("interval", 5*time.Second, "scan processes this often")
+	metricsAddr := set.String("metrics", "", "serve prometheus metrics on `address:port`")
+
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	if *interval <= 0 {
+		return fmt.Errorf("%w: interval must be positive", errBadArg)
+	}
+
+	rules, err := loadAgentRules(set.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if err := e.authorizeLabel(rule.label); err != nil {
+			return err
+		}
+	}
+
+	if err := e.setupEnv(); err != nil {
+		return err
+	}
+
+	a := newAgent(e, rules)
+
+	if *metricsAddr != "" {
+		stop, err := serveMetrics(e, *metricsAddr, a.register)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	e.stdout.Logf("scanning for %d rules every %s\n", len(rules), *interval)
+	for {
+		if err := a.scan(); err != nil {
+			e.stderr.Log("Error: scan:", err)
+		}
+
+		select {
+		case <-e.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// agent registers sockets according to a set of rules.
+type agent struct {
+	e             *env
+	rules         []agentRule
+	scans         *prometheus.CounterVec
+	registrations *prometheus.CounterVec
+	ruleErrors    *prometheus.CounterVec
+	lastScan      prometheus.Gauge
+}
+
+func newAgent(e *env, rules []agentRule) *agent {
+	return &agent{
+		e, rules,
+		prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agent_scans_total",
+			Help: "Total number of scans for sockets",
+		}, []string{"result"}),
+		prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agent_registrations_total",
+			Help: "Total number of sockets registered",
+		}, []string{"label"}),
+		prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agent_rule_errors_total",
+			Help: "Total number of errors while applying a rule",
+		}, []string{"label"}),
+		prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "agent_last_scan_timestamp_seconds",
+			Help: "Time when the last successful scan finished",
+		}),
+	}
+}
+
+func (a *agent) register(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{a.scans, a.registrations, a.ruleErrors, a.lastScan} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+
+	// Make sure that both results and all labels show up in the output.
+	a.scans.WithLabelValues("success")
+	a.scans.WithLabelValues("failure")
+	for _, rule := range a.rules {
+		a.registrations.WithLabelValues(rule.label)
+		a.ruleErrors.WithLabelValues(rule.label)
+	}
+	return nil
+}
+
+// scan applies all rules once.
+//
+// An error in one rule doesn't prevent the others from being applied.
+func (a *agent) scan() error {
+	err := a.apply()
+	if err != nil {
+		a.scans.WithLabelValues("failure").Inc()
+		return err
+	}
+
+	a.scans.WithLabelValues("success").Inc()
+	a.lastScan.SetToCurrentTime()
+	return nil
+}
+
+func (a *agent) apply() error {
+	pids, err := netnsPIDs(a.e.netns)
+	if err != nil {
+		return fmt.Errorf("list processes: %s", err)
+	}
+
+	dp, err := tubular.OpenDispatcher(a.e.netns, a.e.bpfFs, false)
+	if err != nil {
+		return fmt.Errorf("can't open dispatcher: %w", err)
+	}
+	defer dp.Close()
+
+	_, cookies, err := dp.Destinations()
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for i := range a.rules {
+		rule := &a.rules[i]
+		if err := a.applyRule(dp, cookies, rule, pids); err != nil {
+			a.e.stderr.Logf("Error: rule %s: %s\n", rule, err)
+			a.ruleErrors.WithLabelValues(rule.label).Inc()
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d rules failed", failed, len(a.rules))
+	}
+	return nil
+}
+
+func (a *agent) applyRule(dp *tubular.Dispatcher, cookies map[tubular.Destination]tubular.SocketCookie, rule *agentRule, pids []int) error {
+	pids, err := rule.pids(a.e, pids)
+	if err != nil {
+		return err
+	}
+
+	filter, err := socketFilter(rule.protocol, rule.ip, rule.port)
+	if err != nil {
+		return err
+	}
+
+	// Worker processes often share sockets.
+	filter = append(filter, sysconn.UniqueSocket())
+
+	var (
+		files   []*os.File
+		origins = make(map[*os.File]int)
+	)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, pid := range pids {
+		pidFiles, err := pidfd.Files(pid, filter...)
+		files = append(files, pidFiles...)
+		if errors.Is(err, unix.ESRCH) {
+			continue
+		} else if err := skipFdError(a.e, pid, pidFiles, err); err != nil {
+			return fmt.Errorf("pid %d: %w", pid, err)
+		}
+
+		for _, f := range pidFiles {
+			origins[f] = pid
+		}
+	}
+
+	if err := checkDestinations(rule.label, files); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		cookie, err := socketCookie(file)
+		if err != nil {
+			return err
+		}
+
+		dst, err := tubular.NewDestination(rule.label, file)
+		if err != nil {
+			return err
+		}
+
+		if cookies[*dst] == cookie {
+			continue
+		}
+
+		if _, _, err := dp.RegisterSocket(rule.label, file); err != nil {
+			return fmt.Errorf("register socket %s from pid %d: %w", cookie, origins[file], err)
+		}
+
+		a.e.stdout.Logf("registered socket %s from pid %d: %s\n", cookie, origins[file], dst)
+		a.registrations.WithLabelValues(rule.label).Inc()
+	}
+
+	return nil
+}
+
+// pids returns the processes selected by the rule, out of all processes in
+// the network namespace.
+func (r *agentRule) pids(e *env, netnsPIDs []int) ([]int, error) {
+	self := os.Getpid()
+
+	if r.exe != "" {
+		var pids []int
+		for _, pid := range netnsPIDs {
+			if pid == self {
+				continue
+			}
+
+			exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+			if err != nil {
+				// Either gone or a kernel thread.
+				continue
+			}
+
+			// The executable may have been replaced by an upgrade.
+			if strings.TrimSuffix(exe, " (deleted)") == r.exe {
+				pids = append(pids, pid)
+			}
+		}
+		return pids, nil
+	}
+
+	path, err := cgroup.Resolve(e.cgroupFs, r.cgroup)
+	if errors.Is(err, os.ErrNotExist) {
+		// The unit isn't running.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	cgroupPIDs, err := cgroup.PIDs(path)
+	if err != nil {
+		return nil, fmt.Errorf("cgroup %s: %s", path, err)
+	}
+
+	inNetNS := make(map[int]bool, len(netnsPIDs))
+	for _, pid := range netnsPIDs {
+		inNetNS[pid] = true
+	}
+
+	var pids []int
+	for _, pid := range cgroupPIDs {
+		if pid != self && inNetNS[pid] {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/tubular"
+	"github.com/cloudflare/tubular/internal/testutil"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRegisterAgent(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	cat, err := exec.LookPath("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cat, err = filepath.EvalSymlinks(cat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := mustWriteAgentRules(t, agentJSON{
+		Rules: []agentRuleJSON{
+			{Label: "foo", Exe: cat, Protocol: "tcp", IP: "127.0.0.1"},
+		},
+	})
+
+	registered := func() map[tubular.Destination]tubular.SocketCookie {
+		t.Helper()
+
+		dp, err := tubular.OpenDispatcher(netns.Path(), "/sys/fs/bpf", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dp.Close()
+
+		_, cookies, err := dp.Destinations()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cookies
+	}
+
+	spawn := func() (int, tubular.SocketCookie) {
+		t.Helper()
+
+		conn := testutil.Listen(t, netns, "tcp", "127.0.0.1:0")
+		defer conn.(interface{ Close() error }).Close()
+
+		file, err := conn.(interface{ File() (*os.File, error) }).File()
+		if err != nil {
+			t.Fatal("File:", err)
+		}
+		defer file.Close()
+
+		var pid int
+		testutil.JoinNetNS(t, netns, func() error {
+			pid = testutil.SpawnChildWithFiles(t, file)
+			return nil
+		})
+		return pid, mustSocketCookie(t, conn)
+	}
+
+	waitFor := func(want tubular.SocketCookie) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			for dest, cookie := range registered() {
+				if dest.Label == "foo" && cookie == want {
+					return
+				}
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("Socket %s wasn't registered: %v", want, registered())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	pid, cookie := spawn()
+
+	tubectl := tubectlTestCall{
+		NetNS:  netns,
+		ExecNS: netns,
+		Cmd:    "register-agent",
+		Args:   []string{"-interval", "10ms", rules},
+	}
+	stop := tubectl.Start(t)
+	defer stop()
+
+	waitFor(cookie)
+
+	// Simulate a restart of the service.
+	if err := unix.Kill(pid, unix.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+
+	_, cookie = spawn()
+	waitFor(cookie)
+}
+
+func TestAgentRules(t *testing.T) {
+	valid := []agentRuleJSON{
+		{Label: "foo", Exe: "/bin/server"},
+		{Label: "foo", Cgroup: "system.slice/foo.service", Protocol: "udp", IP: "::/0", Port: 53},
+		{Label: "foo", Unit: "foo", Protocol: "tcp", IP: "127.0.0.1"},
+	}
+
+	for _, rule := range valid {
+		rules, err := newAgentRules(&agentJSON{[]agentRuleJSON{rule}})
+		if err != nil {
+			t.Errorf("Rejected %+v: %s", rule, err)
+			continue
+		}
+
+		if rules[0].protocol == "" || rules[0].ip == "" {
+			t.Errorf("Defaults aren't applied for %+v", rule)
+		}
+	}
+
+	invalid := []agentRuleJSON{
+		{Exe: "/bin/server"},
+		{Label: "foo"},
+		{Label: "foo", Exe: "server"},
+		{Label: "foo", Exe: "/bin/server", Unit: "foo"},
+		{Label: "foo", Cgroup: "foo", Unit: "foo"},
+		{Label: "foo", Unit: "foo", Protocol: "icmp"},
+		{Label: "foo", Unit: "foo", IP: "localhost"},
+	}
+
+	for _, rule := range invalid {
+		if _, err := newAgentRules(&agentJSON{[]agentRuleJSON{rule}}); err == nil {
+			t.Errorf("Accepted %+v", rule)
+		}
+	}
+
+	if _, err := newAgentRules(&agentJSON{}); err == nil {
+		t.Error("Accepted empty rules")
+	}
+}
+
+func mustWriteAgentRules(tb testing.TB, config agentJSON) string {
+	tb.Helper()
+
+	buf, err := json.Marshal(config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	path := filepath.Join(tb.TempDir(), "rules.json")
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
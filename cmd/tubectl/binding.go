@@ -4,11 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"text/tabwriter"
+	"time"
 
-	"github.com/cloudflare/tubular/internal"
-	"inet.af/netaddr"
+	"github.com/cloudflare/tubular"
 )
 
 func bindings(e *env, args ...string) error {
@@ -24,17 +25,17 @@ func bindings(e *env, args ...string) error {
 		return err
 	}
 
-	var proto internal.Protocol
+	var proto tubular.Protocol
 	if f := set.Arg(0); set.NArg() >= 1 && f != "any" {
 		if err := proto.UnmarshalText([]byte(f)); err != nil {
 			return fmt.Errorf("parse protocol: %w", err)
 		}
 	}
 
-	var prefix netaddr.IPPrefix
+	var prefix tubular.Prefix
 	var err error
 	if set.NArg() >= 2 {
-		prefix, err = internal.ParsePrefix(set.Arg(1))
+		prefix, err = tubular.ParsePrefix(set.Arg(1))
 		if err != nil {
 			return err
 		}
@@ -49,7 +50,7 @@ func bindings(e *env, args ...string) error {
 		port = uint16(port64)
 	}
 
-	var bindings internal.Bindings
+	var bindings tubular.Bindings
 	{
 		dp, err := e.openDispatcher(true)
 		if err != nil {
@@ -65,7 +66,7 @@ func bindings(e *env, args ...string) error {
 		dp.Close()
 	}
 
-	var filtered internal.Bindings
+	var filtered tubular.Bindings
 	for _, bind := range bindings {
 		if proto != 0 && bind.Protocol != proto {
 			continue
@@ -83,6 +84,10 @@ func bindings(e *env, args ...string) error {
 	}
 	bindings = filtered
 
+	if e.format.structured() {
+		return e.writeResult(newBindingsJSON(bindings))
+	}
+
 	if len(bindings) == 0 {
 		e.stdout.Log("no bindings matched")
 		return nil
@@ -111,18 +116,34 @@ func bind(e *env, args ...string) error {
 		return err
 	}
 
+	check, err := e.labelChecker()
+	if err != nil {
+		return err
+	}
+
 	dp, err := e.openDispatcher(false)
 	if err != nil {
 		return err
 	}
 	defer dp.Close()
 
+	if check != nil {
+		current, err := dp.Bindings()
+		if err != nil {
+			return err
+		}
+
+		if err := authorizeChanges(check, current, withBinding(current, bind)); err != nil {
+			return err
+		}
+	}
+
 	if err := dp.AddBinding(bind); err != nil {
 		return err
 	}
 
 	e.stdout.Logf("bound %s", bind)
-	return nil
+	return e.writeResult(newReplaceJSON(tubular.Bindings{bind}, nil))
 }
 
 func unbind(e *env, args ...string) error {
@@ -137,6 +158,10 @@ func unbind(e *env, args ...string) error {
 		return err
 	}
 
+	if err := e.authorizeLabel(bind.Label); err != nil {
+		return err
+	}
+
 	dp, err := e.openDispatcher(false)
 	if err != nil {
 		return err
@@ -148,20 +173,20 @@ func unbind(e *env, args ...string) error {
 	}
 
 	e.stdout.Log("Removed", bind)
-	return nil
+	return e.writeResult(newReplaceJSON(nil, tubular.Bindings{bind}))
 }
 
-func bindingFromArgs(args []string) (*internal.Binding, error) {
+func bindingFromArgs(args []string) (*tubular.Binding, error) {
 	if n := len(args); n != 4 {
 		return nil, fmt.Errorf("expected label, protocol, ip/prefix and port but got %d arguments", n)
 	}
 
-	var proto internal.Protocol
+	var proto tubular.Protocol
 	switch args[1] {
 	case "udp":
-		proto = internal.UDP
+		proto = tubular.UDP
 	case "tcp":
-		proto = internal.TCP
+		proto = tubular.TCP
 	default:
 		return nil, fmt.Errorf("expected proto udp or tcp, got: %s", args[1])
 	}
@@ -171,13 +196,58 @@ func bindingFromArgs(args []string) (*internal.Binding, error) {
 		return nil, fmt.Errorf("invalid port: %s", err)
 	}
 
-	return internal.NewBinding(args[0], proto, args[2], uint16(port))
+	return tubular.NewBinding(args[0], proto, args[2], uint16(port))
 }
 
 type bindingJSON struct {
-	Label  string           `json:"label"`
-	Prefix netaddr.IPPrefix `json:"prefix"`
-	Port   *uint16          `json:"port"`
+	Label  string         `json:"label"`
+	Prefix tubular.Prefix `json:"prefix"`
+	Port   *uint16        `json:"port"`
+	// Protocol is optional, bindings apply to TCP and UDP if it's omitted.
+	Protocol *tubular.Protocol `json:"protocol,omitempty"`
+	Owner    string            `json:"owner,omitempty"`
+}
+
+// bindings converts bj into bindings for TCP and UDP, unless a
+// protocol is given.
+func (bj *bindingJSON) bindings() (tubular.Bindings, error) {
+	if bj.Port == nil {
+		return nil, fmt.Errorf("binding in json is missing port: %v", *bj)
+	}
+
+	protocols := []tubular.Protocol{tubular.TCP, tubular.UDP}
+	if bj.Protocol != nil {
+		protocols = []tubular.Protocol{*bj.Protocol}
+	}
+
+	var bindings tubular.Bindings
+	for _, proto := range protocols {
+		bindings = append(bindings, &tubular.Binding{
+			Label:    bj.Label,
+			Prefix:   bj.Prefix.Masked(),
+			Protocol: proto,
+			Port:     *bj.Port,
+			Owner:    bj.Owner,
+		})
+	}
+	return bindings, nil
+}
+
+// newBindingJSON converts a binding, including its protocol.
+func newBindingJSON(bind *tubular.Binding) bindingJSON {
+	port, protocol := bind.Port, bind.Protocol
+	return bindingJSON{bind.Label, bind.Prefix, &port, &protocol, bind.Owner}
+}
+
+// newBindingsJSON converts bindings, from most to least specific.
+func newBindingsJSON(bindings tubular.Bindings) []bindingJSON {
+	sort.Sort(bindings)
+
+	result := make([]bindingJSON, 0, len(bindings))
+	for _, bind := range bindings {
+		result = append(result, newBindingJSON(bind))
+	}
+	return result
 }
 
 type configJSON struct {
@@ -188,9 +258,10 @@ func loadBindings(e *env, args ...string) error {
 	set := newFlagSet(e.stderr, "load-bindings", "file")
 	set.Description = func() {
 		port := uint16(80)
+		prefix, _ := tubular.ParsePrefix("127.0.0.1/32")
 		example := configJSON{
 			Bindings: []bindingJSON{
-				{"foo", netaddr.MustParseIPPrefix("127.0.0.1/32"), &port},
+				{"foo", prefix, &port, nil, ""},
 			},
 		}
 
@@ -202,10 +273,30 @@ func loadBindings(e *env, args ...string) error {
 
 			The format is:
 
-			    %s`,
+			    %s
+
+			Bindings apply to TCP and UDP, unless an optional "protocol"
+			field set to "tcp" or "udp" is present. An optional "owner"
+			field records who manages a binding.
+
+			With -owner only the bindings belonging to that owner are
+			replaced. Loading fails if the file contains a binding which
+			exists but has a different owner.
+
+			With -watch the file is applied whenever it changes, and
+			periodically to undo changes made by other means. Failures
+			are logged and retried.
+
+			Examples:
+			  $ tubectl load-bindings bindings.json
+			  $ tubectl load-bindings -watch -metrics 127.0.0.1:8080 bindings.json`,
 			string(out),
 		)
 	}
+	owner := set.String("owner", "", "only replace bindings belonging to `owner`")
+	watch := set.Bool("watch", false, "keep applying the file until interrupted")
+	interval := set.Duration("interval", time.Minute, "re-apply the file this often when watching, 0 disables")
+	metricsAddr := set.String("metrics", "", "serve prometheus metrics on `address:port` when watching")
 
 	if err := set.Parse(args); err != nil {
 		return err
@@ -216,18 +307,27 @@ func loadBindings(e *env, args ...string) error {
 		return errBadArg
 	}
 
+	if *watch {
+		return watchBindings(e, set.Arg(0), *owner, *interval, *metricsAddr)
+	}
+
 	bindings, err := loadConfig(set.Arg(0))
 	if err != nil {
 		return err
 	}
 
+	check, err := e.labelChecker()
+	if err != nil {
+		return err
+	}
+
 	dp, err := e.openDispatcher(false)
 	if err != nil {
 		return err
 	}
 	defer dp.Close()
 
-	added, removed, err := dp.ReplaceBindings(bindings)
+	added, removed, err := replaceBindings(dp, check, *owner, bindings)
 	if err != nil {
 		return err
 	}
@@ -239,10 +339,10 @@ func loadBindings(e *env, args ...string) error {
 		e.stdout.Log("removed", bind)
 	}
 
-	return nil
+	return e.writeResult(newReplaceJSON(added, removed))
 }
 
-func loadConfig(path string) (internal.Bindings, error) {
+func loadConfig(path string) (tubular.Bindings, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -256,27 +356,75 @@ func loadConfig(path string) (internal.Bindings, error) {
 		return nil, fmt.Errorf("%s: %s", file.Name(), err)
 	}
 
-	var bindings internal.Bindings
+	var bindings tubular.Bindings
 	for _, bind := range config.Bindings {
-		if bind.Port == nil {
-			return nil, fmt.Errorf("binding in json is missing port: %v", bind)
+		expanded, err := bind.bindings()
+		if err != nil {
+			return nil, err
 		}
-
-		bindings = append(bindings,
-			&internal.Binding{
-				Label:    bind.Label,
-				Prefix:   bind.Prefix.Masked(),
-				Protocol: internal.TCP,
-				Port:     *bind.Port,
-			},
-			&internal.Binding{
-				Label:    bind.Label,
-				Prefix:   bind.Prefix.Masked(),
-				Protocol: internal.UDP,
-				Port:     *bind.Port,
-			},
-		)
+		bindings = append(bindings, expanded...)
 	}
 
 	return bindings, nil
 }
+
+// saveConfig writes bindings in the format understood by loadConfig.
+func saveConfig(path string, bindings tubular.Bindings) error {
+	config := configJSON{
+		Bindings: make([]bindingJSON, 0, len(bindings)),
+	}
+	for _, bind := range bindings {
+		config.Bindings = append(config.Bindings, newBindingJSON(bind))
+	}
+
+	out, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, append(out, '\n'), 0644); err != nil {
+		return fmt.Errorf("save bindings: %s", err)
+	}
+	return nil
+}
+
+// replaceBindings replaces all bindings, or only the ones belonging to owner
+// if it's not empty.
+//
+// check is invoked for the labels of all bindings which change.
+func replaceBindings(dp *tubular.Dispatcher, check func(string) error, owner string, bindings tubular.Bindings) (added, removed tubular.Bindings, _ error) {
+	if owner != "" {
+		for _, bind := range bindings {
+			if bind.Owner != "" && bind.Owner != owner {
+				return nil, nil, fmt.Errorf("binding %s belongs to %s instead of %s", bind, bind.Owner, owner)
+			}
+			bind.Owner = owner
+		}
+	}
+
+	if check != nil {
+		current, err := dp.Bindings()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if owner != "" {
+			var owned tubular.Bindings
+			for _, bind := range current {
+				if bind.Owner == owner {
+					owned = append(owned, bind)
+				}
+			}
+			current = owned
+		}
+
+		if err := authorizeChanges(check, current, bindings); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if owner != "" {
+		return dp.ReplaceOwnedBindings(owner, bindings)
+	}
+	return dp.ReplaceBindings(bindings)
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
 
-	"github.com/cloudflare/tubular/internal"
-	"github.com/cloudflare/tubular/internal/testutil"
+	"github.com/cloudflare/tubular"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -14,15 +15,15 @@ func TestBindings(t *testing.T) {
 	netns := mustReadyNetNS(t)
 
 	bindings := map[string]struct {
-		proto  internal.Protocol
+		proto  tubular.Protocol
 		prefix string
 		port   uint16
 	}{
-		"foo":  {internal.TCP, "::1", 80},
-		"bar":  {internal.TCP, "1::", 443},
-		"baz":  {internal.UDP, "127.0.1.0/24", 443},
-		"boo":  {internal.UDP, "::1", 443},
-		"wild": {internal.UDP, "2::1", 0},
+		"foo":  {tubular.TCP, "::1", 80},
+		"bar":  {tubular.TCP, "1::", 443},
+		"baz":  {tubular.UDP, "127.0.1.0/24", 443},
+		"boo":  {tubular.UDP, "::1", 443},
+		"wild": {tubular.UDP, "2::1", 0},
 	}
 
 	{
@@ -103,6 +104,48 @@ func TestBindUnbind(t *testing.T) {
 	}
 }
 
+func TestBindUnbindJSON(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	run := func(cmd string, args ...string) replaceJSON {
+		t.Helper()
+
+		tubectl := tubectlTestCall{
+			NetNS: netns,
+			Cmd:   cmd,
+			Args:  args,
+		}
+
+		var result replaceJSON
+		if err := tubectl.RunJSON(t, &result); err != nil {
+			t.Fatalf("Can't execute %s: %s", cmd, err)
+		}
+		return result
+	}
+
+	bind := newBindingJSON(mustNewBinding(t, "foo", tubular.TCP, "127.0.0.1", 80))
+	none := []bindingJSON{}
+
+	result := run("bind", "foo", "tcp", "127.0.0.1", "80")
+	if diff := cmp.Diff(replaceJSON{[]bindingJSON{bind}, none}, result, prefixComparer()); diff != "" {
+		t.Errorf("Result of bind doesn't match (-want +got):\n%s", diff)
+	}
+
+	tubectl := tubectlTestCall{NetNS: netns, Cmd: "bindings"}
+	var bindings []bindingJSON
+	if err := tubectl.RunJSON(t, &bindings); err != nil {
+		t.Fatal("Can't execute bindings:", err)
+	}
+	if diff := cmp.Diff([]bindingJSON{bind}, bindings, prefixComparer()); diff != "" {
+		t.Errorf("Result of bindings doesn't match (-want +got):\n%s", diff)
+	}
+
+	result = run("unbind", "foo", "tcp", "127.0.0.1", "80")
+	if diff := cmp.Diff(replaceJSON{none, []bindingJSON{bind}}, result, prefixComparer()); diff != "" {
+		t.Errorf("Result of unbind doesn't match (-want +got):\n%s", diff)
+	}
+}
+
 func TestBindInvariants(t *testing.T) {
 	netns := mustReadyNetNS(t)
 
@@ -133,7 +176,7 @@ func TestBindInvariants(t *testing.T) {
 	if bind.Port != 443 {
 		t.Error("Binding should have port 443, got", bind.Port)
 	}
-	if bind.Protocol != internal.UDP {
+	if bind.Protocol != tubular.UDP {
 		t.Error("Binding should have proto UDP, got", bind.Protocol)
 	}
 	if p := bind.Prefix.String(); p != "::1/128" {
@@ -194,32 +237,102 @@ func TestLoadBindings(t *testing.T) {
 	}
 
 	// These match testdata/bindings.json
-	want := internal.Bindings{
-		mustNewBinding(t, "foo", internal.TCP, "127.0.0.1", 0),
-		mustNewBinding(t, "foo", internal.UDP, "127.0.0.1", 0),
-		mustNewBinding(t, "foo-port", internal.TCP, "127.0.0.2", 53),
-		mustNewBinding(t, "foo-port", internal.UDP, "127.0.0.2", 53),
-		mustNewBinding(t, "bar", internal.TCP, "::1/64", 0),
-		mustNewBinding(t, "bar", internal.UDP, "::1/64", 0),
-		mustNewBinding(t, "bar-port", internal.TCP, "1::1/64", 53),
-		mustNewBinding(t, "bar-port", internal.UDP, "1::1/64", 53),
+	want := tubular.Bindings{
+		mustNewBinding(t, "foo", tubular.TCP, "127.0.0.1", 0),
+		mustNewBinding(t, "foo", tubular.UDP, "127.0.0.1", 0),
+		mustNewBinding(t, "foo-port", tubular.TCP, "127.0.0.2", 53),
+		mustNewBinding(t, "foo-port", tubular.UDP, "127.0.0.2", 53),
+		mustNewBinding(t, "bar", tubular.TCP, "::1/64", 0),
+		mustNewBinding(t, "bar", tubular.UDP, "::1/64", 0),
+		mustNewBinding(t, "bar-port", tubular.TCP, "1::1/64", 53),
+		mustNewBinding(t, "bar-port", tubular.UDP, "1::1/64", 53),
+	}
+
+	sort.Sort(bindings)
+	sort.Sort(want)
+
+	if diff := cmp.Diff(want, bindings, prefixComparer()); diff != "" {
+		t.Errorf("Bindings don't match (+y -x):\n%s", diff)
+	}
+}
+
+func TestLoadBindingsOwner(t *testing.T) {
+	netns := mustReadyNetNS(t)
+	dir := t.TempDir()
+
+	writeConfig := func(name, config string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	teamA := writeConfig("a.json", `{"bindings":[{"label":"foo","prefix":"127.0.0.1/32","port":80,"protocol":"tcp"}]}`)
+	teamB := writeConfig("b.json", `{"bindings":[{"label":"bar","prefix":"127.0.0.2/32","port":80,"protocol":"tcp"}]}`)
+	empty := writeConfig("empty.json", `{"bindings":[]}`)
+
+	mustTestTubectl(t, netns, "bind", "unowned", "udp", "127.0.0.1", "53")
+	mustTestTubectl(t, netns, "load-bindings", "-owner", "a", teamA)
+	mustTestTubectl(t, netns, "load-bindings", "-owner", "b", teamB)
+
+	if _, err := testTubectl(t, netns, "load-bindings", "-owner", "b", teamA); err == nil {
+		t.Error("load-bindings -owner accepts bindings of a different owner")
+	}
+
+	mustTestTubectl(t, netns, "load-bindings", "-owner", "a", empty)
+
+	output := mustTestTubectl(t, netns, "bindings")
+	if !strings.Contains(output.String(), "owner") {
+		t.Error("Output of bindings doesn't contain owner:", output)
+	}
+
+	dp := mustOpenDispatcher(t, netns)
+	bindings, err := dp.Bindings()
+	if err != nil {
+		t.Fatal("Can't get bindings:", err)
+	}
+
+	bar := mustNewBinding(t, "bar", tubular.TCP, "127.0.0.2", 80)
+	bar.Owner = "b"
+	want := tubular.Bindings{
+		mustNewBinding(t, "unowned", tubular.UDP, "127.0.0.1", 53),
+		bar,
 	}
 
 	sort.Sort(bindings)
 	sort.Sort(want)
 
-	if diff := cmp.Diff(want, bindings, testutil.IPPrefixComparer()); diff != "" {
+	if diff := cmp.Diff(want, bindings, prefixComparer()); diff != "" {
 		t.Errorf("Bindings don't match (+y -x):\n%s", diff)
 	}
 }
 
-func mustNewBinding(tb testing.TB, label string, proto internal.Protocol, prefix string, port uint16) *internal.Binding {
+func mustNewBinding(tb testing.TB, label string, proto tubular.Protocol, prefix string, port uint16) *tubular.Binding {
 	tb.Helper()
 
-	bind, err := internal.NewBinding(label, proto, prefix, port)
+	bind, err := tubular.NewBinding(label, proto, prefix, port)
 	if err != nil {
 		tb.Fatal("Can't create binding:", err)
 	}
 
 	return bind
 }
+
+func mustParsePrefix(tb testing.TB, prefix string) tubular.Prefix {
+	tb.Helper()
+
+	p, err := tubular.ParsePrefix(prefix)
+	if err != nil {
+		tb.Fatal("Can't parse prefix:", err)
+	}
+
+	return p
+}
+
+func prefixComparer() cmp.Option {
+	return cmp.Comparer(func(x, y tubular.Prefix) bool {
+		return x == y
+	})
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/cloudflare/tubular"
+
+	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+type checkStatus int
+
+const (
+	checkOK checkStatus = iota
+	checkWarn
+	checkFail
+)
+
+func (cs checkStatus) String() string {
+	switch cs {
+	case checkOK:
+		return "ok"
+	case checkWarn:
+		return "warn"
+	case checkFail:
+		return "FAIL"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(cs))
+	}
+}
+
+type checkResult struct {
+	status  checkStatus
+	message string
+	hint    string
+}
+
+func checkOKf(format string, args ...interface{}) checkResult {
+	return checkResult{checkOK, fmt.Sprintf(format, args...), ""}
+}
+
+var doctorChecks = []struct {
+	name string
+	fn   func(*env) checkResult
+}{
+	{"kernel", checkKernel},
+	{"unprivileged bpf", checkUnprivilegedBPF},
+	{"bpffs", checkBPFFS},
+	{"memlock", checkMemlock},
+	{"state", checkState},
+	{"program", checkProgram},
+}
+
+type checkJSON struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+func doctor(e *env, args ...string) error {
+	set := e.newFlagSet("doctor")
+	set.Description = `
+		Check the system for common configuration problems.
+
+		Exits with a non-zero status if any check fails. Warnings don't
+		affect the exit status.`
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	failed := 0
+	checks := make([]checkJSON, 0, len(doctorChecks))
+	for _, check := range doctorChecks {
+		result := check.fn(e)
+		checks = append(checks, checkJSON{check.name, strings.ToLower(result.status.String()), result.message, result.hint})
+		e.stdout.Logf("%-4s %s: %s\n", result.status, check.name, result.message)
+		if result.hint != "" {
+			e.stdout.Logf("     hint: %s\n", result.hint)
+		}
+
+		if result.status == checkFail {
+			failed++
+		}
+	}
+
+	// The checks are the result even if some of them failed.
+	if err := e.writeResult(checks); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(doctorChecks))
+	}
+
+	return nil
+}
+
+const minKernelMajor, minKernelMinor = 5, 10
+
+func checkKernel(*env) checkResult {
+	release, major, minor, err := kernelVersion()
+	if err != nil {
+		return checkResult{checkFail, err.Error(), ""}
+	}
+
+	if major < minKernelMajor || (major == minKernelMajor && minor < minKernelMinor) {
+		return checkResult{
+			checkFail,
+			fmt.Sprintf("Linux %s is too old", release),
+			fmt.Sprintf("upgrade to Linux %d.%d or later", minKernelMajor, minKernelMinor),
+		}
+	}
+
+	return checkOKf("Linux %s", release)
+}
+
+func kernelVersion() (release string, major, minor int, err error) {
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return "", 0, 0, fmt.Errorf("uname: %s", err)
+	}
+
+	release = unix.ByteSliceToString(uname.Release[:])
+	major, minor, err = parseKernelRelease(release)
+	return
+}
+
+func parseKernelRelease(release string) (major, minor int, err error) {
+	if _, err := fmt.Sscanf(release, "%d.%d", &major, &minor); err != nil {
+		return 0, 0, fmt.Errorf("can't parse kernel release %q: %s", release, err)
+	}
+	return major, minor, nil
+}
+
+func checkUnprivilegedBPF(*env) checkResult {
+	const path = "/proc/sys/kernel/unprivileged_bpf_disabled"
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return checkResult{checkWarn, err.Error(), ""}
+	}
+
+	if value := strings.TrimSpace(string(contents)); value != "0" {
+		return checkResult{
+			checkWarn,
+			fmt.Sprintf("kernel.unprivileged_bpf_disabled is %s", value),
+			"unprivileged users can't read dispatcher state, grant CAP_BPF to tubectl metrics",
+		}
+	}
+
+	return checkOKf("enabled")
+}
+
+func checkBPFFS(e *env) checkResult {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(e.bpfFs, &fs); err != nil {
+		return checkResult{
+			checkFail,
+			err.Error(),
+			fmt.Sprintf("mount -t bpf bpf %s", e.bpfFs),
+		}
+	}
+
+	if fs.Type != unix.BPF_FS_MAGIC {
+		return checkResult{
+			checkFail,
+			fmt.Sprintf("%s is not a BPF filesystem", e.bpfFs),
+			fmt.Sprintf("mount -t bpf bpf %s", e.bpfFs),
+		}
+	}
+
+	info, err := os.Stat(e.bpfFs)
+	if err != nil {
+		return checkResult{checkFail, err.Error(), ""}
+	}
+
+	if info.Mode().Perm()&0001 == 0 {
+		return checkResult{
+			checkWarn,
+			fmt.Sprintf("%s is not traversable by other users", e.bpfFs),
+			fmt.Sprintf("chmod o+x %s", e.bpfFs),
+		}
+	}
+
+	return checkOKf("%s is mounted", e.bpfFs)
+}
+
+func checkMemlock(*env) checkResult {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_MEMLOCK, &limit); err != nil {
+		return checkResult{checkFail, fmt.Sprintf("getrlimit: %s", err), ""}
+	}
+
+	if limit.Cur == unix.RLIM_INFINITY {
+		return checkOKf("unlimited")
+	}
+
+	// Since Linux 5.11 BPF memory is accounted via cgroups instead.
+	if _, major, minor, err := kernelVersion(); err == nil && (major > 5 || (major == 5 && minor >= 11)) {
+		return checkOKf("not used by the kernel")
+	}
+
+	haveSysResource, err := cap.GetProc().GetFlag(cap.Effective, cap.SYS_RESOURCE)
+	if err == nil && haveSysResource {
+		return checkOKf("raised automatically via CAP_SYS_RESOURCE")
+	}
+
+	return checkResult{
+		checkFail,
+		fmt.Sprintf("RLIMIT_MEMLOCK is limited to %d bytes", limit.Cur),
+		"run ulimit -l unlimited or set LimitMEMLOCK=infinity in the systemd unit",
+	}
+}
+
+func checkState(e *env) checkResult {
+	dp, err := tubular.OpenDispatcher(e.netns, e.bpfFs, true)
+	if errors.Is(err, tubular.ErrNotLoaded) {
+		return checkResult{checkWarn, "dispatcher is not loaded", "run tubectl load"}
+	} else if errors.Is(err, os.ErrPermission) {
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			if result := checkStateOwner(pathErr.Path); result.status == checkFail {
+				return result
+			}
+		}
+
+		return checkResult{checkFail, err.Error(), "run tubectl doctor as root"}
+	} else if err != nil {
+		return checkResult{checkFail, err.Error(), ""}
+	}
+	defer dp.Close()
+
+	if paused, err := dp.Paused(); err != nil {
+		return checkResult{checkFail, err.Error(), ""}
+	} else if paused {
+		return checkResult{checkWarn, "dispatcher is paused", "run tubectl resume"}
+	}
+
+	return checkStateOwner(dp.Path())
+}
+
+// checkStateOwner checks that the current user owns the state directory at
+// path or is a member of its group.
+func checkStateOwner(path string) checkResult {
+	info, err := os.Stat(path)
+	if err != nil {
+		return checkResult{checkFail, err.Error(), ""}
+	}
+
+	groups, err := os.Getgroups()
+	if err != nil {
+		return checkResult{checkFail, fmt.Sprintf("get groups: %s", err), ""}
+	}
+	groups = append(groups, os.Getegid())
+
+	stat := info.Sys().(*syscall.Stat_t)
+	return stateOwnerResult(path, stat.Uid, stat.Gid, os.Geteuid(), groups)
+}
+
+func stateOwnerResult(path string, uid, gid uint32, euid int, groups []int) checkResult {
+	owner := fmt.Sprintf("%s is owned by %d:%d", path, uid, gid)
+	if euid == 0 || uint32(euid) == uid {
+		return checkResult{checkOK, owner, ""}
+	}
+
+	for _, group := range groups {
+		if uint32(group) == gid {
+			return checkOKf("%s, current user is a member of group %d", owner, gid)
+		}
+	}
+
+	return checkResult{
+		checkFail,
+		fmt.Sprintf("%s, current user isn't a member of group %d", owner, gid),
+		"add the current user to the group, or load the dispatcher with a group the current user is a member of: sudo -g <group> tubectl load",
+	}
+}
+
+func checkProgram(e *env) checkResult {
+	err := tubular.CheckDispatcher(e.netns, e.bpfFs)
+	if errors.Is(err, tubular.ErrNotLoaded) {
+		return checkResult{checkWarn, "dispatcher is not loaded", "run tubectl load"}
+	} else if errors.Is(err, os.ErrPermission) {
+		return checkResult{checkFail, err.Error(), "run tubectl doctor as root"}
+	} else if err != nil {
+		return checkResult{
+			checkFail,
+			err.Error(),
+			"the loaded program is stale, run tubectl upgrade",
+		}
+	}
+
+	return checkOKf("loaded program matches %s", Version)
+}
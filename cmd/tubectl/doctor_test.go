@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/tubular/internal/testutil"
+)
+
+func TestDoctor(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	output := mustTestTubectl(t, netns, "doctor")
+	if strings.Contains(output.String(), "FAIL") {
+		t.Error("Output contains failed checks")
+	}
+}
+
+func TestDoctorNotLoaded(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+
+	output := mustTestTubectl(t, netns, "doctor")
+	if !strings.Contains(output.String(), "not loaded") {
+		t.Error("Output doesn't mention missing dispatcher")
+	}
+}
+
+func TestDoctorInvalidBPFFS(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+
+	doctor := tubectlTestCall{
+		NetNS: netns,
+		Args:  []string{"-bpffs", t.TempDir(), "doctor"},
+	}
+
+	if _, err := doctor.Run(t); err == nil {
+		t.Error("doctor doesn't fail with invalid bpffs")
+	}
+}
+
+func TestStateOwnerResult(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		euid   int
+		groups []int
+		status checkStatus
+	}{
+		{"root", 0, nil, checkOK},
+		{"owner", 1000, nil, checkOK},
+		{"group member", 1001, []int{1001, 2000}, checkOK},
+		{"not a member", 1001, []int{1001}, checkFail},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result := stateOwnerResult("/sys/fs/bpf/foo", 1000, 2000, tc.euid, tc.groups)
+			if result.status != tc.status {
+				t.Errorf("Expected %s, got %s: %s", tc.status, result.status, result.message)
+			}
+
+			if result.status == checkFail && result.hint == "" {
+				t.Error("Failed check doesn't have a hint")
+			}
+		})
+	}
+}
+
+func TestParseKernelRelease(t *testing.T) {
+	for _, tc := range []struct {
+		release      string
+		major, minor int
+	}{
+		{"5.10.0", 5, 10},
+		{"5.15.0-1019-aws", 5, 15},
+		{"6.1.0-cloudflare-2022.12.0", 6, 1},
+	} {
+		major, minor, err := parseKernelRelease(tc.release)
+		if err != nil {
+			t.Errorf("Can't parse %q: %s", tc.release, err)
+			continue
+		}
+
+		if major != tc.major || minor != tc.minor {
+			t.Errorf("Expected %d.%d for %q, got %d.%d", tc.major, tc.minor, tc.release, major, minor)
+		}
+	}
+
+	if _, _, err := parseKernelRelease("foo"); err == nil {
+		t.Error("Accepted invalid release")
+	}
+}
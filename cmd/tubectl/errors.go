@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cloudflare/tubular"
+)
+
+// Exit statuses of tubectl, by class of error.
+//
+// There is no status for lock contention: commands wait for other users of
+// the dispatcher to release its lock instead of failing.
+const (
+	exitError          = 1
+	exitBadArgument    = 2
+	exitNotLoaded      = 3
+	exitLoaded         = 4
+	exitNotFound       = 5
+	exitConflict       = 6
+	exitIncompatible   = 7
+	exitOutOfResources = 8
+	exitBadSocket      = 9
+	exitPermission     = 10
+)
+
+var exitStatuses = []struct {
+	status      int
+	description string
+}{
+	{exitError, "unclassified error"},
+	{exitBadArgument, "invalid arguments or flags"},
+	{exitNotLoaded, "the dispatcher isn't loaded"},
+	{exitLoaded, "the dispatcher is already loaded"},
+	{exitNotFound, "a binding, socket or file doesn't exist"},
+	{exitConflict, "a binding or socket doesn't match the expected one"},
+	{exitIncompatible, "the loaded dispatcher is incompatible, or an upgrade failed verification"},
+	{exitOutOfResources, "no destination IDs are left"},
+	{exitBadSocket, "a socket can't be registered"},
+	{exitPermission, "permission denied"},
+}
+
+// errorCodes maps errors to machine readable codes and exit statuses, in
+// order of precedence.
+var errorCodes = []struct {
+	err    error
+	code   string
+	status int
+}{
+	{tubular.ErrNotLoaded, "not_loaded", exitNotLoaded},
+	{tubular.ErrLoaded, "already_loaded", exitLoaded},
+	{tubular.ErrBindingNotFound, "binding_not_found", exitNotFound},
+	{tubular.ErrSocketNotFound, "socket_not_found", exitNotFound},
+	{tubular.ErrDestinationMismatch, "destination_mismatch", exitConflict},
+	{tubular.ErrBindingConflict, "binding_conflict", exitConflict},
+	{tubular.ErrIncompatibleProgram, "incompatible_program", exitIncompatible},
+	{tubular.ErrVerificationFailed, "verification_failed", exitIncompatible},
+	{tubular.ErrOutOfDestinationIDs, "out_of_destination_ids", exitOutOfResources},
+	{tubular.ErrNotSocket, "not_socket", exitBadSocket},
+	{tubular.ErrBadSocketDomain, "bad_socket_domain", exitBadSocket},
+	{tubular.ErrBadSocketType, "bad_socket_type", exitBadSocket},
+	{tubular.ErrBadSocketProtocol, "bad_socket_protocol", exitBadSocket},
+	{tubular.ErrBadSocketState, "bad_socket_state", exitBadSocket},
+	{errBadArg, "bad_argument", exitBadArgument},
+	{errBadFD, "bad_fd", exitBadArgument},
+	{os.ErrPermission, "permission_denied", exitPermission},
+	{os.ErrNotExist, "not_found", exitNotFound},
+}
+
+// classifyError returns the code and exit status for err.
+func classifyError(err error) (code string, status int) {
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code, ec.status
+		}
+	}
+	return "unknown", exitError
+}
+
+func errorCode(err error) string {
+	code, _ := classifyError(err)
+	return code
+}
+
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var childErr *childExitError
+	if errors.As(err, &childErr) {
+		return childErr.status()
+	}
+
+	_, status := classifyError(err)
+	return status
+}
+
+func printExitStatuses(w io.Writer) {
+	fmt.Fprintln(w, "Exit status:")
+	for _, es := range exitStatuses {
+		fmt.Fprintf(w, "  %-3d %s\n", es.status, es.description)
+	}
+}
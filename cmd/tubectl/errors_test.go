@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/cloudflare/tubular"
+	"github.com/cloudflare/tubular/internal/testutil"
+)
+
+func TestExitStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+	}{
+		{nil, 0},
+		{errors.New("foo"), exitError},
+		{fmt.Errorf("status: %w", tubular.ErrNotLoaded), exitNotLoaded},
+		{fmt.Errorf("bind: %w", errBadArg), exitBadArgument},
+		{fmt.Errorf("register: %w", syscall.EINVAL), exitError},
+		{fmt.Errorf("unbind: %w", tubular.ErrBindingNotFound), exitNotFound},
+		{fmt.Errorf("register: %w", tubular.ErrBadSocketState), exitBadSocket},
+		{fmt.Errorf("load-bindings: %w", tubular.ErrBindingConflict), exitConflict},
+		{fmt.Errorf("upgrade: %w", tubular.ErrIncompatibleProgram), exitIncompatible},
+		{fmt.Errorf("bind: %w", tubular.ErrOutOfDestinationIDs), exitOutOfResources},
+		{fmt.Errorf("bind: %w", os.ErrPermission), exitPermission},
+	} {
+		if status := exitStatus(tc.err); status != tc.status {
+			t.Errorf("Expected status %d for %v, got %d", tc.status, tc.err, status)
+		}
+	}
+
+	documented := make(map[int]bool)
+	for _, es := range exitStatuses {
+		documented[es.status] = true
+	}
+
+	for _, ec := range errorCodes {
+		if !documented[ec.status] {
+			t.Errorf("Exit status %d for %s isn't documented", ec.status, ec.code)
+		}
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	for _, tc := range []struct {
+		cmd  string
+		args []string
+		err  error
+	}{
+		{"unbind", []string{"foo", "tcp", "127.0.0.1", "80"}, tubular.ErrBindingNotFound},
+		{"unregister", []string{"foo", "ipv4", "tcp"}, tubular.ErrSocketNotFound},
+		{"bind", []string{"-unknown-flag"}, errBadArg},
+		{"unknown-command", nil, errBadArg},
+	} {
+		t.Run(tc.cmd, func(t *testing.T) {
+			_, err := testTubectl(t, netns, tc.cmd, tc.args...)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Expected %s, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestHelpListsExitStatuses(t *testing.T) {
+	cmd := tubectlTestCall{
+		NetNS: testutil.NewNetNS(t),
+		Args:  []string{"-help"},
+	}
+
+	output := cmd.MustRun(t)
+	if !bytes.Contains(output.Bytes(), []byte("Exit status:")) {
+		t.Error("Usage doesn't list exit statuses")
+	}
+}
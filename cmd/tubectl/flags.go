@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -18,7 +19,8 @@ type flagSet struct {
 // newFlagSet creates a flag set for a command with the given name.
 //
 // args contains both required an optional arguments, separated by the special
-// string "--".
+// string "--". A final optional argument ending in "..." accepts any number
+// of arguments.
 func newFlagSet(output io.Writer, name string, args ...string) *flagSet {
 	set := flag.NewFlagSet(name, flag.ContinueOnError)
 	set.SetOutput(output)
@@ -63,17 +65,20 @@ func newFlagSet(output io.Writer, name string, args ...string) *flagSet {
 }
 
 func (fs *flagSet) Parse(args []string) error {
-	if err := fs.FlagSet.Parse(args); err != nil {
+	if err := fs.FlagSet.Parse(args); errors.Is(err, flag.ErrHelp) {
 		return err
+	} else if err != nil {
+		return fmt.Errorf("%w: %s", errBadArg, err)
 	}
 
 	var err error
 	minArgs := len(fs.args)
 	maxArgs := minArgs + len(fs.optionalArgs)
+	variadic := len(fs.optionalArgs) > 0 && strings.HasSuffix(fs.optionalArgs[len(fs.optionalArgs)-1], "...")
 	switch n := fs.NArg(); {
 	case n < minArgs:
 		err = fmt.Errorf("%w: expected at least %d arguments, got %d", errBadArg, minArgs, n)
-	case n > maxArgs:
+	case n > maxArgs && !variadic:
 		err = fmt.Errorf("%w: expected at most %d arguments, got %d", errBadArg, maxArgs, n)
 	default:
 		return nil
@@ -20,6 +20,11 @@ func TestOptionalArgs(t *testing.T) {
 	if err := fs.Parse([]string{"foo", "bar", "baz"}); err == nil {
 		t.Fatal("Accepted extraneous argument")
 	}
+
+	fs = newFlagSet(&buf, "test", "a", "--", "b...")
+	if err := fs.Parse([]string{"foo", "bar", "baz"}); err != nil {
+		t.Fatal("Can't invoke with variadic arguments")
+	}
 }
 
 func TestTrimLeadingTabsAndSpace(t *testing.T) {
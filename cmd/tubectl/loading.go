@@ -1,11 +1,27 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
 
-	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular"
 )
 
+// dispatcherJSON is the result of commands which change the state of the
+// dispatcher.
+type dispatcherJSON struct {
+	NetNS  string `json:"netns"`
+	Action string `json:"action"`
+	// False if the dispatcher already was in the requested state.
+	Changed bool `json:"changed"`
+	// The program which is attached after an upgrade or rollback.
+	ProgramID uint32 `json:"program_id,omitempty"`
+}
+
 func load(e *env, args ...string) error {
 	set := e.newFlagSet("load")
 	set.Description = "Load the tubular dispatcher."
@@ -14,53 +30,328 @@ func load(e *env, args ...string) error {
 	}
 
 	dp, err := e.createDispatcher()
-	if errors.Is(err, internal.ErrLoaded) {
+	if errors.Is(err, tubular.ErrLoaded) {
 		e.stderr.Log("dispatcher is already loaded in", e.netns)
-		return nil
+		return e.writeResult(dispatcherJSON{e.netns, "load", false, 0})
 	} else if err != nil {
 		return err
 	}
 	defer dp.Close()
 
 	e.stdout.Logf("loaded dispatcher into %s\n", e.netns)
-	return nil
+	return e.writeResult(dispatcherJSON{e.netns, "load", true, 0})
 }
 
 func unload(e *env, args ...string) error {
 	set := e.newFlagSet("unload")
-	set.Description = "Unload the tubular dispatcher, removing any present state."
+	set.Description = `
+		Unload the tubular dispatcher, removing any present state.
+
+		Refuses to unload if there are bindings or registered sockets,
+		unless -force is given. The refusal lists the lookups steered to
+		each destination during -interval. With -save, bindings are
+		written to a file which can be passed to load-bindings before
+		anything is removed.`
+	force := set.Bool("force", false, "unload even if the dispatcher is in use")
+	save := set.String("save", "", "write bindings to `file` before unloading")
+	interval := set.Duration("interval", time.Second, "count lookups per destination during this `duration`")
 	if err := set.Parse(args); err != nil {
 		return err
 	}
 
-	err := internal.UnloadDispatcher(e.netns, e.bpfFs)
-	if errors.Is(err, internal.ErrNotLoaded) {
+	var check func(*tubular.Dispatcher) error
+	if !*force || *save != "" {
+		check = func(dp *tubular.Dispatcher) error {
+			return checkUnload(e, dp, *force, *save, *interval)
+		}
+	}
+
+	err := tubular.UnloadDispatcherChecked(e.netns, e.bpfFs, check)
+	if errors.Is(err, tubular.ErrNotLoaded) {
 		e.stderr.Log("dispatcher is not loaded in", e.netns)
-		return nil
+		return e.writeResult(dispatcherJSON{e.netns, "unload", false, 0})
 	} else if err != nil {
 		return err
 	}
 
 	e.stdout.Logf("unloaded dispatcher from %s\n", e.netns)
-	return nil
+	return e.writeResult(dispatcherJSON{e.netns, "unload", true, 0})
+}
+
+// checkUnload summarises the state that is lost by unloading dp.
+//
+// Unless force is true or dp is empty, it waits for interval to find out
+// which destinations are still receiving traffic.
+func checkUnload(e *env, dp *tubular.Dispatcher, force bool, save string, interval time.Duration) error {
+	bindings, err := dp.Bindings()
+	if err != nil {
+		return err
+	}
+
+	_, cookies, err := dp.Destinations()
+	if err != nil {
+		return err
+	}
+
+	if save != "" {
+		if err := saveConfig(save, bindings); err != nil {
+			return err
+		}
+		e.stdout.Logf("saved %d bindings to %s\n", len(bindings), save)
+	}
+
+	sockets := 0
+	for _, cookie := range cookies {
+		if cookie != 0 {
+			sockets++
+		}
+	}
+
+	if len(bindings) == 0 && sockets == 0 {
+		// Destinations only exist while bindings or sockets refer to them,
+		// so there is no traffic to wait for.
+		return nil
+	}
+
+	var lookups map[tubular.Destination]uint64
+	if !force {
+		// The counters are cumulative, so only an increase means
+		// that the dispatcher is in use.
+		before, err := dp.Metrics()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-e.ctx.Done():
+			return e.ctx.Err()
+		}
+
+		after, err := dp.Metrics()
+		if err != nil {
+			return err
+		}
+
+		lookups = recentLookups(before, after)
+	}
+
+	w := e.stdout
+	if !force {
+		w = e.stderr
+	}
+
+	w.Logf("unloading removes %d bindings and %d registered sockets\n", len(bindings), sockets)
+	sort.Sort(bindings)
+	for _, bind := range bindings {
+		w.Log("  binding", bind)
+	}
+
+	dests := make([]tubular.Destination, 0, len(cookies))
+	for dest, cookie := range cookies {
+		if cookie != 0 {
+			dests = append(dests, dest)
+		}
+	}
+	sortDestinations(dests)
+	for _, dest := range dests {
+		w.Log("  socket", cookies[dest], "for", &dest)
+	}
+
+	if len(lookups) > 0 {
+		w.Logf("destinations steered lookups in the last %s\n", interval)
+
+		active := make([]tubular.Destination, 0, len(lookups))
+		for dest := range lookups {
+			active = append(active, dest)
+		}
+		sortDestinations(active)
+		for _, dest := range active {
+			w.Logf("  %d lookups for %s\n", lookups[dest], &dest)
+		}
+	}
+
+	if force {
+		return nil
+	}
+
+	return fmt.Errorf("dispatcher is in use, specify -force to unload anyway")
+}
+
+// recentLookups returns the number of lookups per destination between two
+// samples of the metrics. Destinations without lookups are omitted.
+func recentLookups(before, after *tubular.Metrics) map[tubular.Destination]uint64 {
+	lookups := make(map[tubular.Destination]uint64)
+	for dest, metrics := range after.Destinations {
+		// Destinations which were added in between start out at zero.
+		if n := metrics.Lookups - before.Destinations[dest].Lookups; n > 0 {
+			lookups[dest] = n
+		}
+	}
+	return lookups
 }
 
 func upgrade(e *env, args ...string) error {
 	set := e.newFlagSet("upgrade")
-	set.Description = "Upgrade the tubular dispatcher, while preserving present state."
+	set.Description = `
+		Upgrade the tubular dispatcher, while preserving present state.
+
+		With -verify, lookups for all bindings are simulated using the
+		current and the new program. The upgrade is refused if the
+		results differ. Simulated lookups are included in metrics.
+
+		-corpus simulates the lookups from a JSON formatted file instead
+		and implies -verify:
+
+		    {"lookups":["tcp:127.0.0.1:80","udp:[::1]:53"]}`
+	verify := set.Bool("verify", false, "refuse to upgrade if the new program steers traffic differently")
+	corpusPath := set.String("corpus", "", "`file` containing lookups to verify the upgrade with")
 	if err := set.Parse(args); err != nil {
 		return err
 	}
 
+	var corpus []tubular.Lookup
+	if *corpusPath != "" {
+		var err error
+		corpus, err = loadCorpus(*corpusPath)
+		if err != nil {
+			return err
+		}
+	}
+
 	if err := e.setupEnv(); err != nil {
 		return err
 	}
 
-	id, err := internal.UpgradeDispatcher(e.netns, e.bpfFs)
+	var (
+		id  tubular.ProgramID
+		err error
+	)
+	switch {
+	case corpus != nil:
+		id, err = tubular.UpgradeDispatcherWithCorpus(e.netns, e.bpfFs, Version, corpus)
+	case *verify:
+		id, err = tubular.UpgradeDispatcherVerified(e.netns, e.bpfFs, Version)
+	default:
+		id, err = tubular.UpgradeDispatcher(e.netns, e.bpfFs, Version)
+	}
 	if err != nil {
 		return err
 	}
 
 	e.stdout.Logf("Upgraded dispatcher to %s, program ID #%d", Version, id)
-	return nil
+	return e.writeResult(dispatcherJSON{e.netns, "upgrade", true, uint32(id)})
+}
+
+type corpusJSON struct {
+	Lookups []tubular.Lookup `json:"lookups"`
+}
+
+func loadCorpus(path string) ([]tubular.Lookup, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var corpus corpusJSON
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&corpus); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", file.Name(), errBadArg, err)
+	}
+
+	if len(corpus.Lookups) == 0 {
+		return nil, fmt.Errorf("%s: %w: no lookups", file.Name(), errBadArg)
+	}
+
+	return corpus.Lookups, nil
+}
+
+func rollback(e *env, args ...string) error {
+	set := e.newFlagSet("rollback")
+	set.Description = `
+		Revert the tubular dispatcher to the program replaced by the last
+		upgrade, while preserving present state.
+
+		The current program is kept, so running rollback again reverts
+		the rollback.`
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	if err := e.setupEnv(); err != nil {
+		return err
+	}
+
+	id, err := tubular.RollbackDispatcher(e.netns, e.bpfFs)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("dispatcher hasn't been upgraded: %w", err)
+	} else if err != nil {
+		return err
+	}
+
+	e.stdout.Logf("Rolled back dispatcher to program ID #%d\n", id)
+	return e.writeResult(dispatcherJSON{e.netns, "rollback", true, uint32(id)})
+}
+
+func pause(e *env, args ...string) error {
+	set := e.newFlagSet("pause")
+	set.Description = `
+		Detach the tubular dispatcher from the network namespace, while
+		preserving present state.
+
+		Traffic is delivered as if tubular wasn't loaded until resume is
+		called.`
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	dp, err := e.openDispatcher(false)
+	if err != nil {
+		return err
+	}
+	defer dp.Close()
+
+	if paused, err := dp.Paused(); err != nil {
+		return err
+	} else if paused {
+		e.stderr.Log("dispatcher is already paused in", e.netns)
+		return e.writeResult(dispatcherJSON{e.netns, "pause", false, 0})
+	}
+
+	if err := dp.Pause(); err != nil {
+		return err
+	}
+
+	e.stdout.Logf("paused dispatcher in %s\n", e.netns)
+	return e.writeResult(dispatcherJSON{e.netns, "pause", true, 0})
+}
+
+func resume(e *env, args ...string) error {
+	set := e.newFlagSet("resume")
+	set.Description = "Attach a paused tubular dispatcher to the network namespace again."
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	dp, err := e.openDispatcher(false)
+	if err != nil {
+		return err
+	}
+	defer dp.Close()
+
+	if paused, err := dp.Paused(); err != nil {
+		return err
+	} else if !paused {
+		e.stderr.Log("dispatcher is not paused in", e.netns)
+		return e.writeResult(dispatcherJSON{e.netns, "resume", false, 0})
+	}
+
+	if err := dp.Resume(); err != nil {
+		return err
+	}
+
+	e.stdout.Logf("resumed dispatcher in %s\n", e.netns)
+	return e.writeResult(dispatcherJSON{e.netns, "resume", true, 0})
 }
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/cloudflare/tubular"
 	"github.com/cloudflare/tubular/internal"
 	"github.com/cloudflare/tubular/internal/testutil"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestLoadUnload(t *testing.T) {
@@ -21,6 +27,62 @@ func TestLoadUnload(t *testing.T) {
 	mustTestTubectl(t, netns, "unload")
 }
 
+func TestUnloadInUse(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustAddBinding(t, dp, "foo", tubular.TCP, "127.0.0.1", 80)
+	dp.Close()
+
+	if _, err := testTubectl(t, netns, "unload"); err == nil {
+		t.Fatal("Unload doesn't refuse a dispatcher with bindings")
+	}
+
+	file := filepath.Join(t.TempDir(), "bindings.json")
+	output := mustTestTubectl(t, netns, "unload", "-force", "-save", file)
+	if !strings.Contains(output.String(), "foo") {
+		t.Error("Output doesn't mention binding")
+	}
+
+	bindings, err := loadConfig(file)
+	if err != nil {
+		t.Fatal("Can't load saved bindings:", err)
+	}
+
+	want := tubular.Bindings{
+		mustNewBinding(t, "foo", tubular.TCP, "127.0.0.1", 80),
+	}
+	if diff := cmp.Diff(want, bindings, prefixComparer()); diff != "" {
+		t.Errorf("Saved bindings don't match (-want +got):\n%s", diff)
+	}
+}
+
+func TestRecentLookups(t *testing.T) {
+	foo := tubular.Destination{Label: "foo", Domain: tubular.AF_INET, Protocol: tubular.TCP}
+	bar := tubular.Destination{Label: "bar", Domain: tubular.AF_INET, Protocol: tubular.TCP}
+
+	before := &tubular.Metrics{
+		Destinations: map[tubular.Destination]tubular.DestinationMetrics{
+			foo: {Lookups: 10},
+		},
+	}
+	after := &tubular.Metrics{
+		Destinations: map[tubular.Destination]tubular.DestinationMetrics{
+			foo: {Lookups: 10},
+			bar: {Lookups: 2},
+		},
+	}
+
+	if lookups := recentLookups(before, before); len(lookups) != 0 {
+		t.Error("Expected no recent lookups for identical samples, got", lookups)
+	}
+
+	want := map[tubular.Destination]uint64{bar: 2}
+	if diff := cmp.Diff(want, recentLookups(before, after)); diff != "" {
+		t.Errorf("Recent lookups don't match (-want +got):\n%s", diff)
+	}
+}
+
 func TestUpgrade(t *testing.T) {
 	netns := mustReadyNetNS(t)
 
@@ -35,3 +97,139 @@ func TestUpgrade(t *testing.T) {
 		t.Error("Output doesn't contain version")
 	}
 }
+
+func TestUpgradeVerify(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustAddBinding(t, dp, "foo", tubular.TCP, "127.0.0.1", 80)
+	dp.Close()
+
+	upgrade := tubectlTestCall{
+		NetNS:     netns,
+		Cmd:       "upgrade",
+		Args:      []string{"-verify"},
+		Effective: internal.CreateCapabilities,
+	}
+	upgrade.MustRun(t)
+}
+
+func TestUpgradeCorpus(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustAddBinding(t, dp, "foo", tubular.TCP, "127.0.0.1", 80)
+	dp.Close()
+
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name, corpus string
+		valid        bool
+	}{
+		{"valid", `{"lookups":["tcp:127.0.0.1:80","udp:[::1]:53"]}`, true},
+		{"empty", `{"lookups":[]}`, false},
+		{"invalid lookup", `{"lookups":["tcp:127.0.0.1"]}`, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.name+".json")
+			if err := os.WriteFile(path, []byte(tc.corpus), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			upgrade := tubectlTestCall{
+				NetNS:     netns,
+				Cmd:       "upgrade",
+				Args:      []string{"-corpus", path},
+				Effective: internal.CreateCapabilities,
+			}
+
+			_, err := upgrade.Run(t)
+			if tc.valid && err != nil {
+				t.Fatal("Upgrade with valid corpus failed:", err)
+			} else if !tc.valid && !errors.Is(err, errBadArg) {
+				t.Fatal("Expected errBadArg for invalid corpus, got", err)
+			}
+		})
+	}
+}
+
+func TestRollback(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	rollback := tubectlTestCall{
+		NetNS:     netns,
+		Cmd:       "rollback",
+		Effective: internal.CreateCapabilities,
+	}
+
+	if _, err := rollback.Run(t); err == nil {
+		t.Fatal("Rollback without upgrade doesn't return an error")
+	}
+
+	upgrade := tubectlTestCall{
+		NetNS:     netns,
+		Cmd:       "upgrade",
+		Effective: internal.CreateCapabilities,
+	}
+	upgrade.MustRun(t)
+
+	rollback.MustRun(t)
+
+	output := mustTestTubectl(t, netns, "status")
+	if !strings.Contains(output.String(), "previous") {
+		t.Error("Output of status doesn't contain previous program")
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	mustTestTubectl(t, netns, "pause")
+
+	output := mustTestTubectl(t, netns, "status")
+	if !strings.Contains(output.String(), "paused") {
+		t.Error("Output of status doesn't mention paused dispatcher")
+	}
+
+	resume := tubectlTestCall{
+		NetNS:     netns,
+		Cmd:       "resume",
+		Effective: internal.CreateCapabilities,
+	}
+	resume.MustRun(t)
+
+	output = mustTestTubectl(t, netns, "status")
+	if strings.Contains(output.String(), "paused") {
+		t.Error("Output of status mentions paused dispatcher after resume")
+	}
+}
+
+func TestPauseResumeJSON(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	for _, tc := range []struct {
+		cmd     string
+		changed bool
+	}{
+		{"pause", true},
+		{"pause", false},
+		{"resume", true},
+		{"resume", false},
+	} {
+		tubectl := tubectlTestCall{
+			NetNS:     netns,
+			Cmd:       tc.cmd,
+			Effective: internal.CreateCapabilities,
+		}
+
+		var result dispatcherJSON
+		if err := tubectl.RunJSON(t, &result); err != nil {
+			t.Fatalf("Can't execute %s: %s", tc.cmd, err)
+		}
+
+		want := dispatcherJSON{netns.Path(), tc.cmd, tc.changed, 0}
+		if result != want {
+			t.Errorf("Expected %+v, got %+v", want, result)
+		}
+	}
+}
@@ -6,11 +6,12 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
-	"syscall"
 
-	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular"
+	"github.com/cloudflare/tubular/internal/cgroup"
 	"github.com/cloudflare/tubular/internal/log"
 	"github.com/cloudflare/tubular/internal/rlimit"
 
@@ -22,13 +23,21 @@ type env struct {
 	stdout, stderr log.Logger
 	netns          string
 	bpfFs          string
+	cgroupFs       string
 	ctx            context.Context
+	// Path to the label policy, empty if no policy is enforced.
+	policy string
 	// Override for os.Getenv
 	getenv func(key string) string
 	// Override for os.NewFile
 	newFile func(fd uintptr, name string) *os.File
 	// Override for net.Listen
 	listen func(network, addr string) (net.Listener, error)
+	// The format of the result. Unless it's text, log messages go to stderr
+	// and the result is written to output.
+	format      outputFormat
+	output      io.Writer
+	wroteResult bool
 }
 
 var (
@@ -36,14 +45,18 @@ var (
 		stdout:  log.NewStdLogger(os.Stdout),
 		stderr:  log.NewStdLogger(os.Stderr),
 		ctx:     context.Background(),
+		policy:  defaultPolicyPath,
 		getenv:  os.Getenv,
 		newFile: os.NewFile,
 		listen:  net.Listen,
+		format:  formatText,
 	}
 
-	// Errors returned by tubectl
-	errBadArg = syscall.EINVAL
-	errBadFD  = syscall.EBADF
+	// Errors returned by tubectl. They are distinct from the syscall errors
+	// with the same message so that errors from the kernel aren't mistaken
+	// for usage errors.
+	errBadArg = errors.New("invalid argument")
+	errBadFD  = errors.New("bad file descriptor")
 )
 
 func (e *env) setupEnv() error {
@@ -63,31 +76,31 @@ func (e *env) setupEnv() error {
 	return nil
 }
 
-func (e *env) createDispatcher() (*internal.Dispatcher, error) {
+func (e *env) createDispatcher() (*tubular.Dispatcher, error) {
 	if err := e.setupEnv(); err != nil {
 		return nil, err
 	}
 
-	dp, err := internal.CreateDispatcher(e.netns, e.bpfFs)
+	dp, err := tubular.CreateDispatcher(e.netns, e.bpfFs, Version)
 	if err != nil {
 		return nil, fmt.Errorf("can't load dispatcher: %w", err)
 	}
 
-	e.stdout.Logf("created dispatcher in %v\n", dp.Path)
+	e.stdout.Logf("created dispatcher in %v\n", dp.Path())
 	return dp, nil
 }
 
-func (e *env) openDispatcher(readOnly bool) (*internal.Dispatcher, error) {
+func (e *env) openDispatcher(readOnly bool) (*tubular.Dispatcher, error) {
 	if err := e.setupEnv(); err != nil {
 		return nil, err
 	}
 
-	dp, err := internal.OpenDispatcher(e.netns, e.bpfFs, readOnly)
+	dp, err := tubular.OpenDispatcher(e.netns, e.bpfFs, readOnly)
 	if err != nil {
 		return nil, fmt.Errorf("can't open dispatcher: %w", err)
 	}
 
-	e.stdout.Logf("opened dispatcher at %v\n", dp.Path)
+	e.stdout.Logf("opened dispatcher at %v\n", dp.Path())
 	return dp, nil
 }
 
@@ -106,9 +119,14 @@ var cmds = []struct {
 	// Dispatcher lifecycle.
 	{"status", status, false},
 	{"metrics", metrics, false},
+	{"serve", serve, false},
+	{"doctor", doctor, false},
 	{"load", load, false},
 	{"unload", unload, false},
 	{"upgrade", upgrade, false},
+	{"rollback", rollback, false},
+	{"pause", pause, false},
+	{"resume", resume, false},
 	// Bindings
 	{"bindings", bindings, false},
 	{"bind", bind, false},
@@ -117,15 +135,24 @@ var cmds = []struct {
 	// Destinations
 	{"register", register, false},
 	{"register-pid", registerPID, false},
+	{"register-cgroup", registerCgroup, false},
+	{"run", runCommand, false},
+	{"register-agent", registerAgent, false},
 	{"unregister", unregister, false},
+	{"sockets", sockets, false},
 	// Deprecated
 	{"list", list, true},
 }
 
 func tubectl(e env, args []string) (err error) {
 	defer func() {
-		if err != nil {
-			e.stderr.Log("Error:", err)
+		if err == nil {
+			return
+		}
+
+		e.stderr.Log("Error:", err)
+		if e.format.structured() && !e.wroteResult {
+			e.writeResult(newErrorJSON(err))
 		}
 	}()
 
@@ -133,6 +160,8 @@ func tubectl(e env, args []string) (err error) {
 	set.SetOutput(e.stderr)
 	set.StringVar(&e.netns, "netns", "/proc/self/ns/net", "`path` to the network namespace")
 	set.StringVar(&e.bpfFs, "bpffs", "/sys/fs/bpf", "`path` to a BPF filesystem for state")
+	set.StringVar(&e.cgroupFs, "cgroupfs", cgroup.Root, "`path` to the unified cgroup hierarchy")
+	set.Var(&e.format, "o", "write results in `format` text, json or yaml")
 
 	set.Usage = func() {
 		out := set.Output()
@@ -150,25 +179,32 @@ func tubectl(e env, args []string) (err error) {
 			fmt.Fprintln(out, "  "+cmd.name)
 		}
 		fmt.Fprintln(out)
+
+		printExitStatuses(out)
+		fmt.Fprintln(out)
 	}
 
 	if err := set.Parse(args); errors.Is(err, flag.ErrHelp) {
 		return nil
 	} else if err != nil {
-		return err
+		return fmt.Errorf("%w: %s", errBadArg, err)
 	}
 
 	if e.netns == "" {
-		return fmt.Errorf("invalid -netns flag")
+		return fmt.Errorf("%w: invalid -netns flag", errBadArg)
 	}
 
 	if e.bpfFs == "" {
-		return fmt.Errorf("invalid -bpffs flag")
+		return fmt.Errorf("%w: invalid -bpffs flag", errBadArg)
+	}
+
+	if e.format.structured() {
+		e.output, e.stdout = e.stdout, e.stderr
 	}
 
 	if set.NArg() < 1 {
 		set.Usage()
-		return fmt.Errorf("missing command")
+		return fmt.Errorf("%w: missing command", errBadArg)
 	}
 
 	var (
@@ -190,11 +226,11 @@ func tubectl(e env, args []string) (err error) {
 	}
 
 	set.Usage()
-	return fmt.Errorf("unknown command '%s'", cmdName)
+	return fmt.Errorf("%w: unknown command '%s'", errBadArg, cmdName)
 }
 
 func main() {
 	if err := tubectl(defaultEnv, os.Args[1:]); err != nil {
-		os.Exit(1)
+		os.Exit(exitStatus(err))
 	}
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"net"
@@ -12,6 +13,7 @@ import (
 	"syscall"
 	"testing"
 
+	"github.com/cloudflare/tubular"
 	"github.com/cloudflare/tubular/internal"
 	"github.com/cloudflare/tubular/internal/log"
 	"github.com/cloudflare/tubular/internal/sysconn"
@@ -81,24 +83,24 @@ func mustReadyNetNS(tb testing.TB) ns.NetNS {
 func mustLoadDispatcher(tb testing.TB, netns ns.NetNS) {
 	tb.Helper()
 
-	var dp *internal.Dispatcher
+	var dp *tubular.Dispatcher
 	err := testutil.WithCapabilities(func() (err error) {
-		dp, err = internal.CreateDispatcher(netns.Path(), "/sys/fs/bpf")
+		dp, err = tubular.CreateDispatcher(netns.Path(), "/sys/fs/bpf", "test")
 		return
 	}, internal.CreateCapabilities...)
 	if err != nil {
 		tb.Fatal(err)
 	}
-	tb.Cleanup(func() { os.RemoveAll(dp.Path) })
+	tb.Cleanup(func() { os.RemoveAll(dp.Path()) })
 
 	if err := dp.Close(); err != nil {
 		tb.Fatal("Can't close dispatcher:", err)
 	}
 }
 
-func mustOpenDispatcher(tb testing.TB, netns ns.NetNS) *internal.Dispatcher {
+func mustOpenDispatcher(tb testing.TB, netns ns.NetNS) *tubular.Dispatcher {
 	tb.Helper()
-	dp, err := internal.OpenDispatcher(netns.Path(), "/sys/fs/bpf", false)
+	dp, err := tubular.OpenDispatcher(netns.Path(), "/sys/fs/bpf", false)
 	if err != nil {
 		tb.Fatal(err)
 	}
@@ -106,10 +108,10 @@ func mustOpenDispatcher(tb testing.TB, netns ns.NetNS) *internal.Dispatcher {
 	return dp
 }
 
-func mustAddBinding(tb testing.TB, dp *internal.Dispatcher, label string, proto internal.Protocol, prefix string, port uint16) {
+func mustAddBinding(tb testing.TB, dp *tubular.Dispatcher, label string, proto tubular.Protocol, prefix string, port uint16) {
 	tb.Helper()
 
-	bind, err := internal.NewBinding(label, proto, prefix, port)
+	bind, err := tubular.NewBinding(label, proto, prefix, port)
 	if err != nil {
 		tb.Fatal(err)
 	}
@@ -120,7 +122,7 @@ func mustAddBinding(tb testing.TB, dp *internal.Dispatcher, label string, proto
 	}
 }
 
-func mustRegisterSocket(tb testing.TB, dp *internal.Dispatcher, label string, file syscall.Conn) *internal.Destination {
+func mustRegisterSocket(tb testing.TB, dp *tubular.Dispatcher, label string, file syscall.Conn) *tubular.Destination {
 	tb.Helper()
 
 	dest, _, err := dp.RegisterSocket(label, file)
@@ -165,6 +167,17 @@ type tubectlTestCall struct {
 	// Effective lists the capabilities required for this call. The effective
 	// set isn't changed if the slice is empty.
 	Effective []cap.Value
+
+	// Policy is the path to the label policy. No policy is enforced if it's
+	// empty.
+	Policy string
+
+	// Format is passed via -o if it's not empty.
+	Format outputFormat
+
+	// Stdout receives the standard output of the call instead of the
+	// buffer shared with standard error if it's not nil.
+	Stdout log.Logger
 }
 
 func (tc *tubectlTestCall) Run(tb testing.TB) (*bytes.Buffer, error) {
@@ -178,10 +191,16 @@ func (tc *tubectlTestCall) Run(tb testing.TB) (*bytes.Buffer, error) {
 }
 
 func (tc *tubectlTestCall) run(tb testing.TB, ctx context.Context, output log.Logger) error {
+	stdout := output
+	if tc.Stdout != nil {
+		stdout = tc.Stdout
+	}
+
 	env := env{
-		stdout: output,
+		stdout: stdout,
 		stderr: output,
 		ctx:    ctx,
+		policy: tc.Policy,
 		getenv: func(key string) string { return tc.getenv(key) },
 		newFile: func(fd uintptr, name string) *os.File {
 			return tc.newFile(fd, name)
@@ -202,6 +221,9 @@ func (tc *tubectlTestCall) run(tb testing.TB, ctx context.Context, output log.Lo
 	if tc.NetNS != nil {
 		args = append(args, "-netns", tc.NetNS.Path())
 	}
+	if tc.Format != "" {
+		args = append(args, "-o", string(tc.Format))
+	}
 	if tc.Cmd != "" {
 		args = append(args, tc.Cmd)
 	}
@@ -249,6 +271,31 @@ func (tc *tubectlTestCall) MustRun(tb testing.TB) *bytes.Buffer {
 	return output
 }
 
+// RunJSON invokes tubectl with -o json and decodes its result into v.
+//
+// The error is returned from tubectl, the result is decoded regardless.
+func (tc *tubectlTestCall) RunJSON(tb testing.TB, v interface{}) error {
+	tb.Helper()
+
+	var stdout, stderr log.Buffer
+	call := *tc
+	call.Format, call.Stdout = formatJSON, &stdout
+	err := call.run(tb, context.Background(), &stderr)
+	tb.Logf("tubectl -o json %s %s\n%s%s", tc.Cmd, strings.Join(tc.Args, " "), &stderr, &stdout)
+
+	dec := json.NewDecoder(&stdout)
+	dec.DisallowUnknownFields()
+	if decErr := dec.Decode(v); decErr != nil {
+		tb.Fatal("Can't decode result:", decErr)
+	}
+
+	if dec.More() {
+		tb.Fatal("Result contains more than one document")
+	}
+
+	return err
+}
+
 func (tc *tubectlTestCall) Start(tb testing.TB) (stop func()) {
 	ctx, cancel := context.WithCancel(context.Background())
 	tb.Cleanup(cancel)
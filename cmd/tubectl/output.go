@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// outputFormat is the format of the result written by a command.
+type outputFormat string
+
+const (
+	formatText outputFormat = "text"
+	formatJSON outputFormat = "json"
+	formatYAML outputFormat = "yaml"
+)
+
+func (of *outputFormat) String() string {
+	return string(*of)
+}
+
+func (of *outputFormat) Set(value string) error {
+	switch format := outputFormat(value); format {
+	case formatText, formatJSON, formatYAML:
+		*of = format
+		return nil
+	default:
+		return fmt.Errorf("expected text, json or yaml, got %q", value)
+	}
+}
+
+// structured returns true if commands write a document instead of human
+// readable output.
+func (of outputFormat) structured() bool {
+	return of == formatJSON || of == formatYAML
+}
+
+// writeResult writes the result of a command to stdout as a JSON or YAML
+// document.
+//
+// It does nothing for text output, commands log human readable messages
+// instead. At most one result is written per invocation.
+func (e *env) writeResult(v interface{}) error {
+	if !e.format.structured() {
+		return nil
+	}
+
+	buf, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return fmt.Errorf("marshal result: %s", err)
+	}
+	buf = append(buf, '\n')
+
+	if e.format == formatYAML {
+		buf, err = jsonToYAML(buf)
+		if err != nil {
+			return fmt.Errorf("marshal result: %s", err)
+		}
+	}
+
+	e.wroteResult = true
+	_, err = e.output.Write(buf)
+	return err
+}
+
+type errorJSON struct {
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+}
+
+func newErrorJSON(err error) errorJSON {
+	return errorJSON{err.Error(), errorCode(err)}
+}
+
+// jsonToYAML converts a JSON document into YAML, preserving the order of
+// keys.
+//
+// Strings are always quoted, since JSON strings are valid YAML double quoted
+// scalars.
+func jsonToYAML(in []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(in))
+	dec.UseNumber()
+
+	value, err := decodeYAMLValue(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if scalar, ok := yamlScalar(value); ok {
+		out.WriteString(scalar + "\n")
+	} else {
+		writeYAML(&out, value, "", "")
+	}
+	return out.Bytes(), nil
+}
+
+type yamlMapping []yamlPair
+
+type yamlPair struct {
+	key   string
+	value interface{}
+}
+
+type yamlSequence []interface{}
+
+func decodeYAMLValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		mapping := yamlMapping{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := decodeYAMLValue(dec)
+			if err != nil {
+				return nil, err
+			}
+
+			mapping = append(mapping, yamlPair{key.(string), value})
+		}
+		_, err := dec.Token()
+		return mapping, err
+
+	case json.Delim('['):
+		seq := yamlSequence{}
+		for dec.More() {
+			value, err := decodeYAMLValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, value)
+		}
+		_, err := dec.Token()
+		return seq, err
+
+	default:
+		return tok, nil
+	}
+}
+
+// yamlScalar formats values which fit on a single line.
+func yamlScalar(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "null", true
+	case bool:
+		return fmt.Sprint(v), true
+	case json.Number:
+		return v.String(), true
+	case string:
+		quoted, _ := json.Marshal(v)
+		return string(quoted), true
+	case yamlMapping:
+		return "{}", len(v) == 0
+	case yamlSequence:
+		return "[]", len(v) == 0
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// writeYAML writes a non-empty mapping or sequence. The first line is
+// prefixed with first, all other lines with indent.
+func writeYAML(out *bytes.Buffer, value interface{}, first, indent string) {
+	prefix := func(i int) string {
+		if i == 0 {
+			return first
+		}
+		return indent
+	}
+
+	var (
+		items []interface{}
+		keys  []string
+	)
+	switch v := value.(type) {
+	case yamlMapping:
+		for _, pair := range v {
+			keys = append(keys, pair.key+":")
+			items = append(items, pair.value)
+		}
+	case yamlSequence:
+		for _, item := range v {
+			keys = append(keys, "-")
+			items = append(items, item)
+		}
+	}
+
+	for i, item := range items {
+		line := prefix(i) + keys[i]
+		if scalar, ok := yamlScalar(item); ok {
+			out.WriteString(line + " " + scalar + "\n")
+			continue
+		}
+
+		if _, ok := value.(yamlSequence); ok {
+			// Nested collections start on the same line as the dash.
+			writeYAML(out, item, line+" ", indent+"  ")
+			continue
+		}
+
+		out.WriteString(strings.TrimRight(line, " ") + "\n")
+		writeYAML(out, item, indent+"  ", indent+"  ")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/cloudflare/tubular/internal/testutil"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestOutputFormat(t *testing.T) {
+	for _, value := range []string{"text", "json", "yaml"} {
+		var format outputFormat
+		if err := format.Set(value); err != nil {
+			t.Errorf("Rejected %q: %s", value, err)
+		}
+	}
+
+	for _, value := range []string{"", "JSON", "xml"} {
+		var format outputFormat
+		if err := format.Set(value); err == nil {
+			t.Errorf("Accepted %q", value)
+		}
+	}
+}
+
+func TestJSONToYAML(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{`"foo"`, `"foo"` + "\n"},
+		{`[]`, "[]\n"},
+		{`{}`, "{}\n"},
+		{
+			`{"b": 1, "a": [true, null], "c": {}, "d": "x: y"}`,
+			"b: 1\na:\n  - true\n  - null\nc: {}\nd: \"x: y\"\n",
+		},
+		{
+			`[{"label": "foo", "port": 80}, [1, 2], {"nested": {"x": []}}]`,
+			"- label: \"foo\"\n  port: 80\n- - 1\n  - 2\n- nested:\n    x: []\n",
+		},
+	} {
+		out, err := jsonToYAML([]byte(tc.in))
+		if err != nil {
+			t.Errorf("Can't convert %s: %s", tc.in, err)
+			continue
+		}
+
+		if diff := cmp.Diff(tc.out, string(out)); diff != "" {
+			t.Errorf("Output for %s doesn't match (-want +got):\n%s", tc.in, diff)
+		}
+	}
+}
+
+func TestErrorJSON(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	loaded := mustReadyNetNS(t)
+
+	for _, tc := range []struct {
+		cmd   string
+		netns ns.NetNS
+		args  []string
+		code  string
+	}{
+		{"status", netns, nil, "not_loaded"},
+		{"unregister", netns, []string{"-cookie", "foo", "foo", "ipv4", "tcp"}, "bad_argument"},
+		{"unbind", loaded, []string{"foo", "tcp", "127.0.0.1", "80"}, "binding_not_found"},
+		{"unregister", loaded, []string{"foo", "ipv4", "tcp"}, "socket_not_found"},
+	} {
+		t.Run(tc.cmd, func(t *testing.T) {
+			tubectl := tubectlTestCall{
+				NetNS: tc.netns,
+				Cmd:   tc.cmd,
+				Args:  tc.args,
+			}
+
+			var result errorJSON
+			if err := tubectl.RunJSON(t, &result); err == nil {
+				t.Fatal("Command didn't fail")
+			}
+
+			if result.Code != tc.code {
+				t.Errorf("Expected code %q, got %q", tc.code, result.Code)
+			}
+
+			if result.Error == "" {
+				t.Error("Error message is missing")
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloudflare/tubular"
+
+	"golang.org/x/sys/unix"
+)
+
+// defaultPolicyPath is the location of the label policy.
+//
+// It can't be changed from the command line, since tubectl may be invoked
+// via sudo by users which are restricted by the policy.
+const defaultPolicyPath = "/etc/tubular/policy.json"
+
+// policyJSON grants users and groups access to labels.
+//
+// A label is either used verbatim, or is a prefix ending in "/*" which
+// matches all labels starting with the prefix. "*" matches all labels.
+type policyJSON struct {
+	Rules []policyRuleJSON `json:"rules"`
+}
+
+type policyRuleJSON struct {
+	// Users by name or numeric ID.
+	Users []string `json:"users,omitempty"`
+	// Groups by name or numeric ID.
+	Groups []string `json:"groups,omitempty"`
+	Labels []string `json:"labels"`
+}
+
+type policyRule struct {
+	uids   map[uint32]bool
+	gids   map[uint32]bool
+	labels []string
+}
+
+// policy decides which labels a peer may use.
+type policy struct {
+	rules []policyRule
+	// Override for looking up the supplementary groups of a user.
+	groupIDs func(uid uint32) []uint32
+}
+
+func loadPolicy(path string) (*policy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config policyJSON
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s: %s", file.Name(), err)
+	}
+
+	pol, err := newPolicy(&config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file.Name(), err)
+	}
+	return pol, nil
+}
+
+func newPolicy(config *policyJSON) (*policy, error) {
+	pol := &policy{groupIDs: supplementaryGroupIDs}
+	for i, rj := range config.Rules {
+		rule := policyRule{
+			make(map[uint32]bool),
+			make(map[uint32]bool),
+			nil,
+		}
+
+		for _, name := range rj.Users {
+			uid, err := lookupID(name, func(name string) (string, error) {
+				usr, err := user.Lookup(name)
+				if err != nil {
+					return "", err
+				}
+				return usr.Uid, nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: user %s: %s", i, name, err)
+			}
+			rule.uids[uid] = true
+		}
+
+		for _, name := range rj.Groups {
+			gid, err := lookupID(name, func(name string) (string, error) {
+				grp, err := user.LookupGroup(name)
+				if err != nil {
+					return "", err
+				}
+				return grp.Gid, nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: group %s: %s", i, name, err)
+			}
+			rule.gids[gid] = true
+		}
+
+		if len(rj.Labels) == 0 {
+			return nil, fmt.Errorf("rule %d: no labels", i)
+		}
+
+		for _, label := range rj.Labels {
+			if err := validateLabelPattern(label); err != nil {
+				return nil, fmt.Errorf("rule %d: %s", i, err)
+			}
+			rule.labels = append(rule.labels, label)
+		}
+
+		pol.rules = append(pol.rules, rule)
+	}
+
+	return pol, nil
+}
+
+func validateLabelPattern(pattern string) error {
+	switch {
+	case pattern == "":
+		return fmt.Errorf("empty label")
+	case pattern == "*":
+		return nil
+	case strings.HasSuffix(pattern, "/*"):
+		pattern = strings.TrimSuffix(pattern, "*")
+	}
+
+	if strings.Contains(pattern, "*") {
+		return fmt.Errorf("label %q: wildcard is only allowed as a trailing /*", pattern)
+	}
+	return nil
+}
+
+// matchLabel returns true if label matches pattern.
+func matchLabel(pattern, label string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasSuffix(pattern, "/*"):
+		return strings.HasPrefix(label, strings.TrimSuffix(pattern, "*"))
+	default:
+		return pattern == label
+	}
+}
+
+func (rule *policyRule) matchLabel(label string) bool {
+	for _, pattern := range rule.labels {
+		if matchLabel(pattern, label) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupID parses a numeric ID or resolves a name using lookup.
+func lookupID(name string, lookup func(string) (string, error)) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	parsed, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q: %s", id, err)
+	}
+	return uint32(parsed), nil
+}
+
+// allows returns nil if the peer may use label.
+func (pol *policy) allows(cred *unix.Ucred, label string) error {
+	if cred == nil {
+		return fmt.Errorf("unknown peer")
+	}
+
+	var gids []uint32
+	for _, rule := range pol.rules {
+		if !rule.matchLabel(label) {
+			continue
+		}
+
+		if rule.uids[cred.Uid] || rule.gids[cred.Gid] {
+			return nil
+		}
+
+		if len(rule.gids) == 0 {
+			continue
+		}
+
+		if gids == nil {
+			gids = pol.groupIDs(cred.Uid)
+		}
+		for _, gid := range gids {
+			if rule.gids[gid] {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("uid %d isn't allowed to use label %s: %w", cred.Uid, label, os.ErrPermission)
+}
+
+// labelChecker returns a function which checks whether the user invoking
+// tubectl may use a label.
+//
+// Returns a nil function if the user isn't restricted: either because
+// there is no policy, or because the user is root.
+func (e *env) labelChecker() (func(label string) error, error) {
+	if e.policy == "" {
+		return nil, nil
+	}
+
+	cred, err := e.caller()
+	if err != nil {
+		return nil, err
+	}
+	if cred.Uid == 0 {
+		return nil, nil
+	}
+
+	pol, err := loadPolicy(e.policy)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return func(label string) error {
+		return pol.allows(cred, label)
+	}, nil
+}
+
+// authorizeLabel checks that the user invoking tubectl may use label.
+func (e *env) authorizeLabel(label string) error {
+	check, err := e.labelChecker()
+	if err != nil || check == nil {
+		return err
+	}
+	return check(label)
+}
+
+// caller returns the credentials of the user invoking tubectl, taking sudo
+// into account.
+func (e *env) caller() (*unix.Ucred, error) {
+	if uid := os.Getuid(); uid != 0 {
+		return &unix.Ucred{Uid: uint32(uid), Gid: uint32(os.Getgid())}, nil
+	}
+
+	sudoUID, sudoGID := e.getenv("SUDO_UID"), e.getenv("SUDO_GID")
+	if sudoUID == "" {
+		return &unix.Ucred{Uid: 0, Gid: uint32(os.Getgid())}, nil
+	}
+
+	uid, err := strconv.ParseUint(sudoUID, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SUDO_UID %q: %s", sudoUID, err)
+	}
+
+	gid, err := strconv.ParseUint(sudoGID, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SUDO_GID %q: %s", sudoGID, err)
+	}
+
+	return &unix.Ucred{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// authorizeChanges checks that check allows the labels of all bindings which
+// differ between current and want.
+func authorizeChanges(check func(string) error, current, want tubular.Bindings) error {
+	if check == nil {
+		return nil
+	}
+
+	have := make(map[tubular.Binding]bool)
+	for _, bind := range current {
+		have[*bind] = true
+	}
+
+	wanted := make(map[tubular.Binding]bool)
+	for _, bind := range want {
+		wanted[*bind] = true
+	}
+
+	labels := make(map[string]bool)
+	for bind := range wanted {
+		if !have[bind] {
+			labels[bind.Label] = true
+		}
+	}
+	for bind := range have {
+		if !wanted[bind] {
+			labels[bind.Label] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(labels))
+	for label := range labels {
+		sorted = append(sorted, label)
+	}
+	sort.Strings(sorted)
+
+	for _, label := range sorted {
+		if err := check(label); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withBinding returns bindings with bind added, replacing any binding for
+// the same protocol, prefix and port.
+func withBinding(bindings tubular.Bindings, bind *tubular.Binding) tubular.Bindings {
+	var result tubular.Bindings
+	for _, b := range bindings {
+		if b.Protocol == bind.Protocol && b.Prefix == bind.Prefix && b.Port == bind.Port {
+			continue
+		}
+		result = append(result, b)
+	}
+	return append(result, bind)
+}
+
+// supplementaryGroupIDs returns the groups a user is a member of.
+func supplementaryGroupIDs(uid uint32) []uint32 {
+	usr, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return nil
+	}
+
+	names, err := usr.GroupIds()
+	if err != nil {
+		return nil
+	}
+
+	var gids []uint32
+	for _, name := range names {
+		if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+			gids = append(gids, uint32(gid))
+		}
+	}
+	return gids
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudflare/tubular"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPolicy(t *testing.T) {
+	pol, err := newPolicy(&policyJSON{
+		Rules: []policyRuleJSON{
+			{Users: []string{"1000"}, Labels: []string{"foo"}},
+			{Groups: []string{"2000"}, Labels: []string{"bar", "baz"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pol.groupIDs = func(uid uint32) []uint32 {
+		if uid == 1001 {
+			return []uint32{2000}
+		}
+		return nil
+	}
+
+	for _, tc := range []struct {
+		uid, gid uint32
+		label    string
+		allowed  bool
+	}{
+		{1000, 1000, "foo", true},
+		{1000, 1000, "bar", false},
+		{1002, 2000, "bar", true},
+		{1001, 1001, "baz", true},
+		{1001, 1001, "foo", false},
+		{1002, 1002, "baz", false},
+	} {
+		err := pol.allows(&unix.Ucred{Uid: tc.uid, Gid: tc.gid}, tc.label)
+		if tc.allowed && err != nil {
+			t.Errorf("uid %d gid %d isn't allowed to use %s: %s", tc.uid, tc.gid, tc.label, err)
+		} else if !tc.allowed && err == nil {
+			t.Errorf("uid %d gid %d is allowed to use %s", tc.uid, tc.gid, tc.label)
+		}
+	}
+
+	if err := pol.allows(nil, "foo"); err == nil {
+		t.Error("Unknown peer is allowed to use a label")
+	}
+}
+
+func TestPolicyInvalid(t *testing.T) {
+	for _, config := range []policyJSON{
+		{Rules: []policyRuleJSON{{Users: []string{"1000"}}}},
+		{Rules: []policyRuleJSON{{Users: []string{"1000"}, Labels: []string{""}}}},
+		{Rules: []policyRuleJSON{{Users: []string{"this-user-doesnt-exist"}, Labels: []string{"foo"}}}},
+	} {
+		if _, err := newPolicy(&config); err == nil {
+			t.Errorf("Accepted invalid policy %+v", config)
+		}
+	}
+}
+
+func TestPolicyLabelPatterns(t *testing.T) {
+	pol, err := newPolicy(&policyJSON{
+		Rules: []policyRuleJSON{
+			{Users: []string{"1000"}, Labels: []string{"team-a/*"}},
+			{Users: []string{"0"}, Labels: []string{"*"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pol.groupIDs = func(uint32) []uint32 { return nil }
+
+	for label, allowed := range map[string]bool{
+		"team-a/foo":     true,
+		"team-a/foo/bar": true,
+		"team-a":         false,
+		"team-ab/foo":    false,
+		"team-b/foo":     false,
+	} {
+		err := pol.allows(&unix.Ucred{Uid: 1000, Gid: 1000}, label)
+		if allowed && err != nil {
+			t.Errorf("Label %s isn't allowed: %s", label, err)
+		} else if !allowed && !errors.Is(err, os.ErrPermission) {
+			t.Errorf("Label %s is allowed", label)
+		}
+	}
+
+	if err := pol.allows(&unix.Ucred{Uid: 0}, "anything"); err != nil {
+		t.Error("Wildcard doesn't match:", err)
+	}
+
+	for _, pattern := range []string{"team-*", "*/foo", "team-a/*/bar"} {
+		if err := validateLabelPattern(pattern); err == nil {
+			t.Errorf("Accepted invalid pattern %q", pattern)
+		}
+	}
+}
+
+func TestAuthorizeChanges(t *testing.T) {
+	foo := mustNewBinding(t, "team-a/foo", tubular.TCP, "127.0.0.1", 80)
+	bar := mustNewBinding(t, "team-b/bar", tubular.TCP, "127.0.0.2", 80)
+	hijack := mustNewBinding(t, "team-a/foo", tubular.TCP, "127.0.0.2", 80)
+
+	var checked []string
+	check := func(label string) error {
+		checked = append(checked, label)
+		if label != "team-a/foo" {
+			return os.ErrPermission
+		}
+		return nil
+	}
+
+	current := tubular.Bindings{foo, bar}
+	if err := authorizeChanges(check, current, current); err != nil {
+		t.Error("Unchanged bindings aren't allowed:", err)
+	}
+	if len(checked) != 0 {
+		t.Error("Unchanged bindings are checked:", checked)
+	}
+
+	if err := authorizeChanges(check, current, withBinding(current, hijack)); err == nil {
+		t.Error("Replacing a binding of another label is allowed")
+	}
+
+	if err := authorizeChanges(check, current, tubular.Bindings{foo}); err == nil {
+		t.Error("Removing a binding of another label is allowed")
+	}
+
+	if err := authorizeChanges(check, tubular.Bindings{bar}, tubular.Bindings{bar, foo}); err != nil {
+		t.Error("Adding a binding is not allowed:", err)
+	}
+}
+
+func TestBindWithPolicy(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	policy := filepath.Join(t.TempDir(), "policy.json")
+	err := os.WriteFile(policy, []byte(`{"rules":[{"users":["1000"],"labels":["team-a/*"]}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sudo := testEnv{"SUDO_UID": "1000", "SUDO_GID": "1000"}
+	call := func(args ...string) error {
+		tc := tubectlTestCall{
+			NetNS:  netns,
+			Cmd:    "bind",
+			Args:   args,
+			Env:    sudo,
+			Policy: policy,
+		}
+		_, err := tc.Run(t)
+		return err
+	}
+
+	if err := call("team-a/foo", "tcp", "127.0.0.1", "80"); err != nil {
+		t.Fatal("Can't bind label granted by policy:", err)
+	}
+
+	if err := call("team-b/foo", "tcp", "127.0.0.2", "80"); !errors.Is(err, os.ErrPermission) {
+		t.Fatal("Expected permission error for label not granted by policy, got", err)
+	}
+}
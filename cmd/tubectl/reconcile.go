@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"github.com/cloudflare/tubular"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+// reconciler applies a bindings file to the dispatcher.
+type reconciler struct {
+	e     *env
+	path  string
+	owner string
+
+	attempts     *prometheus.CounterVec
+	changes      *prometheus.CounterVec
+	lastApplied  prometheus.Gauge
+	lastModified prometheus.Gauge
+}
+
+func newReconciler(e *env, path, owner string) *reconciler {
+	return &reconciler{
+		e, path, owner,
+		prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reconcile_total",
+			Help: "Total number of attempts to apply the bindings file",
+		}, []string{"result"}),
+		prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reconcile_bindings_changed_total",
+			Help: "Total number of bindings added or removed while applying the bindings file",
+		}, []string{"change"}),
+		prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "reconcile_last_applied_timestamp_seconds",
+			Help: "Time when the bindings file was last applied successfully",
+		}),
+		prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "reconcile_last_changed_timestamp_seconds",
+			Help: "Time when applying the bindings file last changed bindings",
+		}),
+	}
+}
+
+func (r *reconciler) register(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{r.attempts, r.changes, r.lastApplied, r.lastModified} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+
+	// Make sure that both results show up in the output.
+	r.attempts.WithLabelValues("success")
+	r.attempts.WithLabelValues("failure")
+	return nil
+}
+
+// reconcile applies the bindings file once.
+func (r *reconciler) reconcile() error {
+	err := r.apply()
+	if err != nil {
+		r.attempts.WithLabelValues("failure").Inc()
+		return err
+	}
+
+	r.attempts.WithLabelValues("success").Inc()
+	r.lastApplied.SetToCurrentTime()
+	return nil
+}
+
+func (r *reconciler) apply() error {
+	bindings, err := loadConfig(r.path)
+	if err != nil {
+		return err
+	}
+
+	check, err := r.e.labelChecker()
+	if err != nil {
+		return err
+	}
+
+	dp, err := tubular.OpenDispatcher(r.e.netns, r.e.bpfFs, false)
+	if err != nil {
+		return fmt.Errorf("can't open dispatcher: %w", err)
+	}
+	defer dp.Close()
+
+	added, removed, err := replaceBindings(dp, check, r.owner, bindings)
+	if err != nil {
+		return err
+	}
+
+	for _, bind := range added {
+		r.e.stdout.Log("added", bind)
+	}
+	for _, bind := range removed {
+		r.e.stdout.Log("removed", bind)
+	}
+
+	r.changes.WithLabelValues("added").Add(float64(len(added)))
+	r.changes.WithLabelValues("removed").Add(float64(len(removed)))
+	if len(added) > 0 || len(removed) > 0 {
+		r.lastModified.SetToCurrentTime()
+	}
+
+	return nil
+}
+
+// watchBindings applies a bindings file whenever it changes and at interval,
+// until the context of e is cancelled.
+//
+// Failing to apply the file isn't fatal, since it may be fixed later.
+func watchBindings(e *env, path, owner string, interval time.Duration, metricsAddr string) error {
+	if err := e.setupEnv(); err != nil {
+		return err
+	}
+
+	r := newReconciler(e, path, owner)
+
+	if metricsAddr != "" {
+		stop, err := serveMetrics(e, metricsAddr, r.register)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	changed, err := watchFile(path)
+	if err != nil {
+		return err
+	}
+	defer changed.Close()
+
+	var ticker <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		ticker = t.C
+	}
+
+	// Editors tend to generate several events when saving a file. Wait for
+	// them to settle before applying the file.
+	const settle = 100 * time.Millisecond
+	debounce := time.NewTimer(0)
+	defer debounce.Stop()
+
+	e.stdout.Logf("watching %s\n", path)
+	for {
+		select {
+		case <-e.ctx.Done():
+			return nil
+
+		case err := <-changed.errs:
+			return fmt.Errorf("watch %s: %s", path, err)
+
+		case <-changed.events:
+			if !debounce.Stop() {
+				select {
+				case <-debounce.C:
+				default:
+				}
+			}
+			debounce.Reset(settle)
+			continue
+
+		case <-ticker:
+		case <-debounce.C:
+		}
+
+		if err := r.reconcile(); err != nil {
+			e.stderr.Log("Error: reconcile:", err)
+		}
+	}
+}
+
+// serveMetrics serves the metrics of the dispatcher and the collectors added
+// by register on addr until stop is called.
+func serveMetrics(e *env, addr string, register func(prometheus.Registerer) error) (stop func(), _ error) {
+	reg, err := tubularRegistry(e)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := register(prometheus.WrapRegistererWithPrefix("tubular_", reg)); err != nil {
+		return nil, fmt.Errorf("register metrics: %s", err)
+	}
+
+	ln, err := e.listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	e.stdout.Log("Serving metrics on", ln.Addr().String())
+
+	timeout := 30 * time.Second
+	srv := metricsServer(e.ctx, reg, &timeout)
+
+	go func() {
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			e.stderr.Log("Error: serve metrics:", err)
+		}
+	}()
+
+	return func() {
+		srv.Close()
+		ln.Close()
+	}, nil
+}
+
+// fileWatcher signals changes to a file via inotify.
+type fileWatcher struct {
+	inotify *os.File
+	events  chan struct{}
+	errs    chan error
+}
+
+// watchFile watches path for changes.
+//
+// The directory containing the file is watched, so that replacing the file
+// via rename is detected as well.
+func watchFile(path string) (*fileWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+
+	// The runtime poller makes Read interruptible by Close.
+	inotify := os.NewFile(uintptr(fd), "inotify")
+
+	dir, name := filepath.Split(filepath.Clean(path))
+	if dir == "" {
+		dir = "."
+	}
+
+	const mask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE | unix.IN_DELETE | unix.IN_ATTRIB
+	if _, err := unix.InotifyAddWatch(fd, dir, mask); err != nil {
+		inotify.Close()
+		return nil, fmt.Errorf("watch %s: %w", dir, err)
+	}
+
+	fw := &fileWatcher{
+		inotify,
+		make(chan struct{}, 1),
+		make(chan error, 1),
+	}
+	go fw.read(name)
+	return fw, nil
+}
+
+func (fw *fileWatcher) read(name string) {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := fw.inotify.Read(buf)
+		if errors.Is(err, os.ErrClosed) {
+			return
+		} else if err != nil {
+			fw.errs <- err
+			return
+		}
+
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(event.Len)]
+			off += unix.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&unix.IN_Q_OVERFLOW == 0 && string(bytes.TrimRight(nameBytes, "\x00")) != name {
+				continue
+			}
+
+			select {
+			case fw.events <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (fw *fileWatcher) Close() error {
+	return fw.inotify.Close()
+}
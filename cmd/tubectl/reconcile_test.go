@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/tubular"
+)
+
+func TestWatchFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bindings.json")
+
+	fw, err := watchFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	expectEvent := func(t *testing.T, want bool) {
+		t.Helper()
+
+		select {
+		case <-fw.events:
+			if !want {
+				t.Error("Unexpected event")
+			}
+
+			// Writing a file generates multiple events.
+			time.Sleep(50 * time.Millisecond)
+			select {
+			case <-fw.events:
+			default:
+			}
+		case err := <-fw.errs:
+			t.Fatal(err)
+		case <-time.After(100 * time.Millisecond):
+			if want {
+				t.Error("Missing event")
+			}
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "other"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, false)
+
+	if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, true)
+
+	// Replacing the file via rename.
+	tmp := filepath.Join(dir, "tmp")
+	if err := os.WriteFile(tmp, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, false)
+
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, true)
+}
+
+func TestLoadBindingsWatch(t *testing.T) {
+	netns := mustReadyNetNS(t)
+	path := filepath.Join(t.TempDir(), "bindings.json")
+
+	writeConfig := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig(`{"bindings":[{"label":"foo","prefix":"127.0.0.1/32","port":80,"protocol":"tcp"}]}`)
+
+	tubectl := tubectlTestCall{
+		NetNS: netns,
+		Cmd:   "load-bindings",
+		Args:  []string{"-watch", "-interval", "100ms", path},
+	}
+	stop := tubectl.Start(t)
+	defer stop()
+
+	// The dispatcher is locked while open, which would block the watcher.
+	withDispatcher := func(fn func(*tubular.Dispatcher) error) {
+		t.Helper()
+
+		dp, err := tubular.OpenDispatcher(netns.Path(), "/sys/fs/bpf", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dp.Close()
+
+		if err := fn(dp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitForBindings := func(want ...string) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var bindings tubular.Bindings
+			withDispatcher(func(dp *tubular.Dispatcher) (err error) {
+				bindings, err = dp.Bindings()
+				return
+			})
+
+			have := make(map[string]bool)
+			for _, bind := range bindings {
+				have[bind.String()] = true
+			}
+
+			matches := len(have) == len(want)
+			for _, bind := range want {
+				matches = matches && have[bind]
+			}
+			if matches {
+				return
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected bindings %v, got %v", want, bindings)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	foo := mustNewBinding(t, "foo", tubular.TCP, "127.0.0.1", 80)
+	waitForBindings(foo.String())
+
+	writeConfig(`{"bindings":[{"label":"bar","prefix":"127.0.0.1/32","port":80,"protocol":"udp"}]}`)
+	bar := mustNewBinding(t, "bar", tubular.UDP, "127.0.0.1", 80)
+	waitForBindings(bar.String())
+
+	// Manual changes are undone.
+	withDispatcher(func(dp *tubular.Dispatcher) error {
+		return dp.AddBinding(foo)
+	})
+	waitForBindings(bar.String())
+}
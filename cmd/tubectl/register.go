@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
-	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular"
+	"github.com/cloudflare/tubular/internal/cgroup"
 	"github.com/cloudflare/tubular/internal/pidfd"
 	"github.com/cloudflare/tubular/internal/sysconn"
 
@@ -22,22 +27,57 @@ const (
 )
 
 func register(e *env, args ...string) error {
-	set := e.newFlagSet("register", "label")
+	set := e.newFlagSet("register", "--", "label")
 	set.Description = `
 		Register sockets under the given label.
 
 		Used together with systemd socket activation, it expects the
-		number of sockets in LISTEN_FDS. LISTEN_PID and LISTEN_FDNAMES are
-		ignored.
+		number of sockets in LISTEN_FDS. If LISTEN_PID is set it must
+		match the pid of tubectl.
+
+		Sockets can be registered under different labels based on the
+		names in LISTEN_FDNAMES, which are set via FileDescriptorName= in
+		the socket unit. With -by-name each socket is registered under its
+		name. -name maps a name to a label, sockets with other names are
+		ignored. Combining both registers unmapped sockets under their
+		name.
+
+		With -replace-cookie the sockets only replace the sockets with the
+		given cookies, which is useful for graceful restarts. Every socket
+		must replace one of the cookies, and every cookie must be replaced.
+		Nothing is registered otherwise.
 
 		Examples:
 		  # Register all sockets passed from systemd under label foo
-		  $ tubectl register foo`
+		  $ tubectl register foo
+
+		  # Register each socket under its name
+		  $ tubectl register -by-name
+
+		  # Register sockets named http under foo and dns under bar
+		  $ tubectl register -name http=foo -name dns=bar
+
+		  # Replace the socket of a previous instance
+		  $ tubectl register -replace-cookie sk:4001 foo`
+	byName := set.Bool("by-name", false, "use the names from LISTEN_FDNAMES as labels")
+	names := make(labelMap)
+	set.Var(names, "name", "register sockets named `name=label` under label (repeatable)")
+	var replace cookieList
+	set.Var(&replace, "replace-cookie", "only replace the socket with `cookie` (repeatable)")
 
 	if err := set.Parse(args); err != nil {
 		return err
 	}
 
+	useNames := *byName || len(names) > 0
+	if useNames && set.NArg() > 0 {
+		set.PrintCommand()
+		return fmt.Errorf("%w: label can't be combined with -by-name or -name", errBadArg)
+	} else if !useNames && set.NArg() == 0 {
+		set.PrintCommand()
+		return fmt.Errorf("%w: label is required without -by-name or -name", errBadArg)
+	}
+
 	// Use the current thread's netns, unit tests don't work well with
 	// /proc/self/ns/net.
 	targetNSPath := fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid())
@@ -45,41 +85,152 @@ func register(e *env, args ...string) error {
 		return err
 	}
 
-	label := set.Arg(0)
-
-	files, err := listenFds(e, sysconn.FirstReuseport())
+	fds, err := listenFds(e, sysconn.FirstReuseport())
 	if err != nil {
 		return err
 	}
 
 	defer func() {
-		for _, f := range files {
-			f.Close()
+		for _, fd := range fds {
+			fd.file.Close()
 		}
 	}()
 
-	return registerFiles(e, label, files)
+	if !useNames {
+		files := make([]*os.File, 0, len(fds))
+		for _, fd := range fds {
+			files = append(files, fd.file)
+		}
+		groups := map[string][]*os.File{set.Arg(0): files}
+		var results []registrationJSON
+		if len(replace) > 0 {
+			results, err = replaceFiles(e, groups, replace)
+		} else {
+			results, err = registerFiles(e, groups)
+		}
+		if err != nil {
+			return err
+		}
+		return e.writeResult(results)
+	}
+
+	if *byName && e.getenv("LISTEN_FDNAMES") == "" {
+		return fmt.Errorf("%w: -by-name requires LISTEN_FDNAMES", errBadArg)
+	}
+
+	var (
+		groups = make(map[string][]*os.File)
+		found  = make(map[string]bool)
+	)
+	for _, fd := range fds {
+		found[fd.name] = true
+
+		label, ok := names[fd.name]
+		if !ok && *byName {
+			label = fd.name
+		} else if !ok {
+			e.stderr.Logf("ignoring socket named %q\n", fd.name)
+			continue
+		}
+
+		groups[label] = append(groups[label], fd.file)
+	}
+
+	for name := range names {
+		if !found[name] {
+			return fmt.Errorf("no socket named %q: %w", name, errBadArg)
+		}
+	}
+
+	var results []registrationJSON
+	if len(replace) > 0 {
+		results, err = replaceFiles(e, groups, replace)
+	} else {
+		results, err = registerFiles(e, groups)
+	}
+	if err != nil {
+		return err
+	}
+	return e.writeResult(results)
+}
+
+// labelMap is a repeatable flag of name=label pairs.
+type labelMap map[string]string
+
+func (lm labelMap) String() string {
+	var pairs []string
+	for name, label := range lm {
+		pairs = append(pairs, name+"="+label)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (lm labelMap) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("expected name=label, got %q", value)
+	}
+
+	if _, ok := lm[parts[0]]; ok {
+		return fmt.Errorf("duplicate name %q", parts[0])
+	}
+
+	lm[parts[0]] = parts[1]
+	return nil
 }
 
 func registerPID(e *env, args ...string) error {
-	set := e.newFlagSet("register-pid", "pid", "label", "protocol", "ip", "port")
+	set := e.newFlagSet("register-pid", "pid", "label", "--", "protocol", "ip", "port")
 	set.Description = `
 		Register sockets from a process under the given label.
 
 		The file descriptors of the target process will be enumerated to find
 		matching sockets according to protocol, ip and port.
 
+		ip may also be a prefix like 127.0.0.0/8, or "any" to match all
+		addresses. A port of 0 matches all ports. Each matching socket is
+		registered with the destination for its domain and protocol. It's
+		an error if several sockets map to the same destination.
+
+		With -all, every listening TCP and unconnected UDP socket is
+		registered. protocol, ip and port may still be given to restrict
+		the sockets, they default to "any", "any" and 0.
+
 		Examples:
 			# Register all supported sockets from the process with pid 12345
 			$ tubectl register-pid 12345 foo tcp 127.0.0.1 80
 
+			# Register a TCP listener on any IPv6 address and port
+			$ tubectl register-pid 12345 foo tcp ::/0 0
+
+			# Register all sockets
+			$ tubectl register-pid -all 12345 foo
+
 			# Read the pid from a file
-			$ tubectl register-pid /path/to.pid foo tcp 127.0.0.1 80`
+			$ tubectl register-pid /path/to.pid foo tcp 127.0.0.1 80
+
+			# Wait up to 30 seconds for the process to create its sockets
+			$ tubectl register-pid -wait 30s 12345 foo tcp 127.0.0.1 80`
+	wait := set.Duration("wait", 0, "wait this long for matching sockets to appear")
+	all := set.Bool("all", false, "register all sockets, protocol, ip and port are optional")
 
 	if err := set.Parse(args); err != nil {
 		return err
 	}
 
+	sockArgs := []string{set.Arg(2), set.Arg(3), set.Arg(4)}
+	if *all {
+		for i, def := range []string{"any", "any", "0"} {
+			if set.NArg() <= i+2 {
+				sockArgs[i] = def
+			}
+		}
+	} else if set.NArg() != 5 {
+		set.PrintCommand()
+		return fmt.Errorf("%w: protocol, ip and port are required without -all", errBadArg)
+	}
+
 	pid, err := strconv.ParseInt(set.Arg(0), 10, 32)
 	if err != nil {
 		pidFile, pidErr := ioutil.ReadFile(set.Arg(0))
@@ -96,101 +247,481 @@ func registerPID(e *env, args ...string) error {
 	}
 
 	label := set.Arg(1)
-	protocol := set.Arg(2)
+	filter, err := socketFilter(sockArgs[0], sockArgs[1], sockArgs[2])
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	if *wait > 0 {
+		ctx, cancel := context.WithTimeout(e.ctx, *wait)
+		defer cancel()
+
+		files, err = pidfd.WaitFiles(ctx, int(pid), 100*time.Millisecond, filter...)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("pid %d: no sockets after %s: %w", pid, *wait, errBadArg)
+		}
+	} else {
+		files, err = pidfd.Files(int(pid), filter...)
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err := skipFdError(e, int(pid), files, err); err != nil {
+		return fmt.Errorf("pid %d: %w", pid, err)
+	}
 
-	ip, err := netaddr.ParseIP(set.Arg(3))
+	results, err := registerFiles(e, map[string][]*os.File{label: files})
 	if err != nil {
-		return fmt.Errorf("invalid IP %q: %s", set.Arg(3), err)
+		return fmt.Errorf("pid %d: %w", pid, err)
+	}
+
+	return e.writeResult(results)
+}
+
+// skipFdError returns err unless it only reports file descriptors of pid
+// which couldn't be examined, and some files matched regardless. The
+// skipped file descriptors are logged in that case.
+func skipFdError(e *env, pid int, files []*os.File, err error) error {
+	var fe *pidfd.FdError
+	if errors.As(err, &fe) && len(files) > 0 {
+		e.stderr.Logf("pid %d: %s\n", pid, fe)
+		return nil
+	}
+	return err
+}
+
+func registerCgroup(e *env, args ...string) error {
+	set := e.newFlagSet("register-cgroup", "cgroup|unit", "label", "protocol", "ip", "port")
+	set.Description = `
+		Register sockets from all processes in a cgroup under the given label.
+
+		The cgroup is either a path, relative to /sys/fs/cgroup or absolute,
+		or the name of a systemd unit. Processes in child cgroups are
+		included. The file descriptors of all processes will be enumerated
+		to find matching sockets according to protocol, ip and port.
+
+		Examples:
+			# Register sockets of a systemd service
+			$ tubectl register-cgroup nginx.service foo tcp 127.0.0.1 80
+
+			# Register sockets from a cgroup
+			$ tubectl register-cgroup system.slice/nginx.service foo tcp 127.0.0.1 80`
+
+	if err := set.Parse(args); err != nil {
+		return err
 	}
 
-	port, err := strconv.ParseUint(set.Arg(4), 10, 16)
+	path, err := cgroup.Resolve(e.cgroupFs, set.Arg(0))
 	if err != nil {
-		return fmt.Errorf("invalid port %q: %s", set.Arg(4), err)
+		return err
 	}
 
-	filter := []sysconn.Predicate{
-		sysconn.IgnoreENOTSOCK(sysconn.InetListener(protocol)),
-		sysconn.LocalAddress(ip, int(port)),
-		sysconn.FirstReuseport(),
+	label := set.Arg(1)
+	filter, err := socketFilter(set.Arg(2), set.Arg(3), set.Arg(4))
+	if err != nil {
+		return err
 	}
 
-	files, err := pidfd.Files(int(pid), filter...)
+	// Worker processes often share sockets.
+	filter = append(filter, sysconn.UniqueSocket())
+
+	pids, err := cgroup.PIDs(path)
 	if err != nil {
-		return fmt.Errorf("pid %d: %w", pid, err)
+		return fmt.Errorf("cgroup %s: %s", path, err)
 	}
 
+	var files []*os.File
 	defer func() {
 		for _, f := range files {
 			f.Close()
 		}
 	}()
 
-	if err := registerFiles(e, label, files); err != nil {
-		return fmt.Errorf("pid %d: %w", pid, err)
+	for _, pid := range pids {
+		if pid == os.Getpid() {
+			continue
+		}
+
+		err := namespacesEqual(e.netns, fmt.Sprintf("/proc/%d/ns/net", pid))
+		if errors.Is(err, os.ErrNotExist) {
+			// The process exited.
+			continue
+		} else if err != nil {
+			e.stderr.Logf("skipping pid %d: %s\n", pid, err)
+			continue
+		}
+
+		pidFiles, err := pidfd.Files(pid, filter...)
+		files = append(files, pidFiles...)
+		if errors.Is(err, unix.ESRCH) {
+			continue
+		} else if err := skipFdError(e, pid, pidFiles, err); err != nil {
+			return fmt.Errorf("pid %d: %w", pid, err)
+		}
+	}
+
+	results, err := registerFiles(e, map[string][]*os.File{label: files})
+	if err != nil {
+		return fmt.Errorf("cgroup %s: %w", path, err)
+	}
+
+	return e.writeResult(results)
+}
+
+// cookieList is a repeatable flag of socket cookies.
+type cookieList []tubular.SocketCookie
+
+func (cl *cookieList) String() string {
+	var cookies []string
+	for _, cookie := range *cl {
+		cookies = append(cookies, cookie.String())
+	}
+	return strings.Join(cookies, ",")
+}
+
+func (cl *cookieList) Set(value string) error {
+	var cookie tubular.SocketCookie
+	if err := cookie.UnmarshalText([]byte(value)); err != nil {
+		return err
+	}
+
+	for _, have := range *cl {
+		if have == cookie {
+			return fmt.Errorf("duplicate cookie %s", cookie)
+		}
 	}
 
+	*cl = append(*cl, cookie)
 	return nil
 }
 
-func registerFiles(e *env, label string, files []*os.File) error {
-	if len(files) == 0 {
-		return fmt.Errorf("no sockets: %w", errBadArg)
+// socketFilter returns predicates which match sockets by protocol, ip
+// and port.
+//
+// protocol may be "any", ip may be a prefix or "any" and port may be 0 to
+// match more than one socket.
+func socketFilter(protocol, ipStr, portStr string) ([]sysconn.Predicate, error) {
+	switch protocol {
+	case "tcp", "udp", "any":
+	default:
+		return nil, fmt.Errorf("invalid protocol %q", protocol)
 	}
 
-	dp, err := e.openDispatcher(false)
+	var prefixes []netaddr.IPPrefix
+	switch {
+	case ipStr == "any":
+		prefixes = []netaddr.IPPrefix{
+			netaddr.IPPrefixFrom(netaddr.IPv4(0, 0, 0, 0), 0),
+			netaddr.IPPrefixFrom(netaddr.IPv6Unspecified(), 0),
+		}
+
+	case strings.ContainsRune(ipStr, '/'):
+		prefix, err := netaddr.ParseIPPrefix(ipStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix %q: %s", ipStr, err)
+		}
+		prefixes = []netaddr.IPPrefix{prefix.Masked()}
+
+	default:
+		ip, err := netaddr.ParseIP(ipStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP %q: %s", ipStr, err)
+		}
+		prefixes = []netaddr.IPPrefix{netaddr.IPPrefixFrom(ip, ip.BitLen())}
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("invalid port %q: %s", portStr, err)
 	}
-	defer dp.Close()
 
-	registered := make(map[internal.Destination]bool)
+	return []sysconn.Predicate{
+		sysconn.IgnoreENOTSOCK(sysconn.InetListener(protocol)),
+		sysconn.LocalPrefixes(prefixes, int(port)),
+		sysconn.FirstReuseport(),
+	}, nil
+}
+
+// checkDestinations returns an error if files contain multiple sockets
+// for the same destination.
+func checkDestinations(label string, files []*os.File) error {
+	seen := make(map[tubular.Destination]string)
 	for _, file := range files {
-		dst, created, err := dp.RegisterSocket(label, file)
+		addr, err := localAddr(file)
 		if err != nil {
-			return fmt.Errorf("register fd: %w", err)
+			return err
 		}
 
-		if registered[*dst] {
-			return fmt.Errorf("found multiple sockets for destination %s", dst)
+		dst, err := tubular.NewDestination(label, file)
+		if err != nil {
+			return fmt.Errorf("socket %s: %w", addr, err)
 		}
-		registered[*dst] = true
 
-		var msg string
-		if created {
-			msg = fmt.Sprintf("created destination %s", dst.String())
-		} else {
-			msg = fmt.Sprintf("updated destination %s", dst.String())
+		if prev, ok := seen[*dst]; ok {
+			return fmt.Errorf("sockets %s and %s both map to destination %s, use a more specific address or port: %w",
+				prev, addr, dst, errBadArg)
 		}
-
-		cookie, _ := socketCookie(file)
-		e.stdout.Logf("registered socket %s: %s\n", cookie, msg)
+		seen[*dst] = addr
 	}
 
 	return nil
 }
 
-// Returns os.File for the first FD passed with systemd protocol for socket
-// activation. Only LISTEN_FDS environment variable is taken into
-// account. LISTEN_PID is ignored. LISTEN_FDNAMES are also ignored, name passed
-// as an argument is used instead.  See sd_listen_fds(3) man-page for more info.
-func listenFds(e *env, p sysconn.Predicate) (res []*os.File, err error) {
+// localAddr returns the address a socket is bound to.
+func localAddr(conn syscall.Conn) (string, error) {
+	var sa unix.Sockaddr
+	err := sysconn.Control(conn, func(fd int) (err error) {
+		sa, err = unix.Getsockname(fd)
+		return
+	})
+	if err != nil {
+		return "", fmt.Errorf("getsockname: %s", err)
+	}
+
+	switch addr := sa.(type) {
+	case *unix.SockaddrInet4:
+		return netaddr.IPPortFrom(netaddr.IPFrom4(addr.Addr), uint16(addr.Port)).String(), nil
+	case *unix.SockaddrInet6:
+		return netaddr.IPPortFrom(netaddr.IPv6Raw(addr.Addr), uint16(addr.Port)).String(), nil
+	default:
+		return fmt.Sprintf("%T", sa), nil
+	}
+}
+
+// registrationJSON describes a change to the socket of a destination.
+type registrationJSON struct {
+	destinationJSON
+	// One of created, updated, replaced or unregistered.
+	Action string `json:"action"`
+	// Cookie of the replaced socket, empty unless action is replaced.
+	Replaced string `json:"replaced,omitempty"`
+}
+
+// registerFiles registers files grouped by label.
+//
+// All sockets are registered while holding the dispatcher lock. If one of
+// them can't be registered, sockets which were registered for a destination
+// without a socket are unregistered again. Sockets which replaced another
+// socket stay registered, since the previous socket isn't available anymore.
+func registerFiles(e *env, groups map[string][]*os.File) (_ []registrationJSON, err error) {
+	var labels []string
+	for label, files := range groups {
+		if len(files) == 0 {
+			return nil, fmt.Errorf("label %s: no sockets: %w", label, errBadArg)
+		}
+
+		if err := e.authorizeLabel(label); err != nil {
+			return nil, err
+		}
+
+		if err := checkDestinations(label, files); err != nil {
+			return nil, fmt.Errorf("label %s: %w", label, err)
+		}
+
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	dp, err := e.openDispatcher(false)
+	if err != nil {
+		return nil, err
+	}
+	defer dp.Close()
+
+	_, previous, err := dp.Destinations()
+	if err != nil {
+		return nil, err
+	}
+
+	registered := make(map[tubular.Destination]tubular.SocketCookie)
 	defer func() {
 		if err == nil {
 			return
 		}
 
-		for _, f := range res {
-			f.Close()
+		for dst, cookie := range registered {
+			if old := previous[dst]; old != 0 {
+				e.stderr.Logf("can't restore socket %s for destination %s\n", old, &dst)
+				continue
+			}
+
+			if err := dp.UnregisterSocketCookie(dst.Label, dst.Domain, dst.Protocol, cookie); err != nil {
+				e.stderr.Logf("can't unregister socket %s: %s\n", cookie, err)
+				continue
+			}
+			e.stderr.Logf("unregistered socket %s\n", cookie)
+		}
+	}()
+
+	var results []registrationJSON
+	for _, label := range labels {
+		for _, file := range groups[label] {
+			dst, created, err := dp.RegisterSocket(label, file)
+			if err != nil {
+				return nil, fmt.Errorf("label %s: register fd: %w", label, err)
+			}
+
+			cookie, _ := socketCookie(file)
+			registered[*dst] = cookie
+
+			action := "updated"
+			if created {
+				action = "created"
+			}
+
+			e.stdout.Logf("registered socket %s: %s destination %s\n", cookie, action, dst.String())
+			results = append(results, registrationJSON{newDestinationJSON(*dst, cookie), action, ""})
+		}
+	}
+
+	return results, nil
+}
+
+// replaceFiles registers files grouped by label in place of the sockets
+// identified by old.
+//
+// Every file must replace one of old, and every one of old must be replaced.
+// Nothing is registered otherwise.
+func replaceFiles(e *env, groups map[string][]*os.File, old []tubular.SocketCookie) ([]registrationJSON, error) {
+	var labels []string
+	for label, files := range groups {
+		if len(files) == 0 {
+			return nil, fmt.Errorf("label %s: no sockets: %w", label, errBadArg)
+		}
+
+		if err := e.authorizeLabel(label); err != nil {
+			return nil, err
+		}
+
+		if err := checkDestinations(label, files); err != nil {
+			return nil, err
+		}
+
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	dp, err := e.openDispatcher(false)
+	if err != nil {
+		return nil, err
+	}
+	defer dp.Close()
+
+	_, current, err := dp.Destinations()
+	if err != nil {
+		return nil, err
+	}
+
+	type replacement struct {
+		label string
+		file  *os.File
+		old   tubular.SocketCookie
+	}
+
+	remaining := make(map[tubular.SocketCookie]bool)
+	for _, cookie := range old {
+		remaining[cookie] = true
+	}
+
+	var replacements []replacement
+	for _, label := range labels {
+		for _, file := range groups[label] {
+			dst, err := tubular.NewDestination(label, file)
+			if err != nil {
+				return nil, err
+			}
+
+			cookie := current[*dst]
+			if !remaining[cookie] {
+				return nil, fmt.Errorf("destination %s has socket %s instead of one of %s: %w",
+					dst, cookie, (*cookieList)(&old), tubular.ErrDestinationMismatch)
+			}
+			delete(remaining, cookie)
+
+			replacements = append(replacements, replacement{label, file, cookie})
+		}
+	}
+
+	for _, cookie := range old {
+		if remaining[cookie] {
+			return nil, fmt.Errorf("socket %s isn't replaced by any socket: %w", cookie, tubular.ErrDestinationMismatch)
+		}
+	}
+
+	var results []registrationJSON
+	for _, r := range replacements {
+		dst, err := dp.ReplaceSocket(r.label, r.file, r.old)
+		if err != nil {
+			return nil, fmt.Errorf("replace socket %s: %w", r.old, err)
+		}
+
+		cookie, _ := socketCookie(r.file)
+		e.stdout.Logf("replaced socket %s with %s: %s\n", r.old, cookie, dst)
+		results = append(results, registrationJSON{newDestinationJSON(*dst, cookie), "replaced", r.old.String()})
+	}
+
+	return results, nil
+}
+
+// listenFd is a file passed via systemd socket activation.
+type listenFd struct {
+	name string
+	file *os.File
+}
+
+// listenFds returns the files passed with the systemd protocol for socket
+// activation, following the semantics of sd_listen_fds_with_names(3).
+//
+// Files which don't match p are closed and skipped. Names default to
+// "unknown" if LISTEN_FDNAMES isn't set.
+func listenFds(e *env, p sysconn.Predicate) (res []listenFd, err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		for _, fd := range res {
+			fd.file.Close()
 		}
 		res = nil
 	}()
 
-	// 1. Check LISTEN_FDS value
+	// 1. Check that the fds are meant for us
+	if listenPid := e.getenv("LISTEN_PID"); listenPid != "" {
+		pid, err := strconv.Atoi(listenPid)
+		if err != nil {
+			return nil, fmt.Errorf("parse LISTEN_PID=%q: %w", listenPid, errBadArg)
+		}
+		if pid != os.Getpid() {
+			return nil, fmt.Errorf("LISTEN_PID=%d doesn't match pid %d: %w", pid, os.Getpid(), errBadArg)
+		}
+	}
+
+	// 2. Check LISTEN_FDS value
 	listenFds := e.getenv("LISTEN_FDS")
 	nfds, err := strconv.Atoi(listenFds)
 	if err != nil {
 		return nil, fmt.Errorf("parse LISTEN_FDS=%q: %w", listenFds, errBadArg)
 	}
+	if nfds < 0 || nfds > math.MaxInt32-listenFdsStart {
+		return nil, fmt.Errorf("LISTEN_FDS=%q: %w", listenFds, errBadArg)
+	}
+
+	// 3. Match names to fds
+	names := make([]string, nfds)
+	if listenFdNames := e.getenv("LISTEN_FDNAMES"); listenFdNames != "" {
+		names = strings.Split(listenFdNames, ":")
+		if len(names) != nfds {
+			return nil, fmt.Errorf("LISTEN_FDNAMES contains %d names, expected %d: %w", len(names), nfds, errBadArg)
+		}
+	} else {
+		for i := range names {
+			names[i] = "unknown"
+		}
+	}
 
 	for i := 0; i < nfds; i++ {
 		file := e.newFile(uintptr(listenFdsStart+i), "")
@@ -204,12 +735,12 @@ func listenFds(e *env, p sysconn.Predicate) (res []*os.File, err error) {
 			file.Close()
 			continue
 		}
-		res = append(res, file)
+		res = append(res, listenFd{names[i], file})
 	}
 	return res, nil
 }
 
-func socketCookie(conn syscall.Conn) (internal.SocketCookie, error) {
+func socketCookie(conn syscall.Conn) (tubular.SocketCookie, error) {
 	var cookie uint64
 	err := sysconn.Control(conn, func(fd int) (err error) {
 		cookie, err = unix.GetsockoptUint64(fd, unix.SOL_SOCKET, unix.SO_COOKIE)
@@ -218,7 +749,7 @@ func socketCookie(conn syscall.Conn) (internal.SocketCookie, error) {
 	if err != nil {
 		return 0, fmt.Errorf("getsockopt(SO_COOKIE): %v", err)
 	}
-	return internal.SocketCookie(cookie), nil
+	return tubular.SocketCookie(cookie), nil
 }
 
 func namespacesEqual(want, have string) error {
@@ -7,10 +7,13 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 
-	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular"
+	"github.com/cloudflare/tubular/internal/log"
+	"github.com/cloudflare/tubular/internal/pidfd"
 	"github.com/cloudflare/tubular/internal/sysconn"
 	"github.com/cloudflare/tubular/internal/testutil"
 
@@ -37,7 +40,7 @@ func TestSingleRegisterCommand(t *testing.T) {
 		return err
 	}
 
-	check := func(t *testing.T, dp *internal.Dispatcher, fds testFds) {
+	check := func(t *testing.T, dp *tubular.Dispatcher, fds testFds) {
 		dests := destinations(t, dp)
 		if len(dests) != len(fds) {
 			t.Fatalf("expected %v registered destination(s), have %v", len(fds), len(dests))
@@ -66,25 +69,29 @@ func TestSingleRegisterCommand(t *testing.T) {
 			[]string{"svc-label"}, testEnv{"LISTEN_FDS": ""}, nil},
 		{"listen_fds zero", errBadArg,
 			[]string{"svc-label"}, testEnv{"LISTEN_FDS": "0"}, nil},
+		{"listen_fds negative", errBadArg,
+			[]string{"svc-label"}, testEnv{"LISTEN_FDS": "-1"}, nil},
+		{"listen_fds too large", errBadArg,
+			[]string{"svc-label"}, testEnv{"LISTEN_FDS": "2147483647"}, nil},
 		{"fd unused", errBadFD,
 			[]string{"svc-label"}, testEnv{"LISTEN_FDS": "1"}, testFds{nil}},
-		{"fd non-socket", internal.ErrNotSocket,
+		{"fd non-socket", tubular.ErrNotSocket,
 			[]string{"svc-label"}, testEnv{"LISTEN_FDS": "1"}, testFds{makeNonSocket(t)}},
-		{"fd dual-stack socket", internal.ErrBadSocketState,
+		{"fd dual-stack socket", tubular.ErrBadSocketState,
 			[]string{"svc-label"}, testEnv{"LISTEN_FDS": "1"}, testFds{makeDualStackSocket(t, netns)}},
-		{"fd unix socket", internal.ErrBadSocketDomain,
+		{"fd unix socket", tubular.ErrBadSocketDomain,
 			[]string{"svc-label"}, testEnv{"LISTEN_FDS": "1"}, testFds{makeListeningSocket(t, netns, "unix")}},
-		{"fd unixpacket socket", internal.ErrBadSocketDomain,
+		{"fd unixpacket socket", tubular.ErrBadSocketDomain,
 			[]string{"svc-label"}, testEnv{"LISTEN_FDS": "1"}, testFds{makeListeningSocket(t, netns, "unixpacket")}},
-		{"fd unixgram socket", internal.ErrBadSocketDomain,
+		{"fd unixgram socket", tubular.ErrBadSocketDomain,
 			[]string{"svc-label"}, testEnv{"LISTEN_FDS": "1"}, testFds{makeListeningSocket(t, netns, "unixgram")}},
-		{"fd connected tcp4", internal.ErrBadSocketState,
+		{"fd connected tcp4", tubular.ErrBadSocketState,
 			[]string{"svc-label"}, testEnv{"LISTEN_FDS": "1"}, testFds{makeConnectedSocket(t, netns, "tcp4")}},
-		{"fd connected tcp6", internal.ErrBadSocketState,
+		{"fd connected tcp6", tubular.ErrBadSocketState,
 			[]string{"svc-label"}, testEnv{"LISTEN_FDS": "1"}, testFds{makeConnectedSocket(t, netns, "tcp6")}},
-		{"fd connected udp4", internal.ErrBadSocketState,
+		{"fd connected udp4", tubular.ErrBadSocketState,
 			[]string{"svc-label"}, testEnv{"LISTEN_FDS": "1"}, testFds{makeConnectedSocket(t, netns, "udp4")}},
-		{"fd connected udp6", internal.ErrBadSocketState,
+		{"fd connected udp6", tubular.ErrBadSocketState,
 			[]string{"svc-label"}, testEnv{"LISTEN_FDS": "1"}, testFds{makeConnectedSocket(t, netns, "udp6")}},
 		{"fd listening tcp4", nil,
 			[]string{"svc-label"}, testEnv{"LISTEN_FDS": "1"}, testFds{makeListeningSocket(t, netns, "tcp4")}},
@@ -128,13 +135,108 @@ func TestSingleRegisterCommand(t *testing.T) {
 				testutil.Listen(t, netns, network, ""),
 			}
 			err := run(t, []string{"svc-label"}, testEnv{"LISTEN_FDS": "2"}, fds)
-			if err == nil {
-				t.Fatal("Expected an error")
+			if !errors.Is(err, errBadArg) {
+				t.Fatal("Expected errBadArg, got", err)
 			}
 
-			// We still register the first fd even if there is an error.
+			// Ambiguous sockets are detected before registering any of them.
 			dp := mustOpenDispatcher(t, netns)
-			check(t, dp, testFds{fds[1]})
+			check(t, dp, nil)
+		})
+	}
+}
+
+func TestRegisterByName(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+
+	var (
+		webTCP = makeListeningSocket(t, netns, "tcp4")
+		webUDP = makeListeningSocket(t, netns, "udp4")
+		dns    = makeListeningSocket(t, netns, "udp6")
+		fds    = testFds{webTCP, webUDP, dns}
+	)
+
+	run := func(t *testing.T, env testEnv, args ...string) error {
+		mustLoadDispatcher(t, netns)
+
+		tubectl := tubectlTestCall{
+			NetNS:    netns,
+			ExecNS:   netns,
+			Cmd:      "register",
+			Args:     args,
+			Env:      env,
+			ExtraFds: fds,
+		}
+		_, err := tubectl.Run(t)
+		return err
+	}
+
+	env := testEnv{
+		"LISTEN_FDS":     "3",
+		"LISTEN_FDNAMES": "web:web:dns",
+		"LISTEN_PID":     fmt.Sprint(os.Getpid()),
+	}
+
+	checkLabels := func(t *testing.T, want map[syscall.Conn]string) {
+		t.Helper()
+
+		dests := destinations(t, mustOpenDispatcher(t, netns))
+		if len(dests) != len(want) {
+			t.Fatalf("expected %d registered destination(s), have %d", len(want), len(dests))
+		}
+
+		for conn, label := range want {
+			dest, ok := dests[mustSocketCookie(t, conn)]
+			if !ok {
+				t.Fatalf("socket for label %s isn't registered", label)
+			}
+			if dest.Label != label {
+				t.Errorf("expected label %s, got %s", label, dest.Label)
+			}
+		}
+	}
+
+	t.Run("by-name", func(t *testing.T) {
+		if err := run(t, env, "-by-name"); err != nil {
+			t.Fatal(err)
+		}
+
+		checkLabels(t, map[syscall.Conn]string{webTCP: "web", webUDP: "web", dns: "dns"})
+	})
+
+	t.Run("mapping", func(t *testing.T) {
+		if err := run(t, env, "-name", "web=foo"); err != nil {
+			t.Fatal(err)
+		}
+
+		checkLabels(t, map[syscall.Conn]string{webTCP: "foo", webUDP: "foo"})
+	})
+
+	t.Run("mapping and by-name", func(t *testing.T) {
+		if err := run(t, env, "-by-name", "-name", "web=foo"); err != nil {
+			t.Fatal(err)
+		}
+
+		checkLabels(t, map[syscall.Conn]string{webTCP: "foo", webUDP: "foo", dns: "dns"})
+	})
+
+	for _, tc := range []struct {
+		name string
+		env  testEnv
+		args []string
+	}{
+		{"unknown name", env, []string{"-name", "foo=bar"}},
+		{"label and by-name", env, []string{"-by-name", "foo"}},
+		{"missing names", testEnv{"LISTEN_FDS": "3"}, []string{"-by-name"}},
+		{"wrong number of names", testEnv{"LISTEN_FDS": "3", "LISTEN_FDNAMES": "web:dns"}, []string{"-by-name"}},
+		{"wrong pid", testEnv{"LISTEN_FDS": "3", "LISTEN_PID": "1"}, []string{"foo"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := run(t, tc.env, tc.args...); !errors.Is(err, errBadArg) {
+				t.Fatal("Expected errBadArg, got", err)
+			}
+
+			checkLabels(t, nil)
 		})
 	}
 }
@@ -198,6 +300,52 @@ func TestRegisterPID(t *testing.T) {
 		}
 	})
 
+	t.Run("wildcard", func(t *testing.T) {
+		for _, args := range [][]string{
+			{"tcp", "any", "0"},
+			{"tcp", "127.0.0.0/8", "8080"},
+			{"any", "0.0.0.0/0", "0"},
+		} {
+			tubectl := tubectlTestCall{
+				NetNS:  netns,
+				ExecNS: netns,
+				Cmd:    "register-pid",
+				Args:   append([]string{fmt.Sprint(child), "my-service"}, args...),
+			}
+			tubectl.MustRun(t)
+		}
+	})
+
+	t.Run("all", func(t *testing.T) {
+		tubectl := tubectlTestCall{
+			NetNS:  netns,
+			ExecNS: netns,
+			Cmd:    "register-pid",
+			Args:   []string{"-all", fmt.Sprint(child), "my-service"},
+		}
+		tubectl.MustRun(t)
+
+		tubectl.Args = []string{fmt.Sprint(child), "my-service"}
+		if _, err := tubectl.Run(t); !errors.Is(err, errBadArg) {
+			t.Error("Expected errBadArg without -all, got", err)
+		}
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		tubectl := tubectlTestCall{
+			NetNS:  netns,
+			ExecNS: netns,
+			Cmd:    "register-pid",
+			Args:   []string{"-wait", "1s", fmt.Sprint(child), "my-service", "tcp", "127.0.0.1", "8080"},
+		}
+		tubectl.MustRun(t)
+
+		tubectl.Args = []string{"-wait", "100ms", fmt.Sprint(child), "my-service", "udp", "127.0.0.1", "80"}
+		if _, err := tubectl.Run(t); !errors.Is(err, errBadArg) {
+			t.Error("Expected errBadArg, got", err)
+		}
+	})
+
 	t.Run("wrong netns", func(t *testing.T) {
 		tubectl := tubectlTestCall{
 			NetNS: netns,
@@ -215,7 +363,249 @@ func TestRegisterPID(t *testing.T) {
 	}
 }
 
-func destinations(tb testing.TB, dp *internal.Dispatcher) map[internal.SocketCookie]internal.Destination {
+func TestRegisterPIDAmbiguous(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	var files []*os.File
+	for _, addr := range []string{"127.0.0.1:8080", "127.0.0.1:8081", "[::1]:8080"} {
+		conn := testutil.Listen(t, netns, "tcp", addr)
+		file, err := conn.(interface{ File() (*os.File, error) }).File()
+		if err != nil {
+			t.Fatal("File:", err)
+		}
+		defer file.Close()
+		files = append(files, file)
+	}
+
+	var child int
+	testutil.JoinNetNS(t, netns, func() error {
+		child = testutil.SpawnChildWithFiles(t, files...)
+		return nil
+	})
+
+	tubectl := tubectlTestCall{
+		NetNS:  netns,
+		ExecNS: netns,
+		Cmd:    "register-pid",
+		Args:   []string{"-all", fmt.Sprint(child), "my-service"},
+	}
+	if _, err := tubectl.Run(t); !errors.Is(err, errBadArg) {
+		t.Error("Expected errBadArg for ambiguous sockets, got", err)
+	}
+
+	// The dispatcher is locked while open, so don't keep it around.
+	registered := func() map[tubular.SocketCookie]tubular.Destination {
+		t.Helper()
+
+		dp, err := tubular.OpenDispatcher(netns.Path(), "/sys/fs/bpf", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dp.Close()
+
+		return destinations(t, dp)
+	}
+
+	if dests := registered(); len(dests) != 0 {
+		t.Error("Ambiguous sockets were registered:", dests)
+	}
+
+	// Restricting the port resolves the ambiguity.
+	tubectl.Args = []string{fmt.Sprint(child), "my-service", "tcp", "any", "8080"}
+	tubectl.MustRun(t)
+
+	if dests := registered(); len(dests) != 2 {
+		t.Error("Expected two registered sockets, got", dests)
+	}
+}
+
+func TestRegisterReplaceCookie(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	var (
+		old4 = makeListeningSocket(t, netns, "tcp4")
+		old6 = makeListeningSocket(t, netns, "tcp6")
+		new4 = makeListeningSocket(t, netns, "tcp4")
+		new6 = makeListeningSocket(t, netns, "tcp6")
+	)
+
+	run := func(fds testFds, args ...string) error {
+		tubectl := tubectlTestCall{
+			NetNS:    netns,
+			ExecNS:   netns,
+			Cmd:      "register",
+			Args:     append(args, "foo"),
+			Env:      testEnv{"LISTEN_FDS": fmt.Sprint(len(fds))},
+			ExtraFds: fds,
+		}
+		_, err := tubectl.Run(t)
+		return err
+	}
+
+	checkRegistered := func(want ...syscall.Conn) {
+		t.Helper()
+
+		dp := mustOpenDispatcher(t, netns)
+		defer dp.Close()
+
+		dests := destinations(t, dp)
+		if len(dests) != len(want) {
+			t.Fatalf("expected %d registered destination(s), have %d", len(want), len(dests))
+		}
+
+		for _, conn := range want {
+			if _, ok := dests[mustSocketCookie(t, conn)]; !ok {
+				t.Fatalf("socket %s isn't registered", mustSocketCookie(t, conn))
+			}
+		}
+	}
+
+	if err := run(testFds{old4, old6}); err != nil {
+		t.Fatal(err)
+	}
+
+	replace := func(conns ...syscall.Conn) []string {
+		var args []string
+		for _, conn := range conns {
+			args = append(args, "-replace-cookie", mustSocketCookie(t, conn).String())
+		}
+		return args
+	}
+
+	// new6 would replace old6, which isn't expected.
+	err := run(testFds{new4, new6}, replace(old4)...)
+	if !errors.Is(err, tubular.ErrDestinationMismatch) {
+		t.Error("Expected ErrDestinationMismatch for unexpected socket, got", err)
+	}
+	checkRegistered(old4, old6)
+
+	// old6 isn't replaced.
+	err = run(testFds{new4}, replace(old4, old6)...)
+	if !errors.Is(err, tubular.ErrDestinationMismatch) {
+		t.Error("Expected ErrDestinationMismatch for unreplaced socket, got", err)
+	}
+	checkRegistered(old4, old6)
+
+	if err := run(testFds{new4, new6}, replace(old4, old6)...); err != nil {
+		t.Fatal("Can't replace sockets:", err)
+	}
+	checkRegistered(new4, new6)
+
+	for _, cookie := range []string{"", "4001", "sk:0"} {
+		if err := run(testFds{new4}, "-replace-cookie", cookie); err == nil {
+			t.Errorf("Accepted cookie %q", cookie)
+		}
+	}
+}
+
+func TestRegisterJSON(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	run := func(conn syscall.Conn, args ...string) registrationJSON {
+		t.Helper()
+
+		tubectl := tubectlTestCall{
+			NetNS:    netns,
+			ExecNS:   netns,
+			Cmd:      "register",
+			Args:     append(args, "foo"),
+			Env:      testEnv{"LISTEN_FDS": "1"},
+			ExtraFds: testFds{conn},
+		}
+
+		var result []registrationJSON
+		if err := tubectl.RunJSON(t, &result); err != nil {
+			t.Fatal("Can't register:", err)
+		}
+
+		if len(result) != 1 {
+			t.Fatalf("Expected one registration, got %v", result)
+		}
+		return result[0]
+	}
+
+	dest := tubular.Destination{Label: "foo", Domain: tubular.AF_INET, Protocol: tubular.TCP}
+	first := makeListeningSocket(t, netns, "tcp4")
+	second := makeListeningSocket(t, netns, "tcp4")
+	third := makeListeningSocket(t, netns, "tcp4")
+
+	for _, tc := range []struct {
+		conn syscall.Conn
+		args []string
+		want registrationJSON
+	}{
+		{first, nil, registrationJSON{newDestinationJSON(dest, mustSocketCookie(t, first)), "created", ""}},
+		{second, nil, registrationJSON{newDestinationJSON(dest, mustSocketCookie(t, second)), "updated", ""}},
+		{
+			third,
+			[]string{"-replace-cookie", mustSocketCookie(t, second).String()},
+			registrationJSON{newDestinationJSON(dest, mustSocketCookie(t, third)), "replaced", mustSocketCookie(t, second).String()},
+		},
+	} {
+		if have := run(tc.conn, tc.args...); have != tc.want {
+			t.Errorf("Expected %+v, got %+v", tc.want, have)
+		}
+	}
+}
+
+func TestRegisterCgroup(t *testing.T) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		t.Skip("Unified cgroup hierarchy not mounted at /sys/fs/cgroup")
+	}
+
+	self, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var path string
+	for _, line := range strings.Split(string(self), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			path = strings.TrimPrefix(line, "0::")
+		}
+	}
+	if path == "" {
+		t.Fatal("Can't find own cgroup")
+	}
+
+	netns := mustReadyNetNS(t)
+
+	conn := testutil.Listen(t, netns, "tcp", "127.0.0.1:8080")
+	file, err := conn.(interface{ File() (*os.File, error) }).File()
+	if err != nil {
+		t.Fatal("File:", err)
+	}
+	defer file.Close()
+
+	// Two processes sharing the same socket.
+	testutil.JoinNetNS(t, netns, func() error {
+		testutil.SpawnChildWithFiles(t, file)
+		testutil.SpawnChildWithFiles(t, file)
+		return nil
+	})
+
+	tubectl := tubectlTestCall{
+		NetNS:  netns,
+		ExecNS: netns,
+		Cmd:    "register-cgroup",
+		Args:   []string{path, "my-service", "tcp", "127.0.0.1", "8080"},
+	}
+	tubectl.MustRun(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	if _, ok := destinations(t, dp)[mustSocketCookie(t, conn)]; !ok {
+		t.Error("Socket wasn't registered")
+	}
+	// Release the lock on the dispatcher.
+	dp.Close()
+
+	tubectl.Args = []string{path, "my-service", "udp", "127.0.0.1", "8080"}
+	if _, err := tubectl.Run(t); !errors.Is(err, errBadArg) {
+		t.Error("Expected errBadArg, got", err)
+	}
+}
+
+func destinations(tb testing.TB, dp *tubular.Dispatcher) map[tubular.SocketCookie]tubular.Destination {
 	tb.Helper()
 
 	_, cookies, err := dp.Destinations()
@@ -223,14 +613,14 @@ func destinations(tb testing.TB, dp *internal.Dispatcher) map[internal.SocketCoo
 		tb.Fatalf("dispatcher destinations: %s", err)
 	}
 
-	destsByCookie := make(map[internal.SocketCookie]internal.Destination)
+	destsByCookie := make(map[tubular.SocketCookie]tubular.Destination)
 	for dest, cookie := range cookies {
 		destsByCookie[cookie] = dest
 	}
 	return destsByCookie
 }
 
-func mustSocketCookie(tb testing.TB, conn syscall.Conn) internal.SocketCookie {
+func mustSocketCookie(tb testing.TB, conn syscall.Conn) tubular.SocketCookie {
 	tb.Helper()
 
 	cookie, err := socketCookie(conn)
@@ -336,3 +726,26 @@ func TestRegisterRefuseDifferentNamespace(t *testing.T) {
 		t.Error("Didn't refuse a socket from a different namespace")
 	}
 }
+
+func TestSkipFdError(t *testing.T) {
+	var stderr log.Buffer
+	e := &env{stderr: &stderr}
+	files := []*os.File{os.Stdin}
+	fdErr := fmt.Errorf("wrapped: %w", &pidfd.FdError{Fds: map[int]error{3: unix.EPERM}})
+
+	if err := skipFdError(e, 1, files, fdErr); err != nil {
+		t.Error("Skipped fds aren't ignored if files match:", err)
+	}
+
+	if !strings.Contains(stderr.String(), "skipped fds") {
+		t.Error("Skipped fds aren't logged")
+	}
+
+	if err := skipFdError(e, 1, nil, fdErr); !errors.Is(err, unix.EPERM) {
+		t.Error("Skipped fds are ignored if no files match:", err)
+	}
+
+	if err := skipFdError(e, 1, files, unix.ESRCH); !errors.Is(err, unix.ESRCH) {
+		t.Error("Other errors are ignored:", err)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/cloudflare/tubular"
+
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+// forwardedSignals are passed on to the child of run.
+var forwardedSignals = []os.Signal{
+	unix.SIGINT, unix.SIGTERM, unix.SIGHUP, unix.SIGQUIT, unix.SIGUSR1, unix.SIGUSR2,
+}
+
+func runCommand(e *env, args ...string) error {
+	set := e.newFlagSet("run", "command", "--", "args...")
+	set.Description = `
+		Run a command with sockets registered under a label.
+
+		The sockets are created and registered before the command is
+		started. They are passed to it using the systemd socket activation
+		protocol: LISTEN_FDS, LISTEN_PID and LISTEN_FDNAMES are set, and the
+		sockets start at fd 3 in the order of -listen. LISTEN_FDNAMES
+		contains the label for each socket. The command is started via
+		/bin/sh, since LISTEN_PID must be set to its pid.
+
+		UDP sockets have IP_RECVORIGDSTADDR or IPV6_RECVORIGDSTADDR and
+		IPV6_FREEBIND enabled, which is required to reply from the correct
+		address.
+
+		Signals are forwarded to the command. Once the command exits its
+		sockets are unregistered, unless they have been replaced in the
+		meantime. If the command exits with an error, run exits with the
+		same status.
+
+		Examples:
+		  $ tubectl run -label foo -listen tcp:127.0.0.1:0 -listen udp:[::1]:0 -- /usr/bin/server`
+	label := set.String("label", "", "register sockets under `label`")
+	var listens listenAddrs
+	set.Var(&listens, "listen", "create a socket bound to `proto:ip:port` (repeatable)")
+
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	if *label == "" {
+		set.PrintCommand()
+		return fmt.Errorf("%w: -label is required", errBadArg)
+	}
+
+	if len(listens) == 0 {
+		set.PrintCommand()
+		return fmt.Errorf("%w: at least one -listen is required", errBadArg)
+	}
+
+	// The child inherits the network namespace of the current thread.
+	targetNSPath := fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid())
+	if err := namespacesEqual(e.netns, targetNSPath); err != nil {
+		return err
+	}
+
+	files := make([]*os.File, 0, len(listens))
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	for _, addr := range listens {
+		file, err := addr.listen()
+		if err != nil {
+			return fmt.Errorf("listen on %s: %s", addr, err)
+		}
+		files = append(files, file)
+	}
+
+	cookies := make([]tubular.SocketCookie, 0, len(files))
+	for _, file := range files {
+		cookie, err := socketCookie(file)
+		if err != nil {
+			return err
+		}
+		cookies = append(cookies, cookie)
+	}
+
+	if _, err := registerFiles(e, map[string][]*os.File{*label: files}); err != nil {
+		return err
+	}
+
+	names := make([]string, len(files))
+	for i := range names {
+		names[i] = *label
+	}
+
+	cmdArgs := append([]string{"-c", `LISTEN_PID=$$; export LISTEN_PID; exec "$0" "$@"`}, set.Args()...)
+	cmd := exec.Command("/bin/sh", cmdArgs...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(listenEnviron(os.Environ()),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+	)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, forwardedSignals...)
+	defer signal.Stop(sigs)
+
+	if err := cmd.Start(); err != nil {
+		unregisterCookies(e, *label, cookies)
+		return fmt.Errorf("start %s: %s", set.Arg(0), err)
+	}
+
+	e.stdout.Logf("started %s with pid %d\n", set.Arg(0), cmd.Process.Pid)
+
+	// The child holds the sockets from now on.
+	for _, file := range files {
+		file.Close()
+	}
+	files = nil
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var (
+		err  error
+		stop = e.ctx.Done()
+	)
+wait:
+	for {
+		select {
+		case sig := <-sigs:
+			cmd.Process.Signal(sig)
+		case <-stop:
+			cmd.Process.Signal(unix.SIGTERM)
+			stop = nil
+		case err = <-done:
+			break wait
+		}
+	}
+
+	unregisterCookies(e, *label, cookies)
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &childExitError{set.Arg(0), exitErr}
+	}
+	return err
+}
+
+// childExitError is returned by run if the command exits with an error.
+//
+// tubectl exits with the same status as the command.
+type childExitError struct {
+	name string
+	err  *exec.ExitError
+}
+
+func (cee *childExitError) Error() string {
+	return fmt.Sprintf("%s: %s", cee.name, cee.err)
+}
+
+func (cee *childExitError) Unwrap() error {
+	return cee.err
+}
+
+// status returns the exit status of the command. A command killed by a
+// signal has status 128 plus the signal number, like in a shell.
+func (cee *childExitError) status() int {
+	if ws, ok := cee.err.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return cee.err.ExitCode()
+}
+
+// listenEnviron removes any socket activation variables from environ.
+func listenEnviron(environ []string) []string {
+	var result []string
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, "LISTEN_") {
+			result = append(result, kv)
+		}
+	}
+	return result
+}
+
+// unregisterCookies removes the destinations of label which still refer to
+// one of cookies. Errors are logged.
+func unregisterCookies(e *env, label string, cookies []tubular.SocketCookie) {
+	dp, err := e.openDispatcher(false)
+	if err != nil {
+		e.stderr.Log("Can't unregister sockets:", err)
+		return
+	}
+	defer dp.Close()
+
+	_, current, err := dp.Destinations()
+	if err != nil {
+		e.stderr.Log("Can't unregister sockets:", err)
+		return
+	}
+
+	for dest, cookie := range current {
+		if dest.Label != label {
+			continue
+		}
+
+		for _, ours := range cookies {
+			if cookie != ours {
+				continue
+			}
+
+			// The socket may be replaced after Destinations returns, so
+			// only remove it if it's still ours.
+			err := dp.UnregisterSocketCookie(dest.Label, dest.Domain, dest.Protocol, cookie)
+			if errors.Is(err, tubular.ErrDestinationMismatch) {
+				e.stderr.Logf("Not unregistering %s: %s\n", &dest, err)
+			} else if err != nil {
+				e.stderr.Logf("Can't unregister %s: %s\n", &dest, err)
+			} else {
+				e.stdout.Logf("unregistered socket %s: %s\n", cookie, &dest)
+			}
+		}
+	}
+}
+
+// listenAddr is the argument to run -listen.
+type listenAddr struct {
+	proto tubular.Protocol
+	addr  netaddr.IPPort
+}
+
+func (la listenAddr) String() string {
+	return fmt.Sprintf("%s:%s", la.proto, la.addr)
+}
+
+// listen creates a blocking socket bound to the address.
+func (la listenAddr) listen() (*os.File, error) {
+	var (
+		domain int
+		sa     unix.Sockaddr
+		port   = int(la.addr.Port())
+	)
+	if ip := la.addr.IP(); ip.Is4() {
+		domain, sa = unix.AF_INET, &unix.SockaddrInet4{Addr: ip.As4(), Port: port}
+	} else {
+		domain, sa = unix.AF_INET6, &unix.SockaddrInet6{Addr: ip.As16(), Port: port}
+	}
+
+	sotype := unix.SOCK_STREAM
+	if la.proto == tubular.UDP {
+		sotype = unix.SOCK_DGRAM
+	}
+
+	fd, err := unix.Socket(domain, sotype|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("socket: %s", err)
+	}
+	file := os.NewFile(uintptr(fd), la.String())
+
+	if err := la.setup(fd, sa); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (la listenAddr) setup(fd int, sa unix.Sockaddr) error {
+	type sockopt struct {
+		level, opt int
+		name       string
+	}
+
+	var opts []sockopt
+	switch {
+	case la.proto == tubular.TCP:
+		opts = append(opts, sockopt{unix.SOL_SOCKET, unix.SO_REUSEADDR, "SO_REUSEADDR"})
+	case la.addr.IP().Is4():
+		opts = append(opts, sockopt{unix.SOL_IP, unix.IP_RECVORIGDSTADDR, "IP_RECVORIGDSTADDR"})
+	default:
+		opts = append(opts,
+			sockopt{unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, "IPV6_RECVORIGDSTADDR"},
+			sockopt{unix.SOL_IPV6, unix.IPV6_FREEBIND, "IPV6_FREEBIND"},
+		)
+	}
+
+	if la.addr.IP().Is6() {
+		// Dual-stack sockets can't be registered.
+		opts = append(opts, sockopt{unix.SOL_IPV6, unix.IPV6_V6ONLY, "IPV6_V6ONLY"})
+	}
+
+	for _, opt := range opts {
+		if err := unix.SetsockoptInt(fd, opt.level, opt.opt, 1); err != nil {
+			return fmt.Errorf("setsockopt(%s): %s", opt.name, err)
+		}
+	}
+
+	if err := unix.Bind(fd, sa); err != nil {
+		return fmt.Errorf("bind: %s", err)
+	}
+
+	if la.proto == tubular.TCP {
+		if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+			return fmt.Errorf("listen: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// listenAddrs is a repeatable flag of proto:ip:port.
+type listenAddrs []listenAddr
+
+func (las *listenAddrs) String() string {
+	var addrs []string
+	for _, la := range *las {
+		addrs = append(addrs, la.String())
+	}
+	return strings.Join(addrs, ",")
+}
+
+func (las *listenAddrs) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected proto:ip:port, got %q", value)
+	}
+
+	var la listenAddr
+	if err := la.proto.UnmarshalText([]byte(parts[0])); err != nil {
+		return err
+	}
+
+	addr, err := netaddr.ParseIPPort(parts[1])
+	if err != nil {
+		return err
+	}
+	la.addr = addr.WithIP(addr.IP().Unmap())
+
+	*las = append(*las, la)
+	return nil
+}
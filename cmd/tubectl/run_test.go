@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/tubular"
+)
+
+func TestRun(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	registered := func() map[tubular.Destination]tubular.SocketCookie {
+		t.Helper()
+
+		dp, err := tubular.OpenDispatcher(netns.Path(), "/sys/fs/bpf", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dp.Close()
+
+		_, cookies, err := dp.Destinations()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cookies
+	}
+
+	listen := []string{"-label", "foo", "-listen", "tcp:127.0.0.1:0", "-listen", "udp:[::1]:0", "--"}
+
+	t.Run("environment", func(t *testing.T) {
+		const script = `test "$LISTEN_PID" = "$$" &&
+			test "$LISTEN_FDS" = 2 &&
+			test "$LISTEN_FDNAMES" = foo:foo &&
+			test -S /proc/$$/fd/3 &&
+			test -S /proc/$$/fd/4 &&
+			{ sleep 1 & }`
+
+		tubectl := tubectlTestCall{
+			NetNS:  netns,
+			ExecNS: netns,
+			Cmd:    "run",
+			Args:   append(listen, "/bin/sh", "-c", script),
+		}
+		// The background sleep keeps the sockets alive after the command
+		// exits.
+		tubectl.MustRun(t)
+
+		if dests := registered(); len(dests) != 0 {
+			t.Error("Sockets weren't unregistered:", dests)
+		}
+	})
+
+	t.Run("supervise", func(t *testing.T) {
+		tubectl := tubectlTestCall{
+			NetNS:  netns,
+			ExecNS: netns,
+			Cmd:    "run",
+			Args:   append(listen, "sleep", "60"),
+		}
+		stop := tubectl.Start(t)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for len(registered()) != 2 {
+			if time.Now().After(deadline) {
+				stop()
+				t.Fatal("Sockets weren't registered:", registered())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		for dest := range registered() {
+			if dest.Label != "foo" {
+				t.Error("Socket registered under wrong label:", dest)
+			}
+		}
+
+		stop()
+		if dests := registered(); len(dests) != 0 {
+			t.Error("Sockets weren't unregistered:", dests)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		tubectl := tubectlTestCall{
+			NetNS:  netns,
+			ExecNS: netns,
+			Cmd:    "run",
+			Args:   append(listen, "/bin/sh", "-c", "exit 42"),
+		}
+		_, err := tubectl.Run(t)
+		if err == nil {
+			t.Fatal("Failing command doesn't return an error")
+		}
+		if status := exitStatus(err); status != 42 {
+			t.Error("Expected exit status 42, got", status)
+		}
+	})
+
+	for _, args := range [][]string{
+		{"-listen", "tcp:127.0.0.1:0", "true"},
+		{"-label", "foo", "true"},
+	} {
+		if _, err := testTubectl(t, netns, "run", args...); !errors.Is(err, errBadArg) {
+			t.Errorf("Expected errBadArg for %q, got %v", args, err)
+		}
+	}
+
+	for _, addr := range []string{"icmp:127.0.0.1:0", "tcp:127.0.0.1", "tcp"} {
+		if _, err := testTubectl(t, netns, "run", "-label", "foo", "-listen", addr, "true"); err == nil {
+			t.Errorf("Accepted invalid address %q", addr)
+		}
+	}
+}
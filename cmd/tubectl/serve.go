@@ -0,0 +1,803 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/tubular"
+	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular/internal/fdpass"
+	"github.com/cloudflare/tubular/internal/sysconn"
+
+	"golang.org/x/sys/unix"
+)
+
+func serve(e *env, args ...string) error {
+	set := e.newFlagSet("serve")
+	set.Description = `
+		Serve a JSON API on a unix socket.
+
+		The dispatcher is kept open while requests arrive, which avoids
+		the cost of invoking tubectl for every change. Other tubectl
+		commands which change state wait until the server has been idle
+		for -linger. Queries only hold a shared lock.
+
+		Anybody who can connect to the socket may query state. Changes
+		are allowed for root, the user running the server and members
+		of -group. Other peers may change bindings and sockets of labels
+		granted to them by -policy:
+
+		  {"rules":[{"users":["alice"],"groups":["web"],"labels":["foo","team-a/*"]}]}
+
+		With -register, sockets can be registered by sending them via
+		SCM_RIGHTS to a SOCK_SEQPACKET unix socket. This doesn't require
+		any privileges from the client, but serve needs CAP_NET_ADMIN to
+		check the network namespace of received sockets.
+
+		The socket is accessible by all users. Go programs can use
+		tubular.RegisterSocketWithServer.
+
+		Endpoints:
+		  GET    /v1/status
+		  GET    /v1/bindings
+		  POST   /v1/bindings     {"label":"foo","prefix":"127.0.0.1/32","port":80}
+		  PUT    /v1/bindings     {"bindings":[...]} (same as load-bindings)
+		  PUT    /v1/bindings?owner=team {"bindings":[...]} (same as load-bindings -owner)
+		  DELETE /v1/bindings     {"label":"foo","prefix":"127.0.0.1/32","port":80}
+		  GET    /v1/destinations
+		  DELETE /v1/destinations?label=foo&domain=ipv4&protocol=udp
+		  GET    /v1/metrics
+
+		Examples:
+		  $ tubectl serve -socket /run/tubular.sock
+		  THEN
+		  $ curl --unix-socket /run/tubular.sock http://localhost/v1/bindings`
+	socket := set.String("socket", "/run/tubular.sock", "`path` of the unix socket to listen on")
+	group := set.String("group", "", "`group` whose members may change state")
+	linger := set.Duration("linger", 100*time.Millisecond, "keep the dispatcher open for this long after a request")
+	register := set.String("register", "", "`path` of the unix socket to accept sockets on")
+	policyPath := set.String("policy", e.policy, "`file` granting labels to users and groups")
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	if err := e.setupEnv(); err != nil {
+		return err
+	}
+
+	srv := &apiServer{e: e, linger: *linger, gid: -1}
+	if *group != "" {
+		grp, err := user.LookupGroup(*group)
+		if err != nil {
+			return err
+		}
+
+		srv.gid, err = strconv.Atoi(grp.Gid)
+		if err != nil {
+			return fmt.Errorf("group %s: invalid gid: %s", *group, err)
+		}
+	}
+	defer srv.closeDispatcher()
+
+	if *policyPath != "" {
+		var err error
+		srv.policy, err = loadPolicy(*policyPath)
+		if errors.Is(err, os.ErrNotExist) && *policyPath == e.policy {
+			// The default policy is optional.
+		} else if err != nil {
+			return err
+		}
+	}
+
+	// Peers restricted by the policy need to be able to connect.
+	mode := os.FileMode(0600)
+	if srv.policy != nil {
+		mode = 0666
+	}
+
+	ln, err := listenUnix(e, "unix", *socket, mode, srv.gid)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	e.stdout.Log("Listening on", *socket)
+
+	if *register != "" {
+		regLn, err := listenUnix(e, fdpass.Network, *register, 0666, -1)
+		if err != nil {
+			return err
+		}
+		defer regLn.Close()
+
+		e.stdout.Log("Accepting sockets on", *register)
+		go srv.serveRegister(regLn)
+	}
+
+	httpSrv := http.Server{
+		Handler:     srv.handler(),
+		ReadTimeout: 30 * time.Second,
+		BaseContext: func(net.Listener) context.Context { return e.ctx },
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, peerCredKey{}, peerCred(conn))
+		},
+	}
+
+	go func() {
+		<-e.ctx.Done()
+		httpSrv.Close()
+	}()
+
+	if err := httpSrv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serve http: %s", err)
+	}
+
+	return nil
+}
+
+// listenUnix listens on a unix socket, replacing a stale socket file.
+//
+// The socket is accessible by the owning group if gid isn't -1.
+func listenUnix(e *env, network, path string, mode os.FileMode, gid int) (net.Listener, error) {
+	ln, err := e.listen(network, path)
+	if errors.Is(err, unix.EADDRINUSE) {
+		if conn, err := net.Dial(network, path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale socket: %s", err)
+		}
+
+		ln, err = e.listen(network, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if gid != -1 {
+		mode |= 0060
+		if err := os.Chown(path, -1, gid); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("change socket group: %s", err)
+		}
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("change socket permissions: %s", err)
+	}
+
+	return ln, nil
+}
+
+type peerCredKey struct{}
+
+// peerCred returns the credentials of the process connected to conn, or nil
+// if they aren't available.
+func peerCred(conn net.Conn) *unix.Ucred {
+	sc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var cred *unix.Ucred
+	err = raw.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil
+	}
+
+	return cred
+}
+
+type apiServer struct {
+	e      *env
+	linger time.Duration
+	// Group allowed to change state, -1 if none.
+	gid int
+	// Grants labels to peers which may not change state, may be nil.
+	policy *policy
+
+	mu    sync.Mutex
+	dp    *tubular.Dispatcher
+	timer *time.Timer
+	// True if dp only holds a shared lock.
+	readOnly bool
+}
+
+// withDispatcher invokes fn with a dispatcher opened read-write.
+//
+// The dispatcher is closed once no request has used it for s.linger, so that
+// other users of tubular aren't locked out.
+func (s *apiServer) withDispatcher(fn func(*tubular.Dispatcher) error) error {
+	return s.withDispatcherMode(false, fn)
+}
+
+// withReadOnlyDispatcher is like withDispatcher, but only requires a
+// read-only dispatcher. This allows other readers to use the dispatcher
+// concurrently.
+func (s *apiServer) withReadOnlyDispatcher(fn func(*tubular.Dispatcher) error) error {
+	return s.withDispatcherMode(true, fn)
+}
+
+func (s *apiServer) withDispatcherMode(readOnly bool, fn func(*tubular.Dispatcher) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+
+	if s.dp != nil && s.readOnly && !readOnly {
+		// Upgrade to an exclusive lock.
+		s.dp.Close()
+		s.dp = nil
+	}
+
+	if s.dp == nil {
+		dp, err := s.e.openDispatcher(readOnly)
+		if err != nil {
+			return err
+		}
+		s.dp = dp
+		s.readOnly = readOnly
+	}
+
+	err := fn(s.dp)
+	s.timer = time.AfterFunc(s.linger, s.closeDispatcher)
+	return err
+}
+
+func (s *apiServer) closeDispatcher() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dp != nil {
+		s.dp.Close()
+		s.dp = nil
+	}
+}
+
+// mayModify returns nil if the peer is allowed to change state.
+func (s *apiServer) mayModify(cred *unix.Ucred) error {
+	if cred == nil {
+		return fmt.Errorf("unknown peer")
+	}
+
+	if cred.Uid == 0 || int(cred.Uid) == os.Geteuid() {
+		return nil
+	}
+
+	if s.gid != -1 {
+		if int(cred.Gid) == s.gid {
+			return nil
+		}
+
+		for _, gid := range supplementaryGroupIDs(cred.Uid) {
+			if int(gid) == s.gid {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("uid %d isn't allowed to change state", cred.Uid)
+}
+
+// labelChecker returns a function which checks whether the peer may use a
+// label.
+//
+// Returns a nil function if the peer may change all state.
+func (s *apiServer) labelChecker(cred *unix.Ucred) (func(string) error, error) {
+	err := s.mayModify(cred)
+	if err == nil {
+		return nil, nil
+	} else if s.policy == nil {
+		return nil, &apiError{http.StatusForbidden, err}
+	}
+
+	return func(label string) error {
+		if err := s.policy.allows(cred, label); err != nil {
+			return &apiError{http.StatusForbidden, err}
+		}
+		return nil
+	}, nil
+}
+
+func requestCred(r *http.Request) *unix.Ucred {
+	cred, _ := r.Context().Value(peerCredKey{}).(*unix.Ucred)
+	return cred
+}
+
+// authorizeLabel checks that the peer may use label.
+func (s *apiServer) authorizeLabel(cred *unix.Ucred, label string) error {
+	check, err := s.labelChecker(cred)
+	if err != nil || check == nil {
+		return err
+	}
+	return check(label)
+}
+
+func (s *apiServer) serveRegister(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.e.stderr.Log("Can't accept connection:", err)
+			}
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			if err := s.handleRegister(conn.(*net.UnixConn)); err != nil {
+				s.e.stderr.Log("Can't register socket:", err)
+			}
+		}()
+	}
+}
+
+func (s *apiServer) handleRegister(conn *net.UnixConn) error {
+	cred := peerCred(conn)
+	if cred == nil {
+		return fmt.Errorf("unknown peer")
+	}
+
+	req, file, err := fdpass.ReadRequest(conn)
+	if err != nil {
+		return fmt.Errorf("uid %d: %s", cred.Uid, err)
+	}
+	defer file.Close()
+
+	var resp fdpass.Response
+	if err := s.authorizeLabel(cred, req.Label); err != nil {
+		resp.Denied = true
+		resp.Error = err.Error()
+		s.e.stderr.Log("Denied registration:", err)
+		return fdpass.WriteResponse(conn, &resp)
+	}
+
+	err = s.withDispatcher(func(dp *tubular.Dispatcher) error {
+		if err := socketInNetNS(file, s.e.netns); err != nil {
+			return err
+		}
+
+		dest, created, err := dp.RegisterSocket(req.Label, file)
+		if err != nil {
+			return err
+		}
+
+		cookie, err := socketCookie(file)
+		if err != nil {
+			return err
+		}
+
+		resp.Destination = &internal.Destination{
+			Label:    dest.Label,
+			Domain:   internal.Domain(dest.Domain),
+			Protocol: internal.Protocol(dest.Protocol),
+		}
+		resp.Cookie, resp.Created = internal.SocketCookie(cookie), created
+		return nil
+	})
+	if err != nil {
+		resp.Error = err.Error()
+		s.e.stderr.Logf("uid %d: register socket: %s\n", cred.Uid, err)
+	} else {
+		s.e.stdout.Logf("registered socket %s for %s by uid %d\n", resp.Cookie, resp.Destination, cred.Uid)
+	}
+
+	return fdpass.WriteResponse(conn, &resp)
+}
+
+// socketInNetNS returns an error if conn doesn't belong to the network
+// namespace at netnsPath.
+func socketInNetNS(conn syscall.Conn, netnsPath string) error {
+	fd, err := sysconn.ControlInt(conn, func(fd int) (int, error) {
+		return unix.IoctlRetInt(fd, unix.SIOCGSKNS)
+	})
+	if err != nil {
+		return fmt.Errorf("get socket network namespace: %s", err)
+	}
+	defer unix.Close(fd)
+
+	return namespacesEqual(netnsPath, fmt.Sprintf("/proc/self/fd/%d", fd))
+}
+
+// apiError is an error with an HTTP status code.
+type apiError struct {
+	code int
+	err  error
+}
+
+func (ae *apiError) Error() string { return ae.err.Error() }
+func (ae *apiError) Unwrap() error { return ae.err }
+
+func badRequest(err error) error {
+	return &apiError{http.StatusBadRequest, err}
+}
+
+type apiHandler func(r *http.Request) (interface{}, error)
+
+func (s *apiServer) handler() http.Handler {
+	routes := map[string]map[string]apiHandler{
+		"/v1/status": {
+			http.MethodGet: s.getStatus,
+		},
+		"/v1/bindings": {
+			http.MethodGet:    s.getBindings,
+			http.MethodPost:   s.addBinding,
+			http.MethodPut:    s.replaceBindings,
+			http.MethodDelete: s.removeBinding,
+		},
+		"/v1/destinations": {
+			http.MethodGet:    s.getDestinations,
+			http.MethodDelete: s.unregister,
+		},
+		"/v1/metrics": {
+			http.MethodGet: s.getMetrics,
+		},
+	}
+
+	mux := http.NewServeMux()
+	for path, methods := range routes {
+		methods := methods
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			fn := methods[r.Method]
+			if fn == nil {
+				writeJSON(w, http.StatusMethodNotAllowed, errorJSON{"method not allowed", ""})
+				return
+			}
+
+			cred := requestCred(r)
+			if cred == nil {
+				writeJSON(w, http.StatusForbidden, errorJSON{"unknown peer", ""})
+				return
+			}
+
+			// Handlers which change state check labels against the policy.
+			// Reject peers outright if there is no policy.
+			if r.Method != http.MethodGet && s.policy == nil {
+				if err := s.mayModify(cred); err != nil {
+					s.e.stderr.Logf("%s %s: %s\n", r.Method, r.URL.Path, err)
+					writeJSON(w, http.StatusForbidden, newErrorJSON(err))
+					return
+				}
+			}
+
+			result, err := fn(r)
+			if err != nil {
+				code := http.StatusInternalServerError
+				var ae *apiError
+				if errors.As(err, &ae) {
+					code = ae.code
+				} else if errors.Is(err, tubular.ErrNotLoaded) {
+					code = http.StatusServiceUnavailable
+				} else if errors.Is(err, tubular.ErrBindingNotFound) || errors.Is(err, tubular.ErrSocketNotFound) {
+					code = http.StatusNotFound
+				} else if errors.Is(err, tubular.ErrBindingConflict) || errors.Is(err, tubular.ErrDestinationMismatch) {
+					code = http.StatusConflict
+				}
+
+				writeJSON(w, code, newErrorJSON(err))
+				return
+			}
+
+			if r.Method != http.MethodGet {
+				s.e.stdout.Logf("%s %s by uid %d\n", r.Method, r.URL.Path, cred.Uid)
+			}
+
+			writeJSON(w, http.StatusOK, result)
+		})
+	}
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func decodeJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return badRequest(fmt.Errorf("decode request: %s", err))
+	}
+	return nil
+}
+
+type programJSON struct {
+	ID      uint32 `json:"id"`
+	Tag     string `json:"tag"`
+	Version string `json:"version"`
+}
+
+type statusJSON struct {
+	Version         string       `json:"version"`
+	Paused          bool         `json:"paused"`
+	Program         *programJSON `json:"program,omitempty"`
+	PreviousProgram *programJSON `json:"previous_program,omitempty"`
+}
+
+func newProgramJSON(prog *tubular.LoadedProgram) *programJSON {
+	if prog == nil {
+		return nil
+	}
+	return &programJSON{uint32(prog.ID), prog.Tag, prog.Version}
+}
+
+func (s *apiServer) getStatus(*http.Request) (interface{}, error) {
+	status := statusJSON{Version: Version}
+	return &status, s.withReadOnlyDispatcher(func(dp *tubular.Dispatcher) (err error) {
+		status.Paused, err = dp.Paused()
+		if err != nil {
+			return err
+		}
+
+		current, previous, err := dp.Programs()
+		if err != nil {
+			return err
+		}
+
+		status.Program = newProgramJSON(current)
+		status.PreviousProgram = newProgramJSON(previous)
+		return nil
+	})
+}
+
+func (s *apiServer) getBindings(*http.Request) (interface{}, error) {
+	result := []bindingJSON{}
+	return &result, s.withReadOnlyDispatcher(func(dp *tubular.Dispatcher) error {
+		bindings, err := dp.Bindings()
+		if err != nil {
+			return err
+		}
+
+		for _, bind := range bindings {
+			result = append(result, newBindingJSON(bind))
+		}
+		return nil
+	})
+}
+
+func decodeBinding(r *http.Request) (tubular.Bindings, error) {
+	var bj bindingJSON
+	if err := decodeJSON(r, &bj); err != nil {
+		return nil, err
+	}
+
+	bindings, err := bj.bindings()
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	return bindings, nil
+}
+
+func (s *apiServer) addBinding(r *http.Request) (interface{}, error) {
+	bindings, err := decodeBinding(r)
+	if err != nil {
+		return nil, err
+	}
+
+	check, err := s.labelChecker(requestCred(r))
+	if err != nil {
+		return nil, err
+	}
+
+	return struct{}{}, s.withDispatcher(func(dp *tubular.Dispatcher) error {
+		if check != nil {
+			current, err := dp.Bindings()
+			if err != nil {
+				return err
+			}
+
+			want := current
+			for _, bind := range bindings {
+				want = withBinding(want, bind)
+			}
+
+			if err := authorizeChanges(check, current, want); err != nil {
+				return err
+			}
+		}
+
+		for _, bind := range bindings {
+			if err := dp.AddBinding(bind); err != nil {
+				return err
+			}
+			s.e.stdout.Log("bound", bind)
+		}
+		return nil
+	})
+}
+
+func (s *apiServer) removeBinding(r *http.Request) (interface{}, error) {
+	bindings, err := decodeBinding(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.authorizeLabel(requestCred(r), bindings[0].Label); err != nil {
+		return nil, err
+	}
+
+	return struct{}{}, s.withDispatcher(func(dp *tubular.Dispatcher) error {
+		for _, bind := range bindings {
+			if err := dp.RemoveBinding(bind); err != nil {
+				return err
+			}
+			s.e.stdout.Log("unbound", bind)
+		}
+		return nil
+	})
+}
+
+type replaceJSON struct {
+	Added   []bindingJSON `json:"added"`
+	Removed []bindingJSON `json:"removed"`
+}
+
+func newReplaceJSON(added, removed tubular.Bindings) *replaceJSON {
+	return &replaceJSON{newBindingsJSON(added), newBindingsJSON(removed)}
+}
+
+func (s *apiServer) replaceBindings(r *http.Request) (interface{}, error) {
+	var config configJSON
+	if err := decodeJSON(r, &config); err != nil {
+		return nil, err
+	}
+
+	var bindings tubular.Bindings
+	for _, bj := range config.Bindings {
+		expanded, err := bj.bindings()
+		if err != nil {
+			return nil, badRequest(err)
+		}
+		bindings = append(bindings, expanded...)
+	}
+
+	check, err := s.labelChecker(requestCred(r))
+	if err != nil {
+		return nil, err
+	}
+
+	owner := r.URL.Query().Get("owner")
+	result := replaceJSON{[]bindingJSON{}, []bindingJSON{}}
+	return &result, s.withDispatcher(func(dp *tubular.Dispatcher) error {
+		added, removed, err := replaceBindings(dp, check, owner, bindings)
+		if err != nil {
+			return err
+		}
+
+		for _, bind := range added {
+			s.e.stdout.Log("added", bind)
+			result.Added = append(result.Added, newBindingJSON(bind))
+		}
+		for _, bind := range removed {
+			s.e.stdout.Log("removed", bind)
+			result.Removed = append(result.Removed, newBindingJSON(bind))
+		}
+		return nil
+	})
+}
+
+type destinationJSON struct {
+	Label    string           `json:"label"`
+	Domain   tubular.Domain   `json:"domain"`
+	Protocol tubular.Protocol `json:"protocol"`
+	// Cookie of the registered socket, empty if there is none.
+	Socket string `json:"socket,omitempty"`
+}
+
+func newDestinationJSON(dest tubular.Destination, cookie tubular.SocketCookie) destinationJSON {
+	dj := destinationJSON{dest.Label, dest.Domain, dest.Protocol, ""}
+	if cookie != 0 {
+		dj.Socket = cookie.String()
+	}
+	return dj
+}
+
+func (s *apiServer) getDestinations(*http.Request) (interface{}, error) {
+	result := []destinationJSON{}
+	return &result, s.withReadOnlyDispatcher(func(dp *tubular.Dispatcher) error {
+		dests, cookies, err := dp.Destinations()
+		if err != nil {
+			return err
+		}
+
+		sortDestinations(dests)
+		for _, dest := range dests {
+			result = append(result, newDestinationJSON(dest, cookies[dest]))
+		}
+		return nil
+	})
+}
+
+func (s *apiServer) unregister(r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+
+	var domain tubular.Domain
+	if err := domain.UnmarshalText([]byte(query.Get("domain"))); err != nil {
+		return nil, badRequest(err)
+	}
+
+	var proto tubular.Protocol
+	if err := proto.UnmarshalText([]byte(query.Get("protocol"))); err != nil {
+		return nil, badRequest(err)
+	}
+
+	dest := tubular.Destination{Label: query.Get("label"), Domain: domain, Protocol: proto}
+	if dest.Label == "" {
+		return nil, badRequest(fmt.Errorf("missing label"))
+	}
+
+	if err := s.authorizeLabel(requestCred(r), dest.Label); err != nil {
+		return nil, err
+	}
+
+	return struct{}{}, s.withDispatcher(func(dp *tubular.Dispatcher) error {
+		if err := dp.UnregisterSocket(dest.Label, dest.Domain, dest.Protocol); err != nil {
+			return err
+		}
+		s.e.stdout.Log("unregistered", &dest)
+		return nil
+	})
+}
+
+type metricsJSON struct {
+	destinationJSON
+	Bindings       uint64 `json:"bindings"`
+	Lookups        uint64 `json:"lookups"`
+	Misses         uint64 `json:"misses"`
+	ErrorBadSocket uint64 `json:"error_bad_socket"`
+}
+
+func (s *apiServer) getMetrics(*http.Request) (interface{}, error) {
+	result := []metricsJSON{}
+	return &result, s.withReadOnlyDispatcher(func(dp *tubular.Dispatcher) error {
+		metrics, err := dp.Metrics()
+		if err != nil {
+			return err
+		}
+
+		dests := make([]tubular.Destination, 0, len(metrics.Destinations))
+		for dest := range metrics.Destinations {
+			dests = append(dests, dest)
+		}
+		sortDestinations(dests)
+
+		for _, dest := range dests {
+			counters := metrics.Destinations[dest]
+			result = append(result, metricsJSON{
+				destinationJSON{dest.Label, dest.Domain, dest.Protocol, ""},
+				metrics.Bindings[dest],
+				counters.Lookups,
+				counters.Misses,
+				counters.ErrorBadSocket,
+			})
+		}
+		return nil
+	})
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/tubular"
+	"github.com/cloudflare/tubular/internal/testutil"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+func TestServe(t *testing.T) {
+	netns := mustReadyNetNS(t)
+	socket := filepath.Join(t.TempDir(), "tubular.sock")
+
+	tubectl := tubectlTestCall{
+		NetNS:     netns,
+		Cmd:       "serve",
+		Args:      []string{"-socket", socket},
+		Listeners: make(chan net.Listener, 1),
+	}
+	tubectl.Start(t)
+
+	select {
+	case <-tubectl.Listeners:
+	case <-time.After(time.Second):
+		t.Fatal("tubectl isn't listening after one second")
+	}
+
+	client := newServeClient(socket)
+	client.Request(t, http.MethodPost, "/v1/bindings", `{"label":"foo","prefix":"127.0.0.1/32","port":80,"protocol":"tcp"}`, nil)
+
+	var bindings []bindingJSON
+	client.Request(t, http.MethodGet, "/v1/bindings", "", &bindings)
+
+	port, proto := uint16(80), tubular.TCP
+	want := []bindingJSON{
+		{"foo", mustParsePrefix(t, "127.0.0.1/32"), &port, &proto, ""},
+	}
+	if diff := cmp.Diff(want, bindings, prefixComparer()); diff != "" {
+		t.Errorf("Bindings don't match (-want +got):\n%s", diff)
+	}
+
+	var status statusJSON
+	client.Request(t, http.MethodGet, "/v1/status", "", &status)
+	if status.Program == nil {
+		t.Error("Status doesn't contain program")
+	}
+
+	client.Request(t, http.MethodDelete, "/v1/bindings", `{"label":"foo","prefix":"127.0.0.1/32","port":80,"protocol":"tcp"}`, nil)
+
+	client.Request(t, http.MethodGet, "/v1/bindings", "", &bindings)
+	if len(bindings) != 0 {
+		t.Error("Binding wasn't removed:", bindings)
+	}
+}
+
+func TestServeReadOnly(t *testing.T) {
+	netns := mustReadyNetNS(t)
+	socket := filepath.Join(t.TempDir(), "tubular.sock")
+
+	tubectl := tubectlTestCall{
+		NetNS:     netns,
+		Cmd:       "serve",
+		Args:      []string{"-socket", socket, "-linger", "1h"},
+		Listeners: make(chan net.Listener, 1),
+	}
+	tubectl.Start(t)
+
+	select {
+	case <-tubectl.Listeners:
+	case <-time.After(time.Second):
+		t.Fatal("tubectl isn't listening after one second")
+	}
+
+	var bindings []bindingJSON
+	newServeClient(socket).Request(t, http.MethodGet, "/v1/bindings", "", &bindings)
+
+	// The server keeps the dispatcher open, but mustn't hold an exclusive
+	// lock for queries.
+	opened := make(chan error, 1)
+	go func() {
+		dp, err := tubular.OpenDispatcher(netns.Path(), "/sys/fs/bpf", true)
+		if err == nil {
+			dp.Close()
+		}
+		opened <- err
+	}()
+
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Fatal("Can't open dispatcher:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Server holds an exclusive lock after a query")
+	}
+}
+
+func TestServeRegister(t *testing.T) {
+	// Requests are handled on threads which don't inherit the capabilities
+	// of tubectlTestCall. TestSocketInNetNS covers the privileged part.
+	if ok, _ := cap.GetProc().GetFlag(cap.Effective, cap.NET_ADMIN); !ok {
+		t.Skip("Checking the network namespace of sockets requires CAP_NET_ADMIN")
+	}
+
+	netns := mustReadyNetNS(t)
+	dir := t.TempDir()
+	register := filepath.Join(dir, "register.sock")
+
+	tubectl := tubectlTestCall{
+		NetNS:     netns,
+		Cmd:       "serve",
+		Args:      []string{"-socket", filepath.Join(dir, "tubular.sock"), "-register", register},
+		Listeners: make(chan net.Listener, 2),
+	}
+	tubectl.Start(t)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-tubectl.Listeners:
+		case <-time.After(time.Second):
+			t.Fatal("tubectl isn't listening after one second")
+		}
+	}
+
+	ln := testutil.Listen(t, netns, "tcp4", "127.0.0.1:0")
+	dest, cookie, err := tubular.RegisterSocketWithServer(register, "foo", ln)
+	if err != nil {
+		t.Fatal("Can't register socket:", err)
+	}
+
+	if dest.Label != "foo" || dest.Domain != tubular.AF_INET || dest.Protocol != tubular.TCP {
+		t.Error("Unexpected destination", dest)
+	}
+
+	if want := mustSocketCookie(t, ln); cookie != want {
+		t.Errorf("Expected cookie %s, got %s", want, cookie)
+	}
+}
+
+func TestSocketInNetNS(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	ln := testutil.Listen(t, netns, "tcp4", "127.0.0.1:0")
+
+	err := testutil.WithCapabilities(func() error {
+		if err := socketInNetNS(ln, netns.Path()); err != nil {
+			t.Error("Socket isn't in its network namespace:", err)
+		}
+
+		if err := socketInNetNS(ln, "/proc/self/ns/net"); err == nil {
+			t.Error("Socket is in the wrong network namespace")
+		}
+		return nil
+	}, cap.NET_ADMIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeMayModify(t *testing.T) {
+	srv := apiServer{gid: 1234}
+
+	for _, cred := range []*unix.Ucred{
+		{Uid: 0, Gid: 0},
+		{Uid: uint32(unix.Geteuid()), Gid: 1},
+		{Uid: 4321, Gid: 1234},
+	} {
+		if err := srv.mayModify(cred); err != nil {
+			t.Errorf("uid %d gid %d: %s", cred.Uid, cred.Gid, err)
+		}
+	}
+
+	if err := srv.mayModify(&unix.Ucred{Uid: 4321, Gid: 4321}); err == nil {
+		t.Error("Unprivileged peer may modify state")
+	}
+
+	if err := srv.mayModify(nil); err == nil {
+		t.Error("Unknown peer may modify state")
+	}
+}
+
+func TestServeUnknownPeer(t *testing.T) {
+	srv := apiServer{e: &defaultEnv, gid: -1, policy: &policy{}}
+	handler := srv.handler()
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		req := httptest.NewRequest(method, "/v1/bindings", strings.NewReader("{}"))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s from unknown peer returns %d instead of %d", method, rec.Code, http.StatusForbidden)
+		}
+	}
+}
+
+type serveClient struct {
+	http.Client
+}
+
+func newServeClient(socket string) *serveClient {
+	return &serveClient{http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}}
+}
+
+// Request sends a request to the server and decodes the response into
+// result, which may be nil.
+func (sc *serveClient) Request(t *testing.T, method, path, body string, result interface{}) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, "http://localhost"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := sc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var buf bytes.Buffer
+		buf.ReadFrom(res.Body)
+		t.Fatalf("%s %s: %s: %s", method, path, res.Status, buf.String())
+	}
+
+	if result != nil {
+		if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+			t.Fatal("Decode response:", err)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/cloudflare/tubular"
+	"github.com/cloudflare/tubular/internal/cgroup"
+	"github.com/cloudflare/tubular/internal/pidfd"
+	"github.com/cloudflare/tubular/internal/sysconn"
+
+	"golang.org/x/sys/unix"
+)
+
+func sockets(e *env, args ...string) error {
+	set := e.newFlagSet("sockets", "--", "pid|cgroup")
+	set.Description = `
+		List inet sockets of a process, a cgroup or the whole network namespace.
+
+		The output shows whether a socket can be registered, and the
+		reason if it can't. Sockets in the same reuseport group share a
+		group number.
+
+		Examples:
+		  $ tubectl sockets
+		  $ tubectl sockets 12345
+		  $ tubectl sockets nginx.service`
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+
+	var (
+		pids []int
+		// Whether pids was given explicitly, which makes errors fatal.
+		explicit = set.NArg() > 0
+		err      error
+	)
+	if !explicit {
+		pids, err = netnsPIDs(e.netns)
+	} else if pid, parseErr := strconv.Atoi(set.Arg(0)); parseErr == nil {
+		pids = []int{pid}
+	} else {
+		var path string
+		path, err = cgroup.Resolve(e.cgroupFs, set.Arg(0))
+		if err == nil {
+			pids, err = cgroup.PIDs(path)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	var infos []socketInfo
+	for _, pid := range pids {
+		if pid == os.Getpid() {
+			continue
+		}
+
+		if explicit {
+			if err := namespacesEqual(e.netns, fmt.Sprintf("/proc/%d/ns/net", pid)); err != nil {
+				e.stderr.Logf("skipping pid %d: %s\n", pid, err)
+				continue
+			}
+		}
+
+		fds, err := pidfd.Fds(pid, sysconn.IgnoreENOTSOCK(inetSocket))
+		var fe *pidfd.FdError
+		if errors.As(err, &fe) {
+			// Show the sockets which could be examined.
+			e.stderr.Logf("pid %d: %s\n", pid, fe)
+		} else if errors.Is(err, unix.ESRCH) || errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil && explicit {
+			return fmt.Errorf("pid %d: %w", pid, err)
+		} else if err != nil {
+			e.stderr.Logf("skipping pid %d: %s\n", pid, err)
+			continue
+		}
+
+		for i, fd := range fds {
+			info, err := newSocketInfo(pid, fd)
+			if err != nil {
+				for _, fd := range fds[i:] {
+					fd.File.Close()
+				}
+				return fmt.Errorf("pid %d: fd %d: %s", pid, fd.Number, err)
+			}
+			fd.File.Close()
+			infos = append(infos, *info)
+		}
+	}
+
+	return printSockets(e, infos)
+}
+
+func inetSocket(fd int) (bool, error) {
+	domain, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	if err != nil {
+		return false, err
+	}
+	return domain == unix.AF_INET || domain == unix.AF_INET6, nil
+}
+
+// netnsPIDs returns all processes in a network namespace.
+func netnsPIDs(netns string) ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		if namespacesEqual(netns, fmt.Sprintf("/proc/%d/ns/net", pid)) != nil {
+			// Either in a different namespace or gone.
+			continue
+		}
+
+		pids = append(pids, pid)
+	}
+
+	sort.Ints(pids)
+	return pids, nil
+}
+
+type socketInfo struct {
+	pid, fd   int
+	cookie    tubular.SocketCookie
+	domain    string
+	sotype    string
+	protocol  string
+	local     string
+	reuseport bool
+	state     string
+	v6only    string
+	// The reason why the socket can't be registered, empty if it can.
+	reason string
+}
+
+func newSocketInfo(pid int, fd pidfd.Fd) (*socketInfo, error) {
+	info := &socketInfo{pid: pid, fd: fd.Number, v6only: "-"}
+
+	var err error
+	info.cookie, err = socketCookie(fd.File)
+	if err != nil {
+		return nil, err
+	}
+
+	info.local, err = localAddr(fd.File)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sysconn.Control(fd.File, func(fd int) error {
+		domain, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+		if err != nil {
+			return fmt.Errorf("getsockopt(SO_DOMAIN): %s", err)
+		}
+
+		sotype, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+		if err != nil {
+			return fmt.Errorf("getsockopt(SO_TYPE): %s", err)
+		}
+
+		proto, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_PROTOCOL)
+		if err != nil {
+			return fmt.Errorf("getsockopt(SO_PROTOCOL): %s", err)
+		}
+
+		reuseport, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT)
+		if err != nil {
+			return fmt.Errorf("getsockopt(SO_REUSEPORT): %s", err)
+		}
+		info.reuseport = reuseport == 1
+
+		acceptConn, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ACCEPTCONN)
+		if err != nil {
+			return fmt.Errorf("getsockopt(SO_ACCEPTCONN): %s", err)
+		}
+
+		_, err = unix.Getpeername(fd)
+		connected := err == nil
+		if err != nil && !errors.Is(err, unix.ENOTCONN) {
+			return fmt.Errorf("getpeername: %s", err)
+		}
+
+		switch {
+		case acceptConn == 1:
+			info.state = "listening"
+		case connected:
+			info.state = "connected"
+		default:
+			info.state = "unconnected"
+		}
+
+		switch domain {
+		case unix.AF_INET:
+			info.domain = "ipv4"
+		case unix.AF_INET6:
+			info.domain = "ipv6"
+
+			v6only, err := unix.GetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY)
+			if err != nil {
+				return fmt.Errorf("getsockopt(IPV6_V6ONLY): %s", err)
+			}
+			info.v6only = strconv.FormatBool(v6only == 1)
+		}
+
+		switch sotype {
+		case unix.SOCK_STREAM:
+			info.sotype = "stream"
+		case unix.SOCK_DGRAM:
+			info.sotype = "dgram"
+		case unix.SOCK_RAW:
+			info.sotype = "raw"
+		default:
+			info.sotype = strconv.Itoa(sotype)
+		}
+
+		switch proto {
+		case unix.IPPROTO_TCP:
+			info.protocol = "tcp"
+		case unix.IPPROTO_UDP:
+			info.protocol = "udp"
+		default:
+			info.protocol = strconv.Itoa(proto)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The label doesn't influence the checks.
+	if _, err := tubular.NewDestination("sockets", fd.File); err != nil {
+		info.reason = err.Error()
+	}
+
+	return info, nil
+}
+
+// socketJSON describes a socket in the output of the sockets command.
+type socketJSON struct {
+	PID      int    `json:"pid"`
+	FD       int    `json:"fd"`
+	Cookie   string `json:"cookie"`
+	Domain   string `json:"domain"`
+	Type     string `json:"type"`
+	Protocol string `json:"protocol"`
+	Local    string `json:"local"`
+	// Sockets in the same reuseport group share a number, zero if the
+	// socket doesn't use SO_REUSEPORT.
+	ReuseportGroup int    `json:"reuseport_group,omitempty"`
+	State          string `json:"state"`
+	// Omitted for IPv4 sockets.
+	V6Only      *bool `json:"v6only,omitempty"`
+	Registrable bool  `json:"registrable"`
+	// The reason why the socket can't be registered.
+	Reason string `json:"reason,omitempty"`
+}
+
+func printSockets(e *env, infos []socketInfo) error {
+	// Sockets with SO_REUSEPORT bound to the same address form a group.
+	type groupKey struct{ protocol, local string }
+	groups := make(map[groupKey]int)
+	reuseportGroup := func(info *socketInfo) int {
+		if !info.reuseport {
+			return 0
+		}
+
+		key := groupKey{info.protocol, info.local}
+		if _, ok := groups[key]; !ok {
+			groups[key] = len(groups) + 1
+		}
+		return groups[key]
+	}
+
+	if e.format.structured() {
+		result := make([]socketJSON, 0, len(infos))
+		for i := range infos {
+			info := &infos[i]
+			sj := socketJSON{
+				info.pid, info.fd, info.cookie.String(), info.domain, info.sotype, info.protocol,
+				info.local, reuseportGroup(info), info.state, nil, info.reason == "", info.reason,
+			}
+			if v6only, err := strconv.ParseBool(info.v6only); err == nil {
+				sj.V6Only = &v6only
+			}
+			result = append(result, sj)
+		}
+		return e.writeResult(result)
+	}
+
+	w := tabwriter.NewWriter(e.stdout, 0, 0, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "pid\tfd\tcookie\tdomain\ttype\tprotocol\tlocal\treuseport\tstate\tv6only\tregister\t")
+
+	for i := range infos {
+		info := &infos[i]
+		group := "-"
+		if n := reuseportGroup(info); n != 0 {
+			group = fmt.Sprintf("#%d", n)
+		}
+
+		verdict := "yes"
+		if info.reason != "" {
+			verdict = "no: " + info.reason
+		}
+
+		_, err := fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			info.pid, info.fd, info.cookie, info.domain, info.sotype, info.protocol,
+			info.local, group, info.state, info.v6only, verdict)
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
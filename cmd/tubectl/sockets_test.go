@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/tubular/internal/testutil"
+)
+
+func TestSockets(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("udp6", "[::1]:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var files []*os.File
+	for _, c := range []interface{ File() (*os.File, error) }{ln.(*net.TCPListener), conn.(*net.UDPConn)} {
+		file, err := c.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		files = append(files, file)
+	}
+
+	child := testutil.SpawnChildWithFiles(t, files...)
+
+	tubectl := tubectlTestCall{
+		Cmd:  "sockets",
+		Args: []string{fmt.Sprint(child)},
+	}
+	output := tubectl.MustRun(t)
+
+	lines := make(map[string]string)
+	for _, line := range strings.Split(output.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 6 {
+			lines[fields[6]] = line
+		}
+	}
+
+	listener := lines[ln.Addr().String()]
+	if listener == "" {
+		t.Fatal("Output doesn't contain listener")
+	}
+	for _, want := range []string{" 3 ", "ipv4", "stream", "tcp", "listening", "yes"} {
+		if !strings.Contains(listener, want) {
+			t.Errorf("Listener doesn't contain %q: %s", want, listener)
+		}
+	}
+
+	connected := lines[conn.LocalAddr().String()]
+	if connected == "" {
+		t.Fatal("Output doesn't contain connected socket")
+	}
+	for _, want := range []string{" 4 ", "ipv6", "dgram", "udp", "connected", "true", "no: "} {
+		if !strings.Contains(connected, want) {
+			t.Errorf("Connected socket doesn't contain %q: %s", want, connected)
+		}
+	}
+}
@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"runtime"
 	"sort"
 	"text/tabwriter"
 	"time"
 
+	"github.com/cloudflare/tubular"
 	"github.com/cloudflare/tubular/internal"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -29,10 +31,12 @@ func status(e *env, args ...string) error {
 	}
 
 	var (
-		bindings internal.Bindings
-		dests    []internal.Destination
-		cookies  map[internal.Destination]internal.SocketCookie
-		metrics  *internal.Metrics
+		bindings          tubular.Bindings
+		dests             []tubular.Destination
+		cookies           map[tubular.Destination]tubular.SocketCookie
+		metrics           *tubular.Metrics
+		current, previous *tubular.LoadedProgram
+		paused            bool
 	)
 	{
 		dp, err := e.openDispatcher(true)
@@ -56,11 +60,23 @@ func status(e *env, args ...string) error {
 			return fmt.Errorf("get metrics: %s", err)
 		}
 
+		paused, err = dp.Paused()
+		if err != nil {
+			return fmt.Errorf("get paused: %s", err)
+		}
+
+		// Programs can't be opened read-only, so this fails for unprivileged
+		// users. Omit program information in that case.
+		current, previous, err = dp.Programs()
+		if err != nil && !errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("get programs: %s", err)
+		}
+
 		dp.Close()
 	}
 
 	if label := set.Arg(0); label != "" {
-		var filtered internal.Bindings
+		var filtered tubular.Bindings
 		for _, bind := range bindings {
 			if bind.Label == label {
 				filtered = append(filtered, bind)
@@ -68,7 +84,7 @@ func status(e *env, args ...string) error {
 		}
 		bindings = filtered
 
-		var filteredDests []internal.Destination
+		var filteredDests []tubular.Destination
 		for _, dest := range dests {
 			if dest.Label == label {
 				filteredDests = append(filteredDests, dest)
@@ -77,15 +93,49 @@ func status(e *env, args ...string) error {
 		dests = filteredDests
 	}
 
+	sortDestinations(dests)
+
+	if e.format.structured() {
+		result := statusResultJSON{
+			statusJSON{Version, paused, newProgramJSON(current), newProgramJSON(previous)},
+			newBindingsJSON(bindings),
+			[]metricsJSON{},
+		}
+
+		for _, dest := range dests {
+			counters := metrics.Destinations[dest]
+			result.Destinations = append(result.Destinations, metricsJSON{
+				newDestinationJSON(dest, cookies[dest]),
+				metrics.Bindings[dest],
+				counters.Lookups,
+				counters.Misses,
+				counters.ErrorBadSocket,
+			})
+		}
+
+		return e.writeResult(&result)
+	}
+
 	w := tabwriter.NewWriter(e.stdout, 0, 0, 1, ' ', tabwriter.AlignRight)
 
+	if paused {
+		e.stdout.Log("Dispatcher is paused, use resume to steer traffic again.")
+		e.stdout.Log()
+	}
+
+	if current != nil {
+		e.stdout.Log("Programs:")
+		if err := printPrograms(w, current, previous); err != nil {
+			return err
+		}
+		e.stdout.Log()
+	}
+
 	e.stdout.Log("Bindings:")
 	if err := printBindings(w, bindings); err != nil {
 		return err
 	}
 
-	sortDestinations(dests)
-
 	e.stdout.Log("\nDestinations:")
 	fmt.Fprintln(w, "label\tdomain\tprotocol\tsocket\tlookups\tmisses\terrors\t")
 
@@ -113,14 +163,49 @@ func status(e *env, args ...string) error {
 	return nil
 }
 
-func printBindings(w *tabwriter.Writer, bindings internal.Bindings) error {
+// statusResultJSON is the result of the status command.
+type statusResultJSON struct {
+	statusJSON
+	Bindings     []bindingJSON `json:"bindings"`
+	Destinations []metricsJSON `json:"destinations"`
+}
+
+func printBindings(w *tabwriter.Writer, bindings tubular.Bindings) error {
 	// Output from most specific to least specific.
 	sort.Sort(bindings)
 
-	fmt.Fprintln(w, "protocol\tprefix\tport\tlabel\t")
+	fmt.Fprintln(w, "protocol\tprefix\tport\tlabel\towner\t")
 
 	for _, bind := range bindings {
-		_, err := fmt.Fprintf(w, "%v\t%s\t%d\t%s\t\n", bind.Protocol, bind.Prefix, bind.Port, bind.Label)
+		_, err := fmt.Fprintf(w, "%v\t%s\t%d\t%s\t%s\t\n", bind.Protocol, bind.Prefix, bind.Port, bind.Label, bind.Owner)
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+func printPrograms(w *tabwriter.Writer, current, previous *tubular.LoadedProgram) error {
+	fmt.Fprintln(w, "\tid\ttag\tversion\t")
+
+	for _, prog := range []struct {
+		name string
+		*tubular.LoadedProgram
+	}{
+		{"current", current},
+		{"previous", previous},
+	} {
+		if prog.LoadedProgram == nil {
+			continue
+		}
+
+		version := prog.Version
+		if version == "" {
+			version = "unknown"
+		}
+
+		_, err := fmt.Fprintf(w, "%s\t%d\t%s\t%s\t\n", prog.name, prog.ID, prog.Tag, version)
 		if err != nil {
 			return err
 		}
@@ -129,7 +214,7 @@ func printBindings(w *tabwriter.Writer, bindings internal.Bindings) error {
 	return w.Flush()
 }
 
-func sortDestinations(dests []internal.Destination) {
+func sortDestinations(dests []tubular.Destination) {
 	sort.Slice(dests, func(i, j int) bool {
 		a, b := dests[i], dests[j]
 		if a.Label != b.Label {
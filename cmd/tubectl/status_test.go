@@ -10,7 +10,7 @@ import (
 	"testing"
 	"time"
 
-	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular"
 	"github.com/cloudflare/tubular/internal/testutil"
 )
 
@@ -18,7 +18,7 @@ func TestStatus(t *testing.T) {
 	netns := mustReadyNetNS(t)
 
 	dp := mustOpenDispatcher(t, netns)
-	mustAddBinding(t, dp, "foo", internal.TCP, "::1", 80)
+	mustAddBinding(t, dp, "foo", tubular.TCP, "::1", 80)
 	sock := makeListeningSocket(t, netns, "tcp")
 	mustRegisterSocket(t, dp, "foo", sock)
 	dp.Close()
@@ -55,7 +55,7 @@ func TestStatusFilteredByLabel(t *testing.T) {
 	netns := mustReadyNetNS(t)
 
 	dp := mustOpenDispatcher(t, netns)
-	mustAddBinding(t, dp, "foo", internal.TCP, "::1", 80)
+	mustAddBinding(t, dp, "foo", tubular.TCP, "::1", 80)
 	sock := makeListeningSocket(t, netns, "tcp")
 	mustRegisterSocket(t, dp, "foo", sock)
 	dp.Close()
@@ -141,3 +141,42 @@ func TestMetricsInvalidArgs(t *testing.T) {
 		t.Error("metrics command accepts missing port")
 	}
 }
+
+func TestStatusJSON(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	mustAddBinding(t, dp, "foo", tubular.TCP, "::1", 80)
+	mustAddBinding(t, dp, "bar", tubular.UDP, "127.0.0.1", 53)
+	sock := makeListeningSocket(t, netns, "tcp6")
+	mustRegisterSocket(t, dp, "foo", sock)
+	dp.Close()
+
+	tubectl := tubectlTestCall{
+		NetNS: netns,
+		Cmd:   "status",
+		Args:  []string{"foo"},
+	}
+
+	var result statusResultJSON
+	if err := tubectl.RunJSON(t, &result); err != nil {
+		t.Fatal("Can't execute status:", err)
+	}
+
+	if result.Paused {
+		t.Error("Dispatcher is reported as paused")
+	}
+
+	if n := len(result.Bindings); n != 1 || result.Bindings[0].Label != "foo" {
+		t.Errorf("Expected one binding for foo, got %v", result.Bindings)
+	}
+
+	want := metricsJSON{destinationJSON: newDestinationJSON(tubular.Destination{
+		Label:    "foo",
+		Domain:   tubular.AF_INET6,
+		Protocol: tubular.TCP,
+	}, mustSocketCookie(t, sock)), Bindings: 1}
+	if n := len(result.Destinations); n != 1 || result.Destinations[0] != want {
+		t.Errorf("Expected destination %+v, got %+v", want, result.Destinations)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
-	"github.com/cloudflare/tubular/internal"
+	"fmt"
+
+	"github.com/cloudflare/tubular"
 )
 
 func unregister(e *env, args ...string) error {
@@ -9,10 +11,16 @@ func unregister(e *env, args ...string) error {
 	set.Description = `
 		Removes the socket mapping for the given label, domain and protocol.
 
+		With -cookie the mapping is only removed if it still refers to the
+		socket with the given cookie. This prevents removing the socket of
+		a new instance of a service during a graceful restart.
+
 		Examples:
 		  $ tubectl unregister foo ipv4 udp
 		  $ tubectl unregister bar ipv6 tcp
+		  $ tubectl unregister -cookie sk:4001 foo ipv4 udp
 		`
+	cookieStr := set.String("cookie", "", "only remove the socket with `cookie`")
 
 	if err := set.Parse(args); err != nil {
 		return err
@@ -20,25 +28,42 @@ func unregister(e *env, args ...string) error {
 
 	label := set.Arg(0)
 
-	var domain internal.Domain
+	var cookie tubular.SocketCookie
+	if *cookieStr != "" {
+		if err := cookie.UnmarshalText([]byte(*cookieStr)); err != nil {
+			return fmt.Errorf("%w: %s", errBadArg, err)
+		}
+	}
+
+	var domain tubular.Domain
 	if err := domain.UnmarshalText([]byte(set.Arg(1))); err != nil {
 		return err
 	}
 
-	var proto internal.Protocol
+	var proto tubular.Protocol
 	if err := proto.UnmarshalText([]byte(set.Arg(2))); err != nil {
 		return err
 	}
 
+	if err := e.authorizeLabel(label); err != nil {
+		return err
+	}
+
 	dp, err := e.openDispatcher(false)
 	if err != nil {
 		return err
 	}
 	defer dp.Close()
 
-	if err := dp.UnregisterSocket(label, domain, proto); err != nil {
+	if cookie != 0 {
+		err = dp.UnregisterSocketCookie(label, domain, proto, cookie)
+	} else {
+		err = dp.UnregisterSocket(label, domain, proto)
+	}
+	if err != nil {
 		return err
 	}
 
-	return nil
+	dest := tubular.Destination{Label: label, Domain: domain, Protocol: proto}
+	return e.writeResult([]registrationJSON{{newDestinationJSON(dest, cookie), "unregistered", ""}})
 }
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"errors"
 	"testing"
+
+	"github.com/cloudflare/tubular"
 )
 
 func TestUnregister(t *testing.T) {
@@ -87,6 +90,46 @@ func TestUnregisterNoSocket(t *testing.T) {
 	}
 }
 
+func TestUnregisterCookie(t *testing.T) {
+	netns := mustReadyNetNS(t)
+
+	conn := makeListeningSocket(t, netns, "udp4")
+	cookie := mustSocketCookie(t, conn)
+
+	tubectl := tubectlTestCall{
+		NetNS:    netns,
+		ExecNS:   netns,
+		Cmd:      "register",
+		Args:     []string{"svc-label"},
+		Env:      map[string]string{"LISTEN_FDS": "1"},
+		ExtraFds: testFds{conn},
+	}
+	tubectl.MustRun(t)
+
+	tubectl = tubectlTestCall{
+		NetNS:  netns,
+		ExecNS: netns,
+		Cmd:    "unregister",
+		Args:   []string{"-cookie", (cookie + 1).String(), "svc-label", "ipv4", "udp"},
+	}
+	if _, err := tubectl.Run(t); !errors.Is(err, tubular.ErrDestinationMismatch) {
+		t.Fatal("Expected ErrDestinationMismatch, got", err)
+	}
+
+	tubectl.Args = []string{"-cookie", "foo", "svc-label", "ipv4", "udp"}
+	if _, err := tubectl.Run(t); !errors.Is(err, errBadArg) {
+		t.Fatal("Expected errBadArg for invalid cookie, got", err)
+	}
+
+	tubectl.Args = []string{"-cookie", cookie.String(), "svc-label", "ipv4", "udp"}
+	tubectl.MustRun(t)
+
+	dp := mustOpenDispatcher(t, netns)
+	if dests := destinations(t, dp); len(dests) != 0 {
+		t.Fatal("Socket wasn't unregistered:", dests)
+	}
+}
+
 func TestUnregisterArgs(t *testing.T) {
 	for tc, args := range map[string][]string{
 		"too-little": {"svc-label", "ipv4"},
@@ -15,5 +15,10 @@ func version(e *env, args ...string) error {
 	}
 
 	e.stdout.Logf("tubectl version: %s (go runtime %s)\n", Version, runtime.Version())
-	return nil
+	return e.writeResult(versionJSON{Version, runtime.Version()})
+}
+
+type versionJSON struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
 }
@@ -0,0 +1,332 @@
+package tubular
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/cloudflare/tubular/internal"
+)
+
+// Dispatcher manipulates the socket dispatch data plane.
+//
+// Methods which are documented as experimental aren't covered by the
+// compatibility promise.
+type Dispatcher struct {
+	dp *internal.Dispatcher
+}
+
+func newDispatcher(dp *internal.Dispatcher, err error) (*Dispatcher, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &Dispatcher{dp}, nil
+}
+
+// Close frees associated resources.
+//
+// It does not remove the dispatcher, see UnloadDispatcher.
+func (d *Dispatcher) Close() error {
+	return d.dp.Close()
+}
+
+// Path returns the directory which contains the state of the dispatcher.
+//
+// Experimental.
+func (d *Dispatcher) Path() string {
+	return d.dp.Path
+}
+
+// Paused returns true if the dispatcher is detached from the network
+// namespace, see Pause.
+//
+// Experimental.
+func (d *Dispatcher) Paused() (bool, error) {
+	return d.dp.Paused()
+}
+
+// Pause detaches the dispatcher from the network namespace.
+//
+// Traffic is delivered as if the dispatcher wasn't loaded, while bindings
+// and destinations are preserved. Pausing a paused dispatcher is a no-op.
+//
+// Experimental.
+func (d *Dispatcher) Pause() error {
+	return d.dp.Pause()
+}
+
+// Resume attaches a paused dispatcher to the network namespace again.
+//
+// Resuming a dispatcher that isn't paused is a no-op.
+//
+// Experimental.
+func (d *Dispatcher) Resume() error {
+	return d.dp.Resume()
+}
+
+// AddBinding redirects traffic for a given protocol, prefix and port to a
+// label.
+//
+// Traffic for the binding is dropped by the data plane if no matching
+// destination exists. If the binding exists and bind doesn't specify an
+// owner, the existing owner is kept.
+func (d *Dispatcher) AddBinding(bind *Binding) error {
+	return d.dp.AddBinding(bind.internal())
+}
+
+// RemoveBinding stops redirecting traffic for a given protocol, prefix and
+// port.
+//
+// Returns ErrBindingNotFound if the binding doesn't exist, and
+// ErrDestinationMismatch if it exists with a different label.
+func (d *Dispatcher) RemoveBinding(bind *Binding) error {
+	return d.dp.RemoveBinding(bind.internal())
+}
+
+// ReplaceBindings changes the currently active bindings to a new set.
+//
+// It is conceptually identical to repeatedly calling AddBinding and
+// RemoveBinding and therefore not atomic: the function may return without
+// applying all changes. A binding whose owner changes is considered added.
+// Unlike AddBinding, the owner of a binding is removed if it isn't specified.
+//
+// Returns the bindings which were added and removed.
+func (d *Dispatcher) ReplaceBindings(bindings Bindings) (added, removed Bindings, _ error) {
+	a, r, err := d.dp.ReplaceBindings(bindings.internal())
+	return newBindings(a), newBindings(r), err
+}
+
+// ReplaceOwnedBindings changes the bindings owned by owner to a new set.
+//
+// Bindings which belong to a different owner or to no owner at all are left
+// untouched. It's an error to specify a binding which exists but isn't owned
+// by owner. The Owner field of bindings is ignored, all of them are assigned
+// to owner.
+//
+// The same caveats as for ReplaceBindings apply.
+//
+// Experimental.
+func (d *Dispatcher) ReplaceOwnedBindings(owner string, bindings Bindings) (added, removed Bindings, _ error) {
+	a, r, err := d.dp.ReplaceOwnedBindings(owner, bindings.internal())
+	return newBindings(a), newBindings(r), err
+}
+
+// Bindings lists known bindings.
+func (d *Dispatcher) Bindings() (Bindings, error) {
+	bindings, err := d.dp.Bindings()
+	if err != nil {
+		return nil, err
+	}
+	return newBindings(bindings), nil
+}
+
+// RegisterSocket adds a socket with the given label.
+//
+// The socket receives traffic for all Bindings that share the same label,
+// L3 and L4 protocol.
+//
+// Returns the Destination with which the socket was registered, and a boolean
+// indicating whether the Destination was created or updated, or an error.
+func (d *Dispatcher) RegisterSocket(label string, conn syscall.Conn) (dest *Destination, created bool, _ error) {
+	dst, created, err := d.dp.RegisterSocket(label, conn)
+	if err != nil {
+		return nil, false, err
+	}
+	return newDestination(dst), created, nil
+}
+
+// ReplaceSocket registers a socket with the given label, but only if the
+// socket currently registered for the same destination has the cookie old.
+//
+// Returns ErrDestinationMismatch if a different socket or no socket is
+// registered.
+func (d *Dispatcher) ReplaceSocket(label string, conn syscall.Conn, old SocketCookie) (*Destination, error) {
+	dst, err := d.dp.ReplaceSocket(label, conn, internal.SocketCookie(old))
+	if err != nil {
+		return nil, err
+	}
+	return newDestination(dst), nil
+}
+
+// UnregisterSocket removes the socket mapping for the given label, domain and
+// protocol.
+//
+// Returns ErrSocketNotFound if no socket is registered.
+func (d *Dispatcher) UnregisterSocket(label string, domain Domain, proto Protocol) error {
+	return d.dp.UnregisterSocket(label, internal.Domain(domain), internal.Protocol(proto))
+}
+
+// UnregisterSocketCookie removes the socket mapping for the given label,
+// domain and protocol, but only if the registered socket has the given
+// cookie.
+//
+// Returns ErrDestinationMismatch if a different socket is registered.
+func (d *Dispatcher) UnregisterSocketCookie(label string, domain Domain, proto Protocol, cookie SocketCookie) error {
+	return d.dp.UnregisterSocketCookie(label, internal.Domain(domain), internal.Protocol(proto), internal.SocketCookie(cookie))
+}
+
+// Destinations returns a set of existing destinations, i.e. sockets and
+// labels, together with the cookies of registered sockets.
+func (d *Dispatcher) Destinations() ([]Destination, map[Destination]SocketCookie, error) {
+	dests, cookies, err := d.dp.Destinations()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := make([]Destination, 0, len(dests))
+	for i := range dests {
+		result = append(result, *newDestination(&dests[i]))
+	}
+
+	resultCookies := make(map[Destination]SocketCookie, len(cookies))
+	for dest, cookie := range cookies {
+		resultCookies[*newDestination(&dest)] = SocketCookie(cookie)
+	}
+
+	return result, resultCookies, nil
+}
+
+// Metrics returns current counters from the data plane.
+func (d *Dispatcher) Metrics() (*Metrics, error) {
+	metrics, err := d.dp.Metrics()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Metrics{
+		make(map[Destination]DestinationMetrics, len(metrics.Destinations)),
+		make(map[Destination]uint64, len(metrics.Bindings)),
+		make(map[Destination]uint8, len(metrics.Sockets)),
+	}
+	for dest, dm := range metrics.Destinations {
+		result.Destinations[*newDestination(&dest)] = DestinationMetrics(dm)
+	}
+	for dest, n := range metrics.Bindings {
+		result.Bindings[*newDestination(&dest)] = n
+	}
+	for dest, n := range metrics.Sockets {
+		result.Sockets[*newDestination(&dest)] = n
+	}
+
+	return result, nil
+}
+
+// SocketQueues returns the queue usage of all registered sockets.
+//
+// Sockets are queried via sock_diag in the dispatcher's network namespace.
+// Entering the namespace requires CAP_SYS_ADMIN unless the calling thread
+// is already a member.
+//
+// Experimental.
+func (d *Dispatcher) SocketQueues() (map[Destination]SocketQueue, error) {
+	queues, err := d.dp.SocketQueues()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[Destination]SocketQueue, len(queues))
+	for dest, queue := range queues {
+		result[*newDestination(&dest)] = SocketQueue(queue)
+	}
+	return result, nil
+}
+
+// Programs returns the active and the previous dispatcher program.
+//
+// previous is nil if the dispatcher hasn't been upgraded.
+//
+// Experimental.
+func (d *Dispatcher) Programs() (current, previous *LoadedProgram, err error) {
+	cur, prev, err := d.dp.Programs()
+	if err != nil {
+		return nil, nil, err
+	}
+	return newLoadedProgram(cur), newLoadedProgram(prev), nil
+}
+
+// A Destination receives traffic from a Binding.
+//
+// It is implicitly created when registering a socket with a Dispatcher.
+type Destination struct {
+	Label    string
+	Domain   Domain
+	Protocol Protocol
+}
+
+func newDestination(dest *internal.Destination) *Destination {
+	return &Destination{dest.Label, Domain(dest.Domain), Protocol(dest.Protocol)}
+}
+
+func (dest *Destination) internal() *internal.Destination {
+	return &internal.Destination{
+		Label:    dest.Label,
+		Domain:   internal.Domain(dest.Domain),
+		Protocol: internal.Protocol(dest.Protocol),
+	}
+}
+
+func (dest *Destination) String() string {
+	return dest.internal().String()
+}
+
+// Metrics contain counters generated by the data plane.
+type Metrics struct {
+	Destinations map[Destination]DestinationMetrics
+	// The number of bindings which refer to a destination.
+	Bindings map[Destination]uint64
+	// One if a socket is registered for a destination, zero otherwise.
+	Sockets map[Destination]uint8
+}
+
+// DestinationMetrics are counters for a single destination.
+type DestinationMetrics struct {
+	// Total number of times traffic matched a destination.
+	Lookups uint64
+	// Total number of failed lookups since no socket was registered.
+	Misses uint64
+	// Total number of failed lookups since the socket was incompatible
+	// with the incoming traffic.
+	ErrorBadSocket uint64
+}
+
+// TotalErrors sums all errors.
+func (dm *DestinationMetrics) TotalErrors() uint64 {
+	return dm.ErrorBadSocket
+}
+
+// SocketQueue describes the queue usage of a registered socket.
+type SocketQueue struct {
+	// Number of connections waiting to be accepted for TCP, or number of
+	// bytes waiting to be read for UDP.
+	Length uint32
+	// Maximum accept backlog for TCP, or size of the receive buffer in bytes
+	// for UDP.
+	Limit uint32
+	// Number of packets dropped by a UDP socket. Always zero for TCP.
+	Drops uint32
+}
+
+// ProgramID identifies a BPF program in the kernel.
+type ProgramID uint32
+
+// LoadedProgram describes a dispatcher program.
+type LoadedProgram struct {
+	ID  ProgramID
+	Tag string
+	// The version of tubular which loaded the program. Empty if unknown.
+	Version string
+}
+
+func newLoadedProgram(lp *internal.LoadedProgram) *LoadedProgram {
+	if lp == nil {
+		return nil
+	}
+	return &LoadedProgram{ProgramID(lp.ID), lp.Tag, lp.Version}
+}
+
+func (lp *LoadedProgram) String() string {
+	version := lp.Version
+	if version == "" {
+		version = "unknown"
+	}
+	return fmt.Sprintf("#%d (tag %s, version %s)", lp.ID, lp.Tag, version)
+}
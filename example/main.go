@@ -9,9 +9,7 @@ import (
 	"os/signal"
 	"time"
 
-	"github.com/cloudflare/tubular/internal/sysconn"
-
-	"golang.org/x/sys/unix"
+	"github.com/cloudflare/tubular/udp"
 )
 
 func run() error {
@@ -28,38 +26,20 @@ func run() error {
 	}
 	defer tcp6.Close()
 
-	// Set up a udp4 listener and enable IP_RECVORIGDSTADDR on it.
-	udp4, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234})
+	// Set up udp4 and udp6 listeners which know the original destination
+	// of packets.
+	udp4, err := udp.Listen("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234})
 	if err != nil {
 		return err
 	}
 	defer udp4.Close()
 
-	err = sysconn.Control(udp4, func(fd int) error {
-		return unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
-	})
-	if err != nil {
-		return err
-	}
-
-	// Set up a udp6 listener and enable IPV6_RECVORIGDSTADDR, IPV6_FREEBIND on it.
-	udp6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback, Port: 1234})
+	udp6, err := udp.Listen("udp6", &net.UDPAddr{IP: net.IPv6loopback, Port: 1234})
 	if err != nil {
 		return err
 	}
 	defer udp6.Close()
 
-	err = sysconn.Control(udp6, func(fd int) error {
-		err := unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
-		if err != nil {
-			return err
-		}
-		return unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_FREEBIND, 1)
-	})
-	if err != nil {
-		return err
-	}
-
 	// We've bound the listening sockets, notify systemd that the process has
 	// finished start up. This will execute any ExecStartPost commands, which
 	// allows us to run register-pid at the appropriate time.
@@ -105,13 +85,12 @@ func run() error {
 	}
 
 	// UDP support.
-	for _, conn := range []*net.UDPConn{udp4, udp6} {
-		go func(conn *net.UDPConn) {
+	for _, conn := range []*udp.Conn{udp4, udp6} {
+		go func(conn *udp.Conn) {
 			msg := make([]byte, 1024)
-			oob := make([]byte, unix.CmsgSpace(unix.SizeofSockaddrInet6))
 
 			for {
-				n, oobn, _, remote, err := conn.ReadMsgUDP(msg, oob)
+				n, remote, dst, err := conn.ReadFromWithDst(msg)
 				if err != nil {
 					select {
 					case <-ctx.Done():
@@ -122,36 +101,8 @@ func run() error {
 					continue
 				}
 
-				// oob contains socket control messages which we need to parse.
-				scms, err := unix.ParseSocketControlMessage(oob[:oobn])
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "parse control message:", err)
-					continue
-				}
-
-				// retrieve the destination address from the SCM.
-				sa, err := unix.ParseOrigDstAddr(&scms[0])
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "retrieve destination:", err)
-					continue
-				}
-
-				// encode the destination address into a cmsg.
-				var info []byte
-				switch v := sa.(type) {
-				case *unix.SockaddrInet4:
-					info = unix.PktInfo4(&unix.Inet4Pktinfo{
-						Spec_dst: v.Addr,
-					})
-
-				case *unix.SockaddrInet6:
-					info = unix.PktInfo6(&unix.Inet6Pktinfo{
-						Addr: v.Addr,
-					})
-				}
-
 				// reply from the original destination address.
-				_, _, err = conn.WriteMsgUDP(append([]byte("hi "), msg[:n]...), info, remote)
+				_, err = conn.WriteToFromSrc(append([]byte("hi "), msg[:n]...), remote, dst)
 				if err != nil {
 					select {
 					case <-ctx.Done():
@@ -0,0 +1,171 @@
+package tubular_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/tubular"
+)
+
+// Steer traffic for 127.0.0.0/8 on port 80 to a listening socket.
+func Example() {
+	dp, err := tubular.OpenDispatcher("/proc/self/ns/net", "/sys/fs/bpf", false)
+	if errors.Is(err, tubular.ErrNotLoaded) {
+		fmt.Println("Load the dispatcher using tubectl load")
+		return
+	} else if err != nil {
+		panic(err)
+	}
+	defer dp.Close()
+
+	bind, err := tubular.NewBinding("http", tubular.TCP, "127.0.0.0/8", 80)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := dp.AddBinding(bind); err != nil {
+		panic(err)
+	}
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer ln.Close()
+
+	dest, created, err := dp.RegisterSocket("http", ln.(*net.TCPListener))
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println("Registered", dest, "created:", created)
+}
+
+func ExampleDispatcher_RegisterSocket() {
+	dp, err := tubular.OpenDispatcher("/proc/self/ns/net", "/sys/fs/bpf", false)
+	if err != nil {
+		panic(err)
+	}
+	defer dp.Close()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	_, _, err = dp.RegisterSocket("dns", conn.(*net.UDPConn))
+	if errors.Is(err, tubular.ErrBadSocketState) {
+		fmt.Println("UDP sockets must not be connected")
+	} else if err != nil {
+		panic(err)
+	}
+}
+
+func ExampleDispatcher_ReplaceBindings() {
+	dp, err := tubular.OpenDispatcher("/proc/self/ns/net", "/sys/fs/bpf", false)
+	if err != nil {
+		panic(err)
+	}
+	defer dp.Close()
+
+	var bindings tubular.Bindings
+	for _, proto := range []tubular.Protocol{tubular.TCP, tubular.UDP} {
+		bind, err := tubular.NewBinding("dns", proto, "2001:db8::/64", 53)
+		if err != nil {
+			panic(err)
+		}
+		bindings = append(bindings, bind)
+	}
+
+	added, removed, err := dp.ReplaceBindings(bindings)
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println("Added", added)
+	fmt.Println("Removed", removed)
+}
+
+func ExampleDispatcher_Metrics() {
+	dp, err := tubular.OpenDispatcher("/proc/self/ns/net", "/sys/fs/bpf", true)
+	if err != nil {
+		panic(err)
+	}
+	defer dp.Close()
+
+	metrics, err := dp.Metrics()
+	if err != nil {
+		panic(err)
+	}
+
+	for dest, counters := range metrics.Destinations {
+		fmt.Printf("%s: %d lookups, %d misses, %d errors\n",
+			&dest, counters.Lookups, counters.Misses, counters.TotalErrors())
+	}
+}
+
+func ExampleRegisterSocketWithServer() {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		panic(err)
+	}
+	defer ln.Close()
+
+	dest, cookie, err := tubular.RegisterSocketWithServer("/run/tubular-register.sock", "http", ln.(*net.TCPListener))
+	if errors.Is(err, os.ErrPermission) {
+		fmt.Println("Not allowed to register sockets for label http")
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	fmt.Println("Registered", cookie, "as", dest)
+}
+
+// Restart an HTTP server without dropping connections.
+func ExampleTakeover() {
+	ln, err := net.Listen("tcp4", "127.0.0.1:8080")
+	if err != nil {
+		panic(err)
+	}
+
+	dp, err := tubular.OpenDispatcher("/proc/self/ns/net", "/sys/fs/bpf", false)
+	if err != nil {
+		panic(err)
+	}
+
+	// Replace the socket of the previous instance, which is then asked to
+	// stop via SIGTERM.
+	previous, err := tubular.Takeover(dp, "/run/http.pid", "http", ln.(*net.TCPListener))
+	dp.Close()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Took over from pid", previous)
+
+	srv := &http.Server{}
+	go srv.Serve(ln)
+
+	// Stop once the next instance has taken over.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	<-sigs
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Accept connections which are still queued before closing the socket.
+	if err := tubular.WaitDrained(ctx, ln.(*net.TCPListener), 100*time.Millisecond); err != nil {
+		fmt.Println("Socket wasn't drained:", err)
+	}
+
+	srv.Shutdown(ctx)
+}
@@ -16,6 +16,9 @@ type Binding struct {
 	Protocol Protocol
 	Prefix   netaddr.IPPrefix
 	Port     uint16
+	// Owner is an optional identifier of whoever manages the binding,
+	// see Dispatcher.ReplaceOwnedBindings.
+	Owner string
 }
 
 // NewBinding creates a new binding.
@@ -33,6 +36,7 @@ func NewBinding(label string, proto Protocol, prefix string, port uint16) (*Bind
 		proto,
 		netaddr.IPPrefixFrom(cidr.IP(), cidr.Bits()).Masked(),
 		port,
+		"",
 	}, nil
 }
 
@@ -52,6 +56,7 @@ func newBindingFromBPF(label string, key *bindingKey) *Binding {
 		key.Protocol,
 		prefix.Masked(),
 		key.Port,
+		"",
 	}
 }
 
@@ -0,0 +1,151 @@
+// Package cgroup finds the processes of a cgroup v2 or systemd unit.
+package cgroup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Root is where the unified cgroup hierarchy is usually mounted.
+const Root = "/sys/fs/cgroup"
+
+// unitTypes are the suffixes of systemd units which have a cgroup.
+var unitTypes = []string{".service", ".scope", ".slice", ".socket", ".mount", ".swap"}
+
+// Resolve returns the path of a cgroup below root.
+//
+// name is either the path of a cgroup, relative to root or including it,
+// or the name of a systemd unit. Units without a suffix are assumed to be
+// services, like systemctl does.
+func Resolve(root, name string) (string, error) {
+	var path string
+	switch {
+	case name == "":
+		return "", fmt.Errorf("empty cgroup")
+
+	case name == root || strings.HasPrefix(name, root+"/"):
+		path = filepath.Clean(name)
+
+	case strings.ContainsRune(name, '/'):
+		path = filepath.Join(root, name)
+
+	default:
+		var err error
+		path, err = findUnit(root, name)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(path, "cgroup.procs")); err != nil {
+		return "", fmt.Errorf("%s: not a cgroup: %w", path, err)
+	}
+
+	return path, nil
+}
+
+func findUnit(root, unit string) (string, error) {
+	hasType := false
+	for _, suffix := range unitTypes {
+		hasType = hasType || strings.HasSuffix(unit, suffix)
+	}
+	if !hasType {
+		unit += ".service"
+	}
+
+	var matches []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path != root && errors.Is(err, fs.ErrPermission) {
+				return fs.SkipDir
+			}
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		if d.Name() == unit {
+			matches = append(matches, path)
+			return fs.SkipDir
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("find unit %s: %w", unit, err)
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("unit %s: no cgroup found in %s: %w", unit, root, os.ErrNotExist)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("unit %s: found multiple cgroups, specify one of %s", unit, strings.Join(matches, ", "))
+	}
+}
+
+// PIDs returns the processes in a cgroup and its descendants.
+//
+// The result is sorted in ascending order.
+func PIDs(path string) ([]int, error) {
+	seen := make(map[int]bool)
+	err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			// The cgroup was removed while walking the tree.
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if d.IsDir() || d.Name() != "cgroup.procs" {
+			return nil
+		}
+
+		return readProcs(path, seen)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pids := make([]int, 0, len(seen))
+	for pid := range seen {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+func readProcs(path string, pids map[int]bool) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// The cgroup was removed.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		pid, err := strconv.Atoi(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s: invalid pid %q", path, scanner.Text())
+		}
+		pids[pid] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResolve(t *testing.T) {
+	root := t.TempDir()
+	mustCgroup(t, root, "user.slice")
+	mustCgroup(t, root, "system.slice/foo.service")
+	mustCgroup(t, root, "system.slice/bar.service")
+	mustCgroup(t, root, "user.slice/user-1000.slice/bar.service")
+	mustCgroup(t, root, "system.slice/baz.scope")
+
+	for _, test := range []struct {
+		name, path string
+	}{
+		{"foo", "system.slice/foo.service"},
+		{"foo.service", "system.slice/foo.service"},
+		{"baz.scope", "system.slice/baz.scope"},
+		{"system.slice/bar.service", "system.slice/bar.service"},
+		{"/system.slice/bar.service", "system.slice/bar.service"},
+		{filepath.Join(root, "user.slice"), "user.slice"},
+	} {
+		path, err := Resolve(root, test.name)
+		if err != nil {
+			t.Errorf("Resolve(%q): %s", test.name, err)
+			continue
+		}
+
+		if want := filepath.Join(root, test.path); path != want {
+			t.Errorf("Resolve(%q) returned %s instead of %s", test.name, path, want)
+		}
+	}
+
+	for _, name := range []string{"", "bar", "missing", "system.slice/missing.service"} {
+		if _, err := Resolve(root, name); err == nil {
+			t.Errorf("Resolve(%q) doesn't return an error", name)
+		}
+	}
+}
+
+func TestPIDs(t *testing.T) {
+	root := t.TempDir()
+	mustCgroup(t, root, "foo.service", "1", "2")
+	mustCgroup(t, root, "foo.service/child", "3", "1")
+	mustCgroup(t, root, "bar.service", "4")
+
+	pids, err := PIDs(filepath.Join(root, "foo.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]int{1, 2, 3}, pids); diff != "" {
+		t.Errorf("PIDs don't match (-want +got):\n%s", diff)
+	}
+}
+
+func mustCgroup(tb testing.TB, root, path string, pids ...string) {
+	tb.Helper()
+
+	dir := filepath.Join(root, path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		tb.Fatal(err)
+	}
+
+	var procs []byte
+	for _, pid := range pids {
+		procs = append(procs, pid+"\n"...)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.procs"), procs, 0644); err != nil {
+		tb.Fatal(err)
+	}
+}
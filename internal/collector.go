@@ -18,6 +18,11 @@ type Collector struct {
 	errors             *prometheus.Desc
 	bindings           *prometheus.Desc
 	destinationSockets *prometheus.Desc
+	acceptQueueLength  *prometheus.Desc
+	acceptQueueBacklog *prometheus.Desc
+	receiveQueueBytes  *prometheus.Desc
+	receiveBufferBytes *prometheus.Desc
+	socketDrops        *prometheus.Desc
 }
 
 var _ prometheus.Collector = (*Collector)(nil)
@@ -61,6 +66,36 @@ func NewCollector(logger log.Logger, netnsPath, bpfFsPath string) *Collector {
 			[]string{"label", "domain", "protocol"},
 			nil,
 		),
+		prometheus.NewDesc(
+			"destination_accept_queue_length",
+			"The number of connections waiting to be accepted by a TCP destination.",
+			[]string{"label", "domain", "protocol"},
+			nil,
+		),
+		prometheus.NewDesc(
+			"destination_accept_queue_backlog",
+			"The maximum number of connections waiting to be accepted by a TCP destination.",
+			[]string{"label", "domain", "protocol"},
+			nil,
+		),
+		prometheus.NewDesc(
+			"destination_receive_queue_bytes",
+			"The number of bytes waiting to be read from a UDP destination.",
+			[]string{"label", "domain", "protocol"},
+			nil,
+		),
+		prometheus.NewDesc(
+			"destination_receive_buffer_bytes",
+			"The size of the receive buffer of a UDP destination.",
+			[]string{"label", "domain", "protocol"},
+			nil,
+		),
+		prometheus.NewDesc(
+			"destination_socket_drops_total",
+			"Total number of packets dropped by the socket of a UDP destination.",
+			[]string{"label", "domain", "protocol"},
+			nil,
+		),
 	}
 }
 
@@ -72,6 +107,11 @@ func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.errors
 	ch <- c.bindings
 	ch <- c.destinationSockets
+	ch <- c.acceptQueueLength
+	ch <- c.acceptQueueBacklog
+	ch <- c.receiveQueueBytes
+	ch <- c.receiveBufferBytes
+	ch <- c.socketDrops
 }
 
 // Collect implements prometheus.Collector.
@@ -79,7 +119,7 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 	// Collect last, so that errors during this collection are reflected.
 	defer c.collectionErrors.Collect(ch)
 
-	metrics, err := c.metrics()
+	metrics, queues, err := c.metrics()
 	if err != nil {
 		c.logger.Log("Failed to collect metrics:", err)
 		c.collectionErrors.Inc()
@@ -144,14 +184,73 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 			commonLabels...,
 		)
 	}
+
+	for dest, queue := range queues {
+		commonLabels := []string{
+			dest.Label,
+			dest.Domain.String(),
+			dest.Protocol.String(),
+		}
+
+		if dest.Protocol == TCP {
+			ch <- prometheus.MustNewConstMetric(
+				c.acceptQueueLength,
+				prometheus.GaugeValue,
+				float64(queue.Length),
+				commonLabels...,
+			)
+
+			ch <- prometheus.MustNewConstMetric(
+				c.acceptQueueBacklog,
+				prometheus.GaugeValue,
+				float64(queue.Limit),
+				commonLabels...,
+			)
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			c.receiveQueueBytes,
+			prometheus.GaugeValue,
+			float64(queue.Length),
+			commonLabels...,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			c.receiveBufferBytes,
+			prometheus.GaugeValue,
+			float64(queue.Limit),
+			commonLabels...,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			c.socketDrops,
+			prometheus.CounterValue,
+			float64(queue.Drops),
+			commonLabels...,
+		)
+	}
 }
 
-func (c *Collector) metrics() (*Metrics, error) {
+func (c *Collector) metrics() (*Metrics, map[Destination]SocketQueue, error) {
 	dp, err := OpenDispatcher(c.netnsPath, c.bpffsPath, true)
 	if err != nil {
-		return nil, fmt.Errorf("open dispatcher: %s", err)
+		return nil, nil, fmt.Errorf("open dispatcher: %s", err)
 	}
 	defer dp.Close()
 
-	return dp.Metrics()
+	metrics, err := dp.Metrics()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Socket queues are best effort, since querying them may require
+	// additional privileges. Failures aren't counted as collection errors,
+	// otherwise an unprivileged collector would report one on every scrape.
+	queues, err := dp.SocketQueues()
+	if err != nil {
+		c.logger.Log("Failed to collect socket queues:", err)
+	}
+
+	return metrics, queues, nil
 }
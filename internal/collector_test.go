@@ -2,14 +2,17 @@ package internal
 
 import (
 	"net"
+	"strings"
 	"testing"
 
 	"github.com/cloudflare/tubular/internal/log"
 	"github.com/cloudflare/tubular/internal/testutil"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/prometheus/client_golang/prometheus"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
 )
 
 func TestCollector(t *testing.T) {
@@ -20,6 +23,11 @@ func TestCollector(t *testing.T) {
 	mustAddBinding(t, dp, mustNewBinding(t, "bar", UDP, "127.0.0.1", 443))
 	dp.Close()
 
+	// Socket queues are collected from a different netns, which requires
+	// CAP_SYS_ADMIN. Collection happens on goroutines spawned by the
+	// registry, so the whole process needs the capability.
+	mustRaiseEffectiveCaps(t, cap.SYS_ADMIN)
+
 	c := NewCollector(log.Discard, netns.Path(), "/sys/fs/bpf")
 	reg := prometheus.NewPedanticRegistry()
 
@@ -40,6 +48,11 @@ func TestCollector(t *testing.T) {
 	testutil.ConnectSocket(t, conn)
 	dp.Close()
 
+	// The size of the receive buffer depends on the system configuration.
+	ignoreBuffer := cmpopts.IgnoreMapEntries(func(key string, _ float64) bool {
+		return strings.HasPrefix(key, "destination_receive_buffer_bytes")
+	})
+
 	t.Run("misses", func(t *testing.T) {
 		for i := float64(0); i < 2; i++ {
 			testutil.CanDial(t, netns, "tcp6", "[::1]:8080")
@@ -56,9 +69,11 @@ func TestCollector(t *testing.T) {
 				`bindings{domain="ipv6", label="foo", protocol="tcp"}`:                          1,
 				`destination_has_socket{domain="ipv4", label="bar", protocol="udp"}`:            1,
 				`destination_has_socket{domain="ipv6", label="foo", protocol="tcp"}`:            0,
+				`destination_receive_queue_bytes{domain="ipv4", label="bar", protocol="udp"}`:   0,
+				`destination_socket_drops_total{domain="ipv4", label="bar", protocol="udp"}`:    0,
 			}
 
-			if diff := cmp.Diff(want, testutil.FlattenMetrics(t, reg)); diff != "" {
+			if diff := cmp.Diff(want, testutil.FlattenMetrics(t, reg), ignoreBuffer); diff != "" {
 				t.Errorf("Metrics don't match (-want +got):\n%s", diff)
 			}
 		}
@@ -80,9 +95,11 @@ func TestCollector(t *testing.T) {
 				`bindings{domain="ipv6", label="foo", protocol="tcp"}`:                          1,
 				`destination_has_socket{domain="ipv4", label="bar", protocol="udp"}`:            1,
 				`destination_has_socket{domain="ipv6", label="foo", protocol="tcp"}`:            0,
+				`destination_receive_queue_bytes{domain="ipv4", label="bar", protocol="udp"}`:   0,
+				`destination_socket_drops_total{domain="ipv4", label="bar", protocol="udp"}`:    0,
 			}
 
-			if diff := cmp.Diff(want, testutil.FlattenMetrics(t, reg)); diff != "" {
+			if diff := cmp.Diff(want, testutil.FlattenMetrics(t, reg), ignoreBuffer); diff != "" {
 				t.Errorf("Metrics don't match (-want +got):\n%s", diff)
 			}
 		}
@@ -105,3 +122,17 @@ func TestLintCollector(t *testing.T) {
 		t.Errorf("%s: %s", lint.Metric, lint.Text)
 	}
 }
+
+func mustRaiseEffectiveCaps(tb testing.TB, caps ...cap.Value) {
+	tb.Helper()
+
+	if err := testutil.ChangeEffectiveCaps(append(caps, cap.DAC_OVERRIDE)...); err != nil {
+		tb.Fatal("Can't raise capabilities:", err)
+	}
+
+	tb.Cleanup(func() {
+		if err := testutil.ChangeEffectiveCaps(cap.DAC_OVERRIDE); err != nil {
+			tb.Error("Can't drop capabilities:", err)
+		}
+	})
+}
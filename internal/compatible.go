@@ -1,12 +1,38 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
+	"os"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
 )
 
+func isPinnedLinkCompatible(pinPath string, spec *ebpf.CollectionSpec) error {
+	var progs dispatcherProgramSpecs
+	if err := spec.Assign(&progs); err != nil {
+		return err
+	}
+
+	prog, err := ebpf.LoadPinnedProgram(programPath(pinPath), nil)
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+
+	link, err := link.LoadPinnedLink(linkPath(pinPath), nil)
+	if errors.Is(err, os.ErrNotExist) {
+		// The dispatcher is paused, there is no link to compare against.
+		return isProgramCompatible(prog, progs.Dispatcher)
+	} else if err != nil {
+		return err
+	}
+	defer link.Close()
+
+	return isLinkCompatible(link, prog, progs.Dispatcher)
+}
+
 func isLinkCompatible(link link.Link, prog *ebpf.Program, spec *ebpf.ProgramSpec) error {
 	linkInfo, err := link.Info()
 	if err != nil {
@@ -16,23 +42,33 @@ func isLinkCompatible(link link.Link, prog *ebpf.Program, spec *ebpf.ProgramSpec
 	// We could retrieve prog via linkInfo.Program, but that requires more
 	// privileges than reading a pinned program. So we have the caller pass in
 	// the pinned program and compare the IDs to make sure we have the correct one.
-	progInfo, err := prog.Info()
+	progID, err := programID(prog)
 	if err != nil {
 		return fmt.Errorf("get dispatcher program info: %s", err)
 	}
 
-	progID, _ := progInfo.ID()
 	if progID != linkInfo.Program {
-		return fmt.Errorf("program id %v doesn't match link %v", progID, linkInfo.Program)
+		return fmt.Errorf("program id %v doesn't match link %v: %w", progID, linkInfo.Program, ErrIncompatibleProgram)
+	}
+
+	return isProgramCompatible(prog, spec)
+}
+
+func isProgramCompatible(prog *ebpf.Program, spec *ebpf.ProgramSpec) error {
+	progInfo, err := prog.Info()
+	if err != nil {
+		return fmt.Errorf("get dispatcher program info: %s", err)
 	}
 
+	progID, _ := progInfo.ID()
+
 	tag, err := spec.Tag()
 	if err != nil {
 		return fmt.Errorf("calculate dispatcher tag: %s", err)
 	}
 
 	if tag != progInfo.Tag {
-		return fmt.Errorf("loaded program #%d has differing tag: %q doesn't match %q", progID, progInfo.Tag, tag)
+		return fmt.Errorf("loaded program #%d has differing tag: %q doesn't match %q: %w", progID, progInfo.Tag, tag, ErrIncompatibleProgram)
 	}
 
 	return nil
@@ -172,6 +172,13 @@ func newDestinationFromConn(label string, conn syscall.Conn) (*Destination, erro
 	return dest, nil
 }
 
+// NewDestination returns the destination which RegisterSocket uses for conn.
+//
+// Returns the same errors as RegisterSocket if the socket isn't supported.
+func NewDestination(label string, conn syscall.Conn) (*Destination, error) {
+	return newDestinationFromConn(label, conn)
+}
+
 func (dest *Destination) String() string {
 	return fmt.Sprintf("%s:%s:%s", dest.Domain, dest.Protocol, dest.Label)
 }
@@ -255,6 +262,30 @@ func (dests *destinations) RemoveSocket(dest *Destination) error {
 	return nil
 }
 
+// Socket returns the cookie of the socket registered for dest, or zero if
+// there is none.
+func (dests *destinations) Socket(dest *Destination) (SocketCookie, error) {
+	key, err := newDestinationKey(dest)
+	if err != nil {
+		return 0, err
+	}
+
+	var alloc destinationAlloc
+	err = dests.allocs.Lookup(key, &alloc)
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var cookie SocketCookie
+	err = dests.sockets.Lookup(alloc.ID, &cookie)
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return 0, nil
+	}
+	return cookie, err
+}
+
 func (dests *destinations) HasID(dest *Destination, want destinationID) bool {
 	key, err := newDestinationKey(dest)
 	if err != nil {
@@ -281,7 +312,7 @@ func (dests *destinations) Acquire(dest *Destination) (destinationID, error) {
 
 	alloc, err := dests.getAllocation(key)
 	if err != nil {
-		return 0, fmt.Errorf("get allocation for %v: %s", key, err)
+		return 0, fmt.Errorf("get allocation for %v: %w", key, err)
 	}
 
 	alloc.Count++
@@ -344,7 +375,7 @@ func (dests *destinations) getAllocation(key *destinationKey) (*destinationAlloc
 
 			id = allocatedID + 1
 			if id == 0 || id >= dests.maxID {
-				return nil, fmt.Errorf("allocate destination: ran out of ids")
+				return nil, fmt.Errorf("allocate destination: %w", ErrOutOfDestinationIDs)
 			}
 		}
 	}
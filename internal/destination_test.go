@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"errors"
 	"net"
 	"syscall"
 	"testing"
@@ -105,6 +106,16 @@ func TestDestinationIDAllocation(t *testing.T) {
 		checkDestinations(t, dests, baz, bingo, quux, frood)
 	})
 
+	t.Run("out of ids", func(t *testing.T) {
+		dests := mustNewDestinations(t)
+		dests.maxID = 1
+		acquire(t, dests, foo, 0)
+
+		if _, err := dests.Acquire(bar); !errors.Is(err, ErrOutOfDestinationIDs) {
+			t.Error("Expected ErrOutOfDestinationIDs, got", err)
+		}
+	})
+
 	t.Run("release by id", func(t *testing.T) {
 		dests := mustNewDestinations(t)
 		acquire(t, dests, foo, 0)
@@ -9,27 +9,38 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
+	"github.com/containernetworking/plugins/pkg/ns"
 	"golang.org/x/sys/unix"
 	"kernel.org/pub/linux/libs/security/libcap/cap"
 
 	"github.com/cloudflare/tubular/internal/lock"
+	"github.com/cloudflare/tubular/internal/sockdiag"
 )
 
 //go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc "$CLANG" -strip "$STRIP" -makebase "$MAKEDIR" dispatcher ../ebpf/inet-kern.c -- -mcpu=v2 -nostdinc -Wall -Werror -I../ebpf/include
 
 // Errors returned by the Dispatcher.
 var (
-	ErrLoaded            = errors.New("dispatcher already loaded")
-	ErrNotLoaded         = errors.New("dispatcher not loaded")
-	ErrNotSocket         = syscall.ENOTSOCK
-	ErrBadSocketDomain   = syscall.EPFNOSUPPORT
-	ErrBadSocketType     = syscall.ESOCKTNOSUPPORT
-	ErrBadSocketProtocol = syscall.EPROTONOSUPPORT
-	ErrBadSocketState    = syscall.EBADFD
+	ErrLoaded              = errors.New("dispatcher already loaded")
+	ErrNotLoaded           = errors.New("dispatcher not loaded")
+	ErrNotSocket           = syscall.ENOTSOCK
+	ErrBadSocketDomain     = syscall.EPFNOSUPPORT
+	ErrBadSocketType       = syscall.ESOCKTNOSUPPORT
+	ErrBadSocketProtocol   = syscall.EPROTONOSUPPORT
+	ErrBadSocketState      = syscall.EBADFD
+	ErrDestinationMismatch = errors.New("destination refers to a different socket")
+	ErrBindingNotFound     = errors.New("binding not found")
+	ErrBindingConflict     = errors.New("binding conflicts with an existing binding")
+	ErrSocketNotFound      = errors.New("no socket registered")
+	ErrOutOfDestinationIDs = errors.New("out of destination IDs")
+	ErrIncompatibleProgram = errors.New("incompatible dispatcher program")
+	ErrVerificationFailed  = errors.New("programs steer traffic differently")
 )
 
 // CreateCapabilities are required to create a new dispatcher.
@@ -39,14 +50,17 @@ var CreateCapabilities = []cap.Value{cap.SYS_ADMIN, cap.NET_ADMIN}
 type Dispatcher struct {
 	stateDir     *lock.File
 	Path         string
+	netnsPath    string
 	bindings     *ebpf.Map
 	destinations *destinations
 }
 
 // CreateDispatcher loads the dispatcher into a network namespace.
 //
+// version is recorded alongside the program, see Dispatcher.Programs.
+//
 // Returns ErrLoaded if the namespace already has the dispatcher enabled.
-func CreateDispatcher(netnsPath, bpfFsPath string) (_ *Dispatcher, err error) {
+func CreateDispatcher(netnsPath, bpfFsPath, version string) (_ *Dispatcher, err error) {
 	closeOnError := func(c io.Closer) {
 		if err != nil {
 			c.Close()
@@ -61,7 +75,7 @@ func CreateDispatcher(netnsPath, bpfFsPath string) (_ *Dispatcher, err error) {
 
 	tempDir, err := ioutil.TempDir(filepath.Dir(pinPath), "tubular-*")
 	if err != nil {
-		return nil, fmt.Errorf("can't create temp directory: %s", err)
+		return nil, fmt.Errorf("can't create temp directory: %w", err)
 	}
 	defer os.RemoveAll(tempDir)
 
@@ -85,6 +99,10 @@ func CreateDispatcher(netnsPath, bpfFsPath string) (_ *Dispatcher, err error) {
 		return nil, fmt.Errorf("pin program: %s", err)
 	}
 
+	if err := recordProgramVersion(tempDir, objs.Dispatcher, version); err != nil {
+		return nil, err
+	}
+
 	// The dispatcher is active after this call.
 	link, err := link.AttachNetNs(int(netns.Fd()), objs.Dispatcher)
 	if err != nil {
@@ -96,6 +114,10 @@ func CreateDispatcher(netnsPath, bpfFsPath string) (_ *Dispatcher, err error) {
 		return nil, fmt.Errorf("can't pin link: %s", err)
 	}
 
+	if err := createBindingOwners(tempDir, objs.Bindings.MaxEntries()); err != nil {
+		return nil, err
+	}
+
 	if err := adjustPermissions(tempDir); err != nil {
 		return nil, fmt.Errorf("adjust permissions: %s", err)
 	}
@@ -110,7 +132,7 @@ func CreateDispatcher(netnsPath, bpfFsPath string) (_ *Dispatcher, err error) {
 	}
 
 	dests := newDestinations(objs.dispatcherMaps)
-	return &Dispatcher{dir, pinPath, objs.Bindings, dests}, nil
+	return &Dispatcher{dir, pinPath, netnsPath, objs.Bindings, dests}, nil
 }
 
 func adjustPermissions(path string) error {
@@ -170,7 +192,7 @@ func OpenDispatcher(netnsPath, bpfFsPath string, readOnly bool) (_ *Dispatcher,
 	if os.IsNotExist(err) {
 		return nil, fmt.Errorf("%s: %w", bpfFsPath, ErrNotLoaded)
 	} else if err != nil {
-		return nil, fmt.Errorf("%s: %s", bpfFsPath, err)
+		return nil, fmt.Errorf("%s: %w", bpfFsPath, err)
 	}
 	defer closeOnError(dir)
 
@@ -186,30 +208,20 @@ func OpenDispatcher(netnsPath, bpfFsPath string, readOnly bool) (_ *Dispatcher,
 		// prevent incompatible modification to dispatcher state. Since this
 		// isn't possible in read-only mode skipping the check is acceptable.
 		// See https://lore.kernel.org/bpf/20210326160501.46234-1-lmb@cloudflare.com/#t
-		var progs dispatcherProgramSpecs
-		if err := spec.Assign(&progs); err != nil {
-			return nil, err
-		}
-
-		link, err := link.LoadPinnedLink(linkPath(pinPath), nil)
-		if err != nil {
-			return nil, err
-		}
-		defer link.Close()
-
-		prog, err := ebpf.LoadPinnedProgram(programPath(pinPath), nil)
-		if err != nil {
-			return nil, err
-		}
-		defer prog.Close()
-
-		if err := isLinkCompatible(link, prog, progs.Dispatcher); err != nil {
+		if err := isPinnedLinkCompatible(pinPath, spec); err != nil {
 			return nil, err
 		}
 	}
 
+	return newDispatcher(dir, pinPath, netnsPath, spec, readOnly)
+}
+
+// newDispatcher loads the maps of a dispatcher.
+//
+// The function takes ownership of dir if it succeeds.
+func newDispatcher(dir *lock.File, pinPath, netnsPath string, spec *ebpf.CollectionSpec, readOnly bool) (*Dispatcher, error) {
 	var maps dispatcherMaps
-	err = spec.LoadAndAssign(&maps, &ebpf.CollectionOptions{
+	err := spec.LoadAndAssign(&maps, &ebpf.CollectionOptions{
 		Maps: ebpf.MapOptions{
 			PinPath: pinPath,
 			LoadPinOptions: ebpf.LoadPinOptions{
@@ -218,12 +230,38 @@ func OpenDispatcher(netnsPath, bpfFsPath string, readOnly bool) (_ *Dispatcher,
 		},
 	})
 	if err != nil {
-		return nil, fmt.Errorf("load BPF: %s", err)
+		return nil, fmt.Errorf("load BPF: %w", err)
 	}
-	defer closeOnError(&maps)
 
 	dests := newDestinations(maps)
-	return &Dispatcher{dir, pinPath, maps.Bindings, dests}, nil
+	return &Dispatcher{dir, pinPath, netnsPath, maps.Bindings, dests}, nil
+}
+
+// CheckDispatcher verifies that the dispatcher loaded into a namespace is
+// compatible with this version of the package.
+//
+// Returns ErrNotLoaded if the dispatcher is not loaded yet.
+func CheckDispatcher(netnsPath, bpfFsPath string) error {
+	netns, pinPath, err := openNetNS(netnsPath, bpfFsPath)
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+
+	dir, err := lock.OpenLockedShared(pinPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: %w", bpfFsPath, ErrNotLoaded)
+	} else if err != nil {
+		return fmt.Errorf("%s: %w", bpfFsPath, err)
+	}
+	defer dir.Close()
+
+	spec, err := loadPatchedDispatcher(nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return isPinnedLinkCompatible(pinPath, spec)
 }
 
 func loadPatchedDispatcher(to interface{}, opts *ebpf.CollectionOptions) (*ebpf.CollectionSpec, error) {
@@ -259,14 +297,48 @@ func loadPatchedDispatcher(to interface{}, opts *ebpf.CollectionOptions) (*ebpf.
 
 // UpgradeDispatcher updates the datapath program for the given dispatcher.
 //
-// It doesn't remove old unused state.
+// It doesn't remove old unused state. The replaced program is kept around
+// so that the upgrade can be reverted via RollbackDispatcher. version is
+// recorded alongside the new program.
 //
 // Returns the program ID of the new dispatcher or an error.
-func UpgradeDispatcher(netnsPath, bpfFsPath string) (ebpf.ProgramID, error) {
-	return upgradeDispatcher(netnsPath, bpfFsPath, (*link.NetNsLink).Update)
+func UpgradeDispatcher(netnsPath, bpfFsPath, version string) (ebpf.ProgramID, error) {
+	return upgradeDispatcher(netnsPath, bpfFsPath, version, nil, (*link.NetNsLink).Update)
 }
 
-func upgradeDispatcher(netnsPath, bpfFsPath string, linkUpdate func(*link.NetNsLink, *ebpf.Program) error) (ebpf.ProgramID, error) {
+// UpgradeDispatcherVerified is like UpgradeDispatcher, but refuses to upgrade
+// if the new program steers traffic differently than the current one.
+//
+// Traffic is simulated by running both programs against the lookups in
+// corpus via BPF_PROG_TEST_RUN, which requires at least Linux 5.14. If corpus
+// is nil, lookups are derived from the bindings. Simulated lookups are
+// included in the metrics of a destination.
+func UpgradeDispatcherVerified(netnsPath, bpfFsPath, version string, corpus []Lookup) (ebpf.ProgramID, error) {
+	verify := func(pinPath string, objs *dispatcherObjects) error {
+		return verifyUpgrade(pinPath, objs, corpus)
+	}
+	return upgradeDispatcher(netnsPath, bpfFsPath, version, verify, (*link.NetNsLink).Update)
+}
+
+func verifyUpgrade(pinPath string, objs *dispatcherObjects, corpus []Lookup) error {
+	if corpus == nil {
+		var err error
+		corpus, err = lookupCorpus(objs.Bindings)
+		if err != nil {
+			return err
+		}
+	}
+
+	current, err := ebpf.LoadPinnedProgram(programPath(pinPath), nil)
+	if err != nil {
+		return fmt.Errorf("load current program: %s", err)
+	}
+	defer current.Close()
+
+	return verifyPrograms(current, objs.Dispatcher, corpus)
+}
+
+func upgradeDispatcher(netnsPath, bpfFsPath, version string, verify func(string, *dispatcherObjects) error, linkUpdate func(*link.NetNsLink, *ebpf.Program) error) (ebpf.ProgramID, error) {
 	netns, pinPath, err := openNetNS(netnsPath, bpfFsPath)
 	if err != nil {
 		return 0, err
@@ -275,7 +347,7 @@ func upgradeDispatcher(netnsPath, bpfFsPath string, linkUpdate func(*link.NetNsL
 
 	dir, err := lock.OpenLockedExclusive(pinPath)
 	if err != nil {
-		return 0, fmt.Errorf("%s: %s", bpfFsPath, err)
+		return 0, fmt.Errorf("%s: %w", bpfFsPath, err)
 	}
 	defer dir.Close()
 
@@ -296,11 +368,20 @@ func upgradeDispatcher(netnsPath, bpfFsPath string, linkUpdate func(*link.NetNsL
 	}
 	progID, _ := progInfo.ID()
 
-	nslink, err := link.LoadPinnedLink(linkPath(pinPath), nil)
+	if verify != nil {
+		if err := verify(pinPath, &objs); err != nil {
+			return 0, fmt.Errorf("verify upgrade: %w", err)
+		}
+	}
+
+	// nslink is nil if the dispatcher is paused.
+	nslink, err := loadPinnedNetNsLink(pinPath)
 	if err != nil {
 		return 0, err
 	}
-	defer nslink.Close()
+	if nslink != nil {
+		defer nslink.Close()
+	}
 
 	progPath := programPath(pinPath)
 	tmpPath := programUpgradePath(pinPath)
@@ -310,6 +391,15 @@ func upgradeDispatcher(netnsPath, bpfFsPath string, linkUpdate func(*link.NetNsL
 	// Remove the temporary program pin if the update fails.
 	defer os.Remove(tmpPath)
 
+	if err := recordProgramVersion(pinPath, objs.Dispatcher, version); err != nil {
+		return 0, err
+	}
+
+	// Dispatchers created by older versions lack the owner map.
+	if err := createBindingOwners(pinPath, objs.Bindings.MaxEntries()); err != nil {
+		return 0, err
+	}
+
 	// Adjust permissions, since the mode we want may have changed.
 	// There is a risk here that we change permissions to something that an
 	// old version of the binary can't deal with.
@@ -318,20 +408,144 @@ func upgradeDispatcher(netnsPath, bpfFsPath string, linkUpdate func(*link.NetNsL
 	}
 
 	// This is the start of the critical section. Do as little as possible in here.
-	if err := linkUpdate(nslink.(*link.NetNsLink), objs.Dispatcher); err != nil {
-		return 0, fmt.Errorf("update link: %s", err)
+	if nslink != nil {
+		if err := linkUpdate(nslink, objs.Dispatcher); err != nil {
+			return 0, fmt.Errorf("update link: %s", err)
+		}
 	}
 
-	if err := os.Rename(tmpPath, progPath); err != nil {
+	// Keep the replaced program around for RollbackDispatcher. This
+	// replaces any existing previous program.
+	if err := os.Rename(progPath, programPreviousPath(pinPath)); err != nil {
 		// At this point we are hosed: link and the pinned program disagree, so
 		// the next OpenDispatcher call will fail. There isn't much we can do,
 		// and if rename fails we probably have bigger fish to fry.
+		return 0, fmt.Errorf("rename previous program: %s", err)
+	}
+
+	if err := os.Rename(tmpPath, progPath); err != nil {
+		// See above.
 		return 0, fmt.Errorf("rename program: %s", err)
 	}
 
 	return progID, nil
 }
 
+// RollbackDispatcher reverts the datapath program to the one replaced by
+// the last call to UpgradeDispatcher.
+//
+// The current program becomes the previous program, so calling
+// RollbackDispatcher twice restores the original state.
+//
+// Returns the program ID of the restored dispatcher or an error.
+func RollbackDispatcher(netnsPath, bpfFsPath string) (ebpf.ProgramID, error) {
+	return rollbackDispatcher(netnsPath, bpfFsPath, (*link.NetNsLink).Update)
+}
+
+func rollbackDispatcher(netnsPath, bpfFsPath string, linkUpdate func(*link.NetNsLink, *ebpf.Program) error) (ebpf.ProgramID, error) {
+	netns, pinPath, err := openNetNS(netnsPath, bpfFsPath)
+	if err != nil {
+		return 0, err
+	}
+	defer netns.Close()
+
+	dir, err := lock.OpenLockedExclusive(pinPath)
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("%s: %w", bpfFsPath, ErrNotLoaded)
+	} else if err != nil {
+		return 0, fmt.Errorf("%s: %w", bpfFsPath, err)
+	}
+	defer dir.Close()
+
+	prevPath := programPreviousPath(pinPath)
+	prev, err := ebpf.LoadPinnedProgram(prevPath, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("no previous program: %w", err)
+	} else if err != nil {
+		return 0, fmt.Errorf("load previous program: %s", err)
+	}
+	defer prev.Close()
+
+	prevID, err := programID(prev)
+	if err != nil {
+		return 0, err
+	}
+
+	// nslink is nil if the dispatcher is paused.
+	nslink, err := loadPinnedNetNsLink(pinPath)
+	if err != nil {
+		return 0, err
+	}
+	if nslink != nil {
+		defer nslink.Close()
+	}
+
+	// This is the start of the critical section. Do as little as possible in here.
+	if nslink != nil {
+		if err := linkUpdate(nslink, prev); err != nil {
+			return 0, fmt.Errorf("update link: %s", err)
+		}
+	}
+
+	// Swap the current and previous program. We are hosed if any of the
+	// renames fail, see upgradeDispatcher.
+	progPath := programPath(pinPath)
+	tmpPath := programUpgradePath(pinPath)
+	if err := os.Rename(progPath, tmpPath); err != nil {
+		return 0, fmt.Errorf("rename program: %s", err)
+	}
+
+	if err := os.Rename(prevPath, progPath); err != nil {
+		return 0, fmt.Errorf("rename previous program: %s", err)
+	}
+
+	if err := os.Rename(tmpPath, prevPath); err != nil {
+		return 0, fmt.Errorf("rename program: %s", err)
+	}
+
+	return prevID, nil
+}
+
+// recordProgramVersion stores the version of prog in the state directory.
+//
+// Versions of programs other than prog and the currently pinned programs
+// are removed.
+func recordProgramVersion(pinPath string, prog *ebpf.Program, version string) error {
+	versions, err := openProgramVersions(pinPath, false)
+	if err != nil {
+		return err
+	}
+	defer versions.Close()
+
+	id, err := programID(prog)
+	if err != nil {
+		return err
+	}
+
+	keep := []ebpf.ProgramID{id}
+	for _, path := range []string{programPath(pinPath), programPreviousPath(pinPath)} {
+		pinned, err := ebpf.LoadPinnedProgram(path, nil)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("load pinned program: %s", err)
+		}
+
+		pinnedID, err := programID(pinned)
+		pinned.Close()
+		if err != nil {
+			return err
+		}
+		keep = append(keep, pinnedID)
+	}
+
+	if err := pruneProgramVersions(versions, keep...); err != nil {
+		return err
+	}
+
+	return setProgramVersion(versions, id, version)
+}
+
 // Close frees associated resources.
 //
 // It does not remove the dispatcher, see UnloadDispatcher.
@@ -353,6 +567,16 @@ func (d *Dispatcher) Close() error {
 //
 // Returns ErrNotLoaded if the dispatcher state directory doesn't exist.
 func UnloadDispatcher(netnsPath, bpfFsPath string) error {
+	return UnloadDispatcherChecked(netnsPath, bpfFsPath, nil)
+}
+
+// UnloadDispatcherChecked is like UnloadDispatcher, but allows inspecting
+// the dispatcher before its state is removed.
+//
+// check is invoked with a read-only Dispatcher while the state is locked,
+// so the Dispatcher can't be modified concurrently. The dispatcher isn't
+// removed if check returns an error.
+func UnloadDispatcherChecked(netnsPath, bpfFsPath string, check func(*Dispatcher) error) error {
 	netns, pinPath, err := openNetNS(netnsPath, bpfFsPath)
 	if err != nil {
 		return err
@@ -363,10 +587,16 @@ func UnloadDispatcher(netnsPath, bpfFsPath string) error {
 	if os.IsNotExist(err) {
 		return fmt.Errorf("%s: %w", bpfFsPath, ErrNotLoaded)
 	} else if err != nil {
-		return fmt.Errorf("%s: %s", bpfFsPath, err)
+		return fmt.Errorf("%s: %w", bpfFsPath, err)
 	}
 	defer dir.Close()
 
+	if check != nil {
+		if err := checkDispatcher(dir, pinPath, netnsPath, check); err != nil {
+			return err
+		}
+	}
+
 	if err := os.RemoveAll(pinPath); err != nil {
 		return fmt.Errorf("remove pinned state: %s", err)
 	}
@@ -374,6 +604,130 @@ func UnloadDispatcher(netnsPath, bpfFsPath string) error {
 	return nil
 }
 
+func checkDispatcher(dir *lock.File, pinPath, netnsPath string, check func(*Dispatcher) error) error {
+	// The duplicated fd shares the lock with dir, closing it doesn't
+	// release the lock.
+	fd, err := unix.FcntlInt(dir.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("duplicate state directory fd: %s", err)
+	}
+
+	spec, err := loadPatchedDispatcher(nil, nil)
+	if err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	dup := lock.Exclusive(os.NewFile(uintptr(fd), dir.Name()))
+	dp, err := newDispatcher(dup, pinPath, netnsPath, spec, true)
+	if err != nil {
+		dup.Close()
+		return err
+	}
+	defer dp.Close()
+
+	return check(dp)
+}
+
+// loadPinnedNetNsLink loads the link which attaches the dispatcher to the
+// network namespace.
+//
+// Returns a nil link if the dispatcher is paused.
+func loadPinnedNetNsLink(pinPath string) (*link.NetNsLink, error) {
+	pinned, err := link.LoadPinnedLink(linkPath(pinPath), nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	nslink, ok := pinned.(*link.NetNsLink)
+	if !ok {
+		pinned.Close()
+		return nil, fmt.Errorf("pinned link has unexpected type %T", pinned)
+	}
+
+	return nslink, nil
+}
+
+// Paused returns true if the dispatcher is detached from the network
+// namespace, see Pause.
+func (d *Dispatcher) Paused() (bool, error) {
+	_, err := os.Stat(linkPath(d.Path))
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// Pause detaches the dispatcher from the network namespace.
+//
+// Traffic is delivered as if the dispatcher wasn't loaded, while bindings
+// and destinations are preserved. Pausing a paused dispatcher is a no-op.
+func (d *Dispatcher) Pause() error {
+	nslink, err := loadPinnedNetNsLink(d.Path)
+	if err != nil {
+		return fmt.Errorf("load link: %s", err)
+	}
+	if nslink == nil {
+		return nil
+	}
+	defer nslink.Close()
+
+	// Closing the link isn't enough to detach it, since there may be other
+	// references.
+	if err := detachLink(nslink); err != nil {
+		return fmt.Errorf("detach link: %s", err)
+	}
+
+	if err := os.Remove(linkPath(d.Path)); err != nil {
+		return fmt.Errorf("remove link: %s", err)
+	}
+
+	return nil
+}
+
+// Resume attaches a paused dispatcher to the network namespace again.
+//
+// Resuming a dispatcher that isn't paused is a no-op.
+func (d *Dispatcher) Resume() error {
+	if paused, err := d.Paused(); err != nil {
+		return err
+	} else if !paused {
+		return nil
+	}
+
+	netns, err := ns.GetNS(d.netnsPath)
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+
+	prog, err := ebpf.LoadPinnedProgram(programPath(d.Path), nil)
+	if err != nil {
+		return fmt.Errorf("load program: %s", err)
+	}
+	defer prog.Close()
+
+	nslink, err := link.AttachNetNs(int(netns.Fd()), prog)
+	if err != nil {
+		return fmt.Errorf("attach program to netns %s: %s", netns.Path(), err)
+	}
+	defer nslink.Close()
+
+	if err := nslink.Pin(linkPath(d.Path)); err != nil {
+		return fmt.Errorf("can't pin link: %s", err)
+	}
+
+	if err := adjustPermissions(d.Path); err != nil {
+		return fmt.Errorf("adjust permissions: %s", err)
+	}
+
+	return nil
+}
+
 // Program returns the active dispatcher program.
 //
 // The caller must call Program.Close().
@@ -400,6 +754,13 @@ func (d *Domain) UnmarshalText(text []byte) error {
 	return nil
 }
 
+func (d Domain) MarshalText() ([]byte, error) {
+	if d != AF_INET && d != AF_INET6 {
+		return nil, fmt.Errorf("unknown domain %d", uint8(d))
+	}
+	return []byte(d.String()), nil
+}
+
 func (d Domain) String() string {
 	switch d {
 	case AF_INET:
@@ -431,6 +792,13 @@ func (p *Protocol) UnmarshalText(text []byte) error {
 	return nil
 }
 
+func (p Protocol) MarshalText() ([]byte, error) {
+	if p != TCP && p != UDP {
+		return nil, fmt.Errorf("unknown protocol %d", uint8(p))
+	}
+	return []byte(p.String()), nil
+}
+
 func (p Protocol) String() string {
 	switch p {
 	case TCP:
@@ -445,14 +813,25 @@ func (p Protocol) String() string {
 // AddBinding redirects traffic for a given protocol, prefix and port to a label.
 //
 // Traffic for the binding is dropped by the data plane if no matching
-// destination exists.
+// destination exists. If the binding exists and bind doesn't specify an
+// owner, the existing owner is kept.
 func (d *Dispatcher) AddBinding(bind *Binding) error {
+	return d.addBinding(bind, false)
+}
+
+// addBinding is like AddBinding, but removes the existing owner of a binding
+// if replaceOwner is true and bind doesn't specify one.
+func (d *Dispatcher) addBinding(bind *Binding, replaceOwner bool) error {
 	dest := newDestinationFromBinding(bind)
 
 	if bind.Prefix.IP().Is4in6() {
 		return fmt.Errorf("prefix cannot be v4-mapped v6: %v", bind.Prefix)
 	}
 
+	if _, err := newOwner(bind.Owner); err != nil {
+		return err
+	}
+
 	key := newBindingKey(bind)
 
 	var old bindingValue
@@ -468,7 +847,7 @@ func (d *Dispatcher) AddBinding(bind *Binding) error {
 
 	id, err := d.destinations.Acquire(dest)
 	if err != nil {
-		return fmt.Errorf("acquire destination: %s", err)
+		return fmt.Errorf("acquire destination: %w", err)
 	}
 
 	new := bindingValue{id, key.PrefixLen}
@@ -482,23 +861,41 @@ func (d *Dispatcher) AddBinding(bind *Binding) error {
 		_ = d.destinations.ReleaseByID(old.ID)
 	}
 
+	if releaseOldID && bind.Owner == "" && !replaceOwner {
+		return nil
+	}
+
+	if err := d.setBindingOwner(key, bind.Owner); err != nil {
+		return fmt.Errorf("binding owner: %s", err)
+	}
+
 	return nil
 }
 
+// replaceBinding is like AddBinding, but also replaces the owner of an
+// existing binding.
+func (d *Dispatcher) replaceBinding(bind *Binding) error {
+	return d.addBinding(bind, true)
+}
+
 // RemoveBinding stops redirecting traffic for a given protocol, prefix and port.
 //
-// Returns an error if the binding doesn't exist.
+// Returns ErrBindingNotFound if the binding doesn't exist, and
+// ErrDestinationMismatch if it exists with a different label.
 func (d *Dispatcher) RemoveBinding(bind *Binding) error {
 	key := newBindingKey(bind)
 
 	var existing bindingValue
-	if err := d.bindings.Lookup(key, &existing); err != nil {
+	err := d.bindings.Lookup(key, &existing)
+	if errors.Is(err, ebpf.ErrKeyNotExist) || (err == nil && existing.PrefixLen != key.PrefixLen) {
+		return fmt.Errorf("remove binding %s: %w", bind, ErrBindingNotFound)
+	} else if err != nil {
 		return fmt.Errorf("remove binding: lookup destination: %s", err)
 	}
 
 	dest := newDestinationFromBinding(bind)
 	if !d.destinations.HasID(dest, existing.ID) {
-		return fmt.Errorf("remove binding: destination mismatch")
+		return fmt.Errorf("remove binding %s: %w", bind, ErrDestinationMismatch)
 	}
 
 	if err := d.bindings.Delete(key); err != nil {
@@ -511,6 +908,10 @@ func (d *Dispatcher) RemoveBinding(bind *Binding) error {
 		return fmt.Errorf("remove binding: %s", err)
 	}
 
+	if err := d.setBindingOwner(key, ""); err != nil {
+		return fmt.Errorf("remove binding: %s", err)
+	}
+
 	return nil
 }
 
@@ -518,34 +919,101 @@ func (d *Dispatcher) RemoveBinding(bind *Binding) error {
 //
 // It is conceptually identical to repeatedly calling AddBinding and RemoveBinding
 // and therefore not atomic: the function may return without applying all changes.
+// A binding whose owner changes is considered added. Unlike AddBinding, the
+// owner of a binding is removed if it isn't specified.
 //
 // Returns a boolean indicating whether any changes were made.
 func (d *Dispatcher) ReplaceBindings(bindings Bindings) (added, removed Bindings, _ error) {
-	return d.replaceBindings(bindings, d.AddBinding, d.RemoveBinding)
+	return d.replaceBindings(bindings, nil, d.replaceBinding, d.RemoveBinding)
+}
+
+// ReplaceOwnedBindings changes the bindings owned by owner to a new set.
+//
+// Bindings which belong to a different owner or to no owner at all are left
+// untouched. It's an error to specify a binding which exists but isn't owned
+// by owner. The Owner field of bindings is ignored, all of them are assigned
+// to owner.
+//
+// The same caveats as for ReplaceBindings apply.
+func (d *Dispatcher) ReplaceOwnedBindings(owner string, bindings Bindings) (added, removed Bindings, _ error) {
+	if owner == "" {
+		return nil, nil, fmt.Errorf("owner can't be empty")
+	}
+	if _, err := newOwner(owner); err != nil {
+		return nil, nil, err
+	}
+
+	return d.replaceBindings(bindings, &owner, d.replaceBinding, d.RemoveBinding)
 }
 
-func (d *Dispatcher) replaceBindings(bindings Bindings, add, remove func(*Binding) error) (added, removed Bindings, _ error) {
+// replaceBindings replaces all bindings, or only the ones belonging to owner
+// if it isn't nil.
+func (d *Dispatcher) replaceBindings(bindings Bindings, owner *string, add, remove func(*Binding) error) (added, removed Bindings, _ error) {
 	want := make(map[bindingKey]string)
+	wantOwners := make(map[bindingKey]string)
 	for _, bind := range bindings {
 		key := newBindingKey(bind)
 
 		if label := want[*key]; label != "" {
-			return nil, nil, fmt.Errorf("duplicate binding %s: already assigned to %s", bind, label)
+			return nil, nil, fmt.Errorf("duplicate binding %s: already assigned to %s: %w", bind, label, ErrBindingConflict)
 		}
 
 		want[*key] = bind.Label
+		if owner != nil {
+			wantOwners[*key] = *owner
+		} else {
+			wantOwners[*key] = bind.Owner
+		}
+	}
+
+	owners, err := d.bindingOwners()
+	if err != nil {
+		return nil, nil, fmt.Errorf("get binding owners: %s", err)
 	}
 
 	have := make(map[bindingKey]string)
-	err := d.iterBindings(func(key bindingKey, label string) {
-		have[key] = label
+	var conflicts []string
+	err = d.iterBindings(func(key bindingKey, label string) {
+		if owner == nil || owners[key] == *owner {
+			have[key] = label
+			return
+		}
+
+		if want[key] == "" {
+			return
+		}
+
+		bind := newBindingFromBPF(label, &key)
+		if other := owners[key]; other != "" {
+			conflicts = append(conflicts, fmt.Sprintf("%s (owned by %s)", bind, other))
+		} else {
+			conflicts = append(conflicts, fmt.Sprintf("%s (not owned)", bind))
+		}
 	})
 	if err != nil {
 		return nil, nil, fmt.Errorf("get existing bindings: %s", err)
 	}
 
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return nil, nil, fmt.Errorf("%w: %s", ErrBindingConflict, strings.Join(conflicts, ", "))
+	}
+
 	added, removed = diffBindings(have, want)
 
+	for key, label := range want {
+		if have[key] == label && owners[key] != wantOwners[key] {
+			added = append(added, newBindingFromBPF(label, &key))
+		}
+	}
+
+	for _, bind := range added {
+		bind.Owner = wantOwners[*newBindingKey(bind)]
+	}
+	for _, bind := range removed {
+		bind.Owner = owners[*newBindingKey(bind)]
+	}
+
 	// There is a chance of misdirecting traffic when adding overlapping bindings.
 	// Consider a scenario where (2) is added before (1):
 	//   1. IP:80 -> foo
@@ -558,13 +1026,13 @@ func (d *Dispatcher) replaceBindings(bindings Bindings, add, remove func(*Bindin
 
 	for _, bind := range added {
 		if err := add(bind); err != nil {
-			return nil, nil, fmt.Errorf("add binding %s: %s", bind, err)
+			return nil, nil, fmt.Errorf("add binding %s: %w", bind, err)
 		}
 	}
 
 	for _, bind := range removed {
 		if err := remove(bind); err != nil {
-			return nil, nil, fmt.Errorf("remove binding %s: %s", bind, err)
+			return nil, nil, fmt.Errorf("remove binding %s: %w", bind, err)
 		}
 	}
 
@@ -601,9 +1069,16 @@ func (d *Dispatcher) iterBindings(fn func(bindingKey, string)) error {
 
 // Bindings lists known bindings.
 func (d *Dispatcher) Bindings() (Bindings, error) {
+	owners, err := d.bindingOwners()
+	if err != nil {
+		return nil, err
+	}
+
 	var bindings Bindings
-	err := d.iterBindings(func(key bindingKey, label string) {
-		bindings = append(bindings, newBindingFromBPF(label, &key))
+	err = d.iterBindings(func(key bindingKey, label string) {
+		bind := newBindingFromBPF(label, &key)
+		bind.Owner = owners[key]
+		bindings = append(bindings, bind)
 	})
 	if err != nil {
 		return nil, err
@@ -622,6 +1097,36 @@ func (c SocketCookie) String() string {
 	return fmt.Sprintf("sk:%x", uint64(c))
 }
 
+// MarshalText encodes c in the format produced by String.
+//
+// The zero cookie can't be encoded, since UnmarshalText rejects it.
+func (c SocketCookie) MarshalText() ([]byte, error) {
+	if c == 0 {
+		return nil, fmt.Errorf("socket cookie: zero is not a valid cookie")
+	}
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText parses the format produced by String.
+func (c *SocketCookie) UnmarshalText(text []byte) error {
+	str := string(text)
+	if !strings.HasPrefix(str, "sk:") {
+		return fmt.Errorf("socket cookie %q: missing sk: prefix", str)
+	}
+
+	value, err := strconv.ParseUint(strings.TrimPrefix(str, "sk:"), 16, 64)
+	if err != nil {
+		return fmt.Errorf("socket cookie %q: %s", str, err)
+	}
+
+	if value == 0 {
+		return fmt.Errorf("socket cookie %q: zero is not a valid cookie", str)
+	}
+
+	*c = SocketCookie(value)
+	return nil
+}
+
 // RegisterSocket adds a socket with the given label.
 //
 // The socket receives traffic for all Bindings that share the same label,
@@ -638,12 +1143,38 @@ func (d *Dispatcher) RegisterSocket(label string, conn syscall.Conn) (dest *Dest
 
 	created, err = d.destinations.AddSocket(dest, conn)
 	if err != nil {
-		return nil, false, fmt.Errorf("add socket: %s", err)
+		return nil, false, fmt.Errorf("add socket: %w", err)
 	}
 
 	return
 }
 
+// ReplaceSocket registers a socket with the given label, but only if the
+// socket currently registered for the same destination has the cookie old.
+//
+// Returns ErrDestinationMismatch if a different socket or no socket is
+// registered.
+func (d *Dispatcher) ReplaceSocket(label string, conn syscall.Conn, old SocketCookie) (*Destination, error) {
+	dest, err := newDestinationFromConn(label, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.checkSocket(dest, old); err != nil {
+		return nil, err
+	}
+
+	if _, err := d.destinations.AddSocket(dest, conn); err != nil {
+		return nil, fmt.Errorf("add socket: %w", err)
+	}
+
+	return dest, nil
+}
+
+// UnregisterSocket removes the socket mapping for the given label, domain and
+// protocol.
+//
+// Returns ErrSocketNotFound if no socket is registered.
 func (d *Dispatcher) UnregisterSocket(label string, domain Domain, proto Protocol) error {
 	dest := &Destination{
 		Label:    label,
@@ -653,7 +1184,7 @@ func (d *Dispatcher) UnregisterSocket(label string, domain Domain, proto Protoco
 
 	err := d.destinations.RemoveSocket(dest)
 	if errors.Is(err, ebpf.ErrKeyNotExist) {
-		return fmt.Errorf("socket %s doesn't exist", dest)
+		return fmt.Errorf("socket %s: %w", dest, ErrSocketNotFound)
 	}
 	if err != nil {
 		return fmt.Errorf("remove socket %s: %s", dest, err)
@@ -662,6 +1193,50 @@ func (d *Dispatcher) UnregisterSocket(label string, domain Domain, proto Protoco
 	return nil
 }
 
+// UnregisterSocketCookie removes the socket mapping for the given label,
+// domain and protocol, but only if the registered socket has the given
+// cookie.
+//
+// Returns ErrDestinationMismatch if a different socket is registered.
+func (d *Dispatcher) UnregisterSocketCookie(label string, domain Domain, proto Protocol, cookie SocketCookie) error {
+	dest := &Destination{
+		Label:    label,
+		Domain:   domain,
+		Protocol: proto,
+	}
+
+	if err := d.checkSocket(dest, cookie); err != nil {
+		return err
+	}
+
+	if err := d.destinations.RemoveSocket(dest); err != nil {
+		return fmt.Errorf("remove socket %s: %s", dest, err)
+	}
+
+	return nil
+}
+
+// checkSocket returns an error if the socket registered for dest doesn't
+// have the expected cookie.
+//
+// The check isn't racy since d holds an exclusive lock on the dispatcher.
+func (d *Dispatcher) checkSocket(dest *Destination, want SocketCookie) error {
+	have, err := d.destinations.Socket(dest)
+	if err != nil {
+		return fmt.Errorf("lookup socket %s: %s", dest, err)
+	}
+
+	if have == 0 {
+		return fmt.Errorf("socket %s doesn't exist: %w", dest, ErrDestinationMismatch)
+	}
+
+	if have != want {
+		return fmt.Errorf("socket %s is %s instead of %s: %w", dest, have, want, ErrDestinationMismatch)
+	}
+
+	return nil
+}
+
 // Metrics contain counters generated by the data plane.
 type Metrics struct {
 	Destinations map[Destination]DestinationMetrics
@@ -714,6 +1289,93 @@ func (d *Dispatcher) Metrics() (*Metrics, error) {
 	return &Metrics{destMetrics, bindingMetrics, socketsPresent}, nil
 }
 
+// SocketQueue describes the queue usage of a registered socket.
+type SocketQueue struct {
+	// Number of connections waiting to be accepted for TCP, or number of
+	// bytes waiting to be read for UDP.
+	Length uint32
+	// Maximum accept backlog for TCP, or size of the receive buffer in bytes
+	// for UDP.
+	Limit uint32
+	// Number of packets dropped by a UDP socket. Always zero for TCP.
+	Drops uint32
+}
+
+// SocketQueues returns the queue usage of all registered sockets.
+//
+// Sockets are queried via sock_diag in the dispatcher's network namespace.
+// Entering the namespace requires CAP_SYS_ADMIN unless the calling thread
+// is already a member.
+func (d *Dispatcher) SocketQueues() (map[Destination]SocketQueue, error) {
+	destsByID, err := d.destinations.List()
+	if err != nil {
+		return nil, fmt.Errorf("list destinations: %s", err)
+	}
+
+	socketsByID, err := d.destinations.Sockets()
+	if err != nil {
+		return nil, fmt.Errorf("list sockets: %s", err)
+	}
+
+	type kind struct {
+		Domain
+		Protocol
+	}
+
+	destsByCookie := make(map[SocketCookie]*Destination)
+	kinds := make(map[kind]bool)
+	for id, cookie := range socketsByID {
+		dest := destsByID[id]
+		if dest == nil {
+			continue
+		}
+
+		destsByCookie[cookie] = dest
+		kinds[kind{dest.Domain, dest.Protocol}] = true
+	}
+
+	queues := make(map[Destination]SocketQueue)
+	if len(destsByCookie) == 0 {
+		return queues, nil
+	}
+
+	err = inNetNS(d.netnsPath, func() error {
+		for k := range kinds {
+			states := uint32(sockdiag.StateAll)
+			if k.Protocol == TCP {
+				states = sockdiag.StateListen
+			}
+
+			sockets, err := sockdiag.Dump(uint8(k.Domain), uint8(k.Protocol), states)
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", k.Domain, k.Protocol, err)
+			}
+
+			for _, sk := range sockets {
+				dest := destsByCookie[SocketCookie(sk.Cookie)]
+				if dest == nil || dest.Domain != k.Domain || dest.Protocol != k.Protocol {
+					continue
+				}
+
+				queue := SocketQueue{Length: sk.RecvQueue}
+				if k.Protocol == TCP {
+					queue.Limit = sk.SendQueue
+				} else {
+					queue.Limit = sk.RecvBuffer
+					queue.Drops = sk.Drops
+				}
+				queues[*dest] = queue
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("socket diagnostics: %s", err)
+	}
+
+	return queues, nil
+}
+
 // Destinations returns a set of existing destinations, i.e. sockets and labels.
 func (d *Dispatcher) Destinations() ([]Destination, map[Destination]SocketCookie, error) {
 	destsByID, err := d.destinations.List()
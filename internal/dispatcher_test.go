@@ -29,6 +29,7 @@ import (
 	"github.com/cilium/ebpf/link"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"kernel.org/pub/linux/libs/security/libcap/cap"
 )
 
@@ -50,7 +51,7 @@ func TestLoadDispatcher(t *testing.T) {
 	}
 
 	err := testutil.WithCapabilities(func() error {
-		_, err := CreateDispatcher(netns.Path(), "/sys/fs/bpf")
+		_, err := CreateDispatcher(netns.Path(), "/sys/fs/bpf", "test")
 		return err
 	}, CreateCapabilities...)
 	if !errors.Is(err, ErrLoaded) {
@@ -105,6 +106,40 @@ func TestUnloadDispatcherNotLoaded(t *testing.T) {
 	}
 }
 
+func TestUnloadDispatcherChecked(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+	mustAddBinding(t, dp, mustNewBinding(t, "foo", TCP, "127.0.0.1", 80))
+	dp.Close()
+
+	errInUse := errors.New("in use")
+	err := UnloadDispatcherChecked(netns.Path(), "/sys/fs/bpf", func(dp *Dispatcher) error {
+		bindings, err := dp.Bindings()
+		if err != nil {
+			return err
+		}
+		if len(bindings) != 1 {
+			t.Error("Expected one binding, got", len(bindings))
+		}
+		return errInUse
+	})
+	if !errors.Is(err, errInUse) {
+		t.Fatal("Expected error from check, got", err)
+	}
+
+	dp = mustOpenDispatcher(t, nil, netns)
+	dp.Close()
+
+	err = UnloadDispatcherChecked(netns.Path(), "/sys/fs/bpf", func(*Dispatcher) error { return nil })
+	if err != nil {
+		t.Fatal("Unload:", err)
+	}
+
+	if _, err := OpenDispatcher(netns.Path(), "/sys/fs/bpf", true); !errors.Is(err, ErrNotLoaded) {
+		t.Fatal("Expected ErrNotLoaded after unload, got", err)
+	}
+}
+
 func TestDispatcherConcurrentAccess(t *testing.T) {
 	procs := runtime.GOMAXPROCS(0)
 	if procs < 2 {
@@ -170,7 +205,7 @@ func TestDispatcherUpgrade(t *testing.T) {
 
 	for i := 0; i < 3; i++ {
 		err := testutil.WithCapabilities(func() error {
-			_, err := UpgradeDispatcher(netns.Path(), "/sys/fs/bpf")
+			_, err := UpgradeDispatcher(netns.Path(), "/sys/fs/bpf", fmt.Sprintf("v%d", i))
 			return err
 		}, CreateCapabilities...)
 		if err != nil {
@@ -181,6 +216,144 @@ func TestDispatcherUpgrade(t *testing.T) {
 	dp = mustOpenDispatcher(t, nil, netns)
 	defer dp.Close()
 	check(dp)
+
+	current, previous := mustPrograms(t, dp)
+	if current.Version != "v2" {
+		t.Errorf("Expected current version v2, got %q", current.Version)
+	}
+	if previous == nil {
+		t.Fatal("Previous program isn't kept")
+	}
+	if previous.Version != "v1" {
+		t.Errorf("Expected previous version v1, got %q", previous.Version)
+	}
+}
+
+func TestDispatcherRollback(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+	check := assertDispatcherState(t, dp, netns)
+	original, _ := mustPrograms(t, dp)
+	if err := dp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var upgradedID ebpf.ProgramID
+	err := testutil.WithCapabilities(func() (err error) {
+		upgradedID, err = UpgradeDispatcher(netns.Path(), "/sys/fs/bpf", "upgraded")
+		return
+	}, CreateCapabilities...)
+	if err != nil {
+		t.Fatal("Upgrade failed:", err)
+	}
+
+	var rolledBackID ebpf.ProgramID
+	err = testutil.WithCapabilities(func() (err error) {
+		rolledBackID, err = RollbackDispatcher(netns.Path(), "/sys/fs/bpf")
+		return
+	}, CreateCapabilities...)
+	if err != nil {
+		t.Fatal("Rollback failed:", err)
+	}
+
+	if rolledBackID != original.ID {
+		t.Errorf("Rollback returned program #%d instead of #%d", rolledBackID, original.ID)
+	}
+
+	dp = mustOpenDispatcher(t, nil, netns)
+	defer dp.Close()
+	check(dp)
+
+	current, previous := mustPrograms(t, dp)
+	if diff := cmp.Diff(original, current); diff != "" {
+		t.Errorf("Current program doesn't match original (-want +got):\n%s", diff)
+	}
+	if previous == nil || previous.ID != upgradedID || previous.Version != "upgraded" {
+		t.Errorf("Previous program should be the upgraded one, got %v", previous)
+	}
+}
+
+func TestDispatcherRollbackWithoutUpgrade(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+	dp.Close()
+
+	err := testutil.WithCapabilities(func() error {
+		_, err := RollbackDispatcher(netns.Path(), "/sys/fs/bpf")
+		return err
+	}, CreateCapabilities...)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Expected ErrNotExist from rollback without upgrade, got", err)
+	}
+}
+
+func TestDispatcherPauseResume(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+	check := assertDispatcherState(t, dp, netns)
+	dp.Close()
+
+	dp = mustOpenDispatcher(t, nil, netns)
+	if err := dp.Pause(); err != nil {
+		t.Fatal("Can't pause:", err)
+	}
+
+	if paused, err := dp.Paused(); err != nil {
+		t.Fatal(err)
+	} else if !paused {
+		t.Error("Dispatcher isn't paused")
+	}
+
+	if testutil.CanDial(t, netns, "tcp4", "127.0.0.1:443") {
+		t.Error("Traffic is steered while paused")
+	}
+
+	if err := dp.Pause(); err != nil {
+		t.Error("Pausing twice returns an error:", err)
+	}
+	dp.Close()
+
+	// Upgrades keep the dispatcher paused.
+	err := testutil.WithCapabilities(func() error {
+		_, err := UpgradeDispatcher(netns.Path(), "/sys/fs/bpf", "test")
+		return err
+	}, CreateCapabilities...)
+	if err != nil {
+		t.Fatal("Can't upgrade paused dispatcher:", err)
+	}
+
+	dp = mustOpenDispatcher(t, nil, netns)
+	defer dp.Close()
+
+	if paused, err := dp.Paused(); err != nil {
+		t.Fatal(err)
+	} else if !paused {
+		t.Error("Upgrade resumes the dispatcher")
+	}
+
+	err = testutil.WithCapabilities(dp.Resume, CreateCapabilities...)
+	if err != nil {
+		t.Fatal("Can't resume:", err)
+	}
+
+	if paused, err := dp.Paused(); err != nil {
+		t.Fatal(err)
+	} else if paused {
+		t.Error("Dispatcher is paused after resume")
+	}
+
+	check(dp)
+}
+
+func mustPrograms(tb testing.TB, dp *Dispatcher) (current, previous *LoadedProgram) {
+	tb.Helper()
+
+	current, previous, err := dp.Programs()
+	if err != nil {
+		tb.Fatal("Can't get programs:", err)
+	}
+
+	return current, previous
 }
 
 func TestDispatcherUpgradeFailedLinkUpdate(t *testing.T) {
@@ -195,7 +368,7 @@ func TestDispatcherUpgradeFailedLinkUpdate(t *testing.T) {
 		return errors.New("aborted")
 	}
 
-	_, err := upgradeDispatcher(netns.Path(), "/sys/fs/bpf", updateLink)
+	_, err := upgradeDispatcher(netns.Path(), "/sys/fs/bpf", "test", nil, updateLink)
 	if err == nil {
 		t.Fatal("Upgrade didn't fail")
 	}
@@ -282,8 +455,13 @@ func assertDispatcherState(tb testing.TB, dp *Dispatcher, netns ns.NetNS) func(*
 
 		testutil.CanDialName(tb, netns, "tcp", "127.0.0.1:443", "service")
 
+		// Upgrades keep the replaced program around.
+		ignorePrevious := cmpopts.IgnoreSliceElements(func(fi fileInfo) bool {
+			return fi.Name == filepath.Base(programPreviousPath(dp.Path))
+		})
+
 		filesAfter := filesInDirectory(tb, dp.Path)
-		if diff := cmp.Diff(filesBefore, filesAfter); diff != "" {
+		if diff := cmp.Diff(filesBefore, filesAfter, ignorePrevious); diff != "" {
 			tb.Fatal("Filesystem state before and after doesn't match:\n", diff)
 		}
 	}
@@ -325,7 +503,7 @@ func TestDispatcherUpgradeWithIncompatibleMap(t *testing.T) {
 		break
 	}
 
-	if _, err := UpgradeDispatcher(netns.Path(), "/sys/fs/bpf"); err == nil {
+	if _, err := UpgradeDispatcher(netns.Path(), "/sys/fs/bpf", "test"); err == nil {
 		t.Fatal("Upgrading a dispatcher with an incompatible map doesn't return an error")
 	}
 }
@@ -433,6 +611,8 @@ func TestDispatcherAccess(t *testing.T) {
 
 			if err == nil {
 				t.Fatal("Managed to open dispatcher")
+			} else if !errors.Is(err, os.ErrPermission) {
+				t.Fatal("Expected a permission error, got", err)
 			}
 		})
 	}
@@ -560,8 +740,8 @@ func TestRemoveBinding(t *testing.T) {
 	bindA := mustNewBinding(t, "foo", TCP, "::1", 80)
 	bindB := mustNewBinding(t, "bar", TCP, "::1", 80)
 
-	if err := dp.RemoveBinding(bindA); err == nil {
-		t.Error("Removing a non-existing binding doesn't return an error")
+	if err := dp.RemoveBinding(bindA); !errors.Is(err, ErrBindingNotFound) {
+		t.Error("Removing a non-existing binding doesn't return ErrBindingNotFound:", err)
 	}
 
 	if err := dp.AddBinding(bindA); err != nil {
@@ -577,8 +757,13 @@ func TestRemoveBinding(t *testing.T) {
 		t.Fatal("Expected one destination, got", n)
 	}
 
-	if err := dp.RemoveBinding(bindB); err == nil {
-		t.Fatal("Removed a binding where the destination doesn't match")
+	if err := dp.RemoveBinding(bindB); !errors.Is(err, ErrDestinationMismatch) {
+		t.Fatal("Removing a binding where the destination doesn't match doesn't return ErrDestinationMismatch:", err)
+	}
+
+	// The lookup for a more specific binding returns bindA.
+	if err := dp.RemoveBinding(mustNewBinding(t, "foo", TCP, "::1", 0)); !errors.Is(err, ErrBindingNotFound) {
+		t.Error("Removing a less specific binding doesn't return ErrBindingNotFound:", err)
 	}
 
 	if err := dp.RemoveBinding(bindA); err != nil {
@@ -604,8 +789,8 @@ func TestReplaceBindings(t *testing.T) {
 		netns := testutil.NewNetNS(t)
 		dp := mustCreateDispatcher(t, netns)
 
-		if _, _, err := dp.ReplaceBindings(Bindings{a, aRelabeled}); err == nil {
-			t.Error("ReplaceBindings doesn't reject multiple labels for the same binding")
+		if _, _, err := dp.ReplaceBindings(Bindings{a, aRelabeled}); !errors.Is(err, ErrBindingConflict) {
+			t.Error("ReplaceBindings doesn't reject multiple labels for the same binding:", err)
 		}
 	})
 
@@ -664,6 +849,126 @@ func TestReplaceBindings(t *testing.T) {
 	}
 }
 
+func TestReplaceOwnedBindings(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	unowned := mustNewBinding(t, "foo", TCP, "127.0.0.1", 80)
+	mustAddBinding(t, dp, unowned)
+
+	a := mustNewBinding(t, "bar", TCP, "::1", 80)
+	b := mustNewBinding(t, "bar", UDP, "::1", 53)
+	added, removed, err := dp.ReplaceOwnedBindings("team-a", Bindings{a, b})
+	if err != nil {
+		t.Fatal("Can't replace owned bindings:", err)
+	}
+	if len(added) != 2 || len(removed) != 0 {
+		t.Fatalf("Expected two added bindings, got %v %v", added, removed)
+	}
+	for _, bind := range added {
+		if bind.Owner != "team-a" {
+			t.Error("Added binding has owner", bind.Owner)
+		}
+	}
+
+	c := mustNewBinding(t, "baz", TCP, "::1", 443)
+	if _, _, err := dp.ReplaceOwnedBindings("team-b", Bindings{c}); err != nil {
+		t.Fatal("Can't replace owned bindings:", err)
+	}
+
+	if _, _, err := dp.ReplaceOwnedBindings("team-b", Bindings{c, a}); !errors.Is(err, ErrBindingConflict) {
+		t.Error("ReplaceOwnedBindings accepts a binding of a different owner:", err)
+	}
+
+	if _, _, err := dp.ReplaceOwnedBindings("team-b", Bindings{unowned}); err == nil {
+		t.Error("ReplaceOwnedBindings accepts a binding without owner")
+	}
+
+	added, removed, err = dp.ReplaceOwnedBindings("team-a", Bindings{b})
+	if err != nil {
+		t.Fatal("Can't replace owned bindings:", err)
+	}
+	if len(added) != 0 || len(removed) != 1 || removed[0].Label != "bar" || removed[0].Protocol != TCP {
+		t.Errorf("Expected %v to be removed, got %v %v", a, added, removed)
+	}
+
+	have, err := dp.Bindings()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owners := make(map[string]string)
+	for _, bind := range have {
+		owners[bind.String()] = bind.Owner
+	}
+
+	want := map[string]string{
+		unowned.String(): "",
+		b.String():       "team-a",
+		c.String():       "team-b",
+	}
+	if diff := cmp.Diff(want, owners); diff != "" {
+		t.Errorf("Owners don't match (-want +got):\n%s", diff)
+	}
+
+	if _, _, err := dp.ReplaceOwnedBindings("", nil); err == nil {
+		t.Error("ReplaceOwnedBindings accepts an empty owner")
+	}
+
+	// Removing a binding removes its owner as well.
+	mustRemoveBinding := func(bind *Binding) {
+		t.Helper()
+		if err := dp.RemoveBinding(bind); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustRemoveBinding(c)
+	mustAddBinding(t, dp, c)
+	if _, _, err := dp.ReplaceOwnedBindings("team-a", Bindings{c}); err == nil {
+		t.Error("Owner of a removed binding is retained")
+	}
+
+	// ReplaceBindings assigns owners as well.
+	owned := *c
+	owned.Owner = "team-c"
+	added, _, err = dp.ReplaceBindings(Bindings{&owned})
+	if err != nil {
+		t.Fatal("Can't replace bindings:", err)
+	}
+	if len(added) != 1 || added[0].Owner != "team-c" {
+		t.Error("Changing the owner doesn't add the binding:", added)
+	}
+
+	ownerOf := func(bind *Binding) string {
+		t.Helper()
+		have, err := dp.Bindings()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, have := range have {
+			if have.String() == bind.String() {
+				return have.Owner
+			}
+		}
+		t.Fatal("Missing binding", bind)
+		return ""
+	}
+
+	// AddBinding keeps the owner unless one is specified.
+	mustAddBinding(t, dp, c)
+	if owner := ownerOf(c); owner != "team-c" {
+		t.Errorf("AddBinding without owner changes the owner to %q", owner)
+	}
+
+	// ReplaceBindings removes owners which aren't specified.
+	if _, _, err := dp.ReplaceBindings(Bindings{c}); err != nil {
+		t.Fatal("Can't replace bindings:", err)
+	}
+	if owner := ownerOf(c); owner != "" {
+		t.Errorf("ReplaceBindings without owner keeps owner %q", owner)
+	}
+}
+
 func TestReplaceBindingsOverlapping(t *testing.T) {
 	netns := testutil.NewNetNS(t, "2001:db8::/32")
 	dp := mustCreateDispatcher(t, netns)
@@ -689,7 +994,7 @@ func TestReplaceBindingsOverlapping(t *testing.T) {
 	}
 
 	go func() {
-		_, _, err := dp.replaceBindings(Bindings{foo, bar}, add, nil)
+		_, _, err := dp.replaceBindings(Bindings{foo, bar}, nil, add, nil)
 		if err != nil {
 			t.Error("Failed to replace bindings:", err)
 		}
@@ -715,7 +1020,7 @@ func TestReplaceBindingsOverlapping(t *testing.T) {
 	}
 
 	go func() {
-		_, _, err := dp.replaceBindings(nil, nil, remove)
+		_, _, err := dp.replaceBindings(nil, nil, nil, remove)
 		if err != nil {
 			t.Error("Failed to replace bindings:", err)
 		}
@@ -779,6 +1084,100 @@ func TestUpdateRegisteredSocket(t *testing.T) {
 	}
 }
 
+func TestReplaceSocket(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	conn := testutil.Listen(t, netns, "tcp4", "")
+	if _, err := dp.ReplaceSocket("service-name", conn, 1); !errors.Is(err, ErrDestinationMismatch) {
+		t.Fatal("Replacing a missing socket doesn't return ErrDestinationMismatch:", err)
+	}
+
+	dest := mustRegisterSocket(t, dp, "service-name", conn)
+	old := mustRegisteredCookie(t, dp, dest)
+
+	next := testutil.Listen(t, netns, "tcp4", "")
+	if _, err := dp.ReplaceSocket("service-name", next, old+1); !errors.Is(err, ErrDestinationMismatch) {
+		t.Fatal("Replacing the wrong socket doesn't return ErrDestinationMismatch:", err)
+	}
+	if cookie := mustRegisteredCookie(t, dp, dest); cookie != old {
+		t.Fatal("Socket was replaced despite the wrong cookie")
+	}
+
+	if _, err := dp.ReplaceSocket("service-name", next, old); err != nil {
+		t.Fatal("Can't replace socket:", err)
+	}
+	if cookie := mustRegisteredCookie(t, dp, dest); cookie == old {
+		t.Fatal("Socket wasn't replaced")
+	}
+}
+
+func TestUnregisterSocketCookie(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	conn := testutil.Listen(t, netns, "udp4", "")
+	dest := mustRegisterSocket(t, dp, "service-name", conn)
+	cookie := mustRegisteredCookie(t, dp, dest)
+
+	err := dp.UnregisterSocketCookie(dest.Label, dest.Domain, dest.Protocol, cookie+1)
+	if !errors.Is(err, ErrDestinationMismatch) {
+		t.Fatal("Unregistering the wrong socket doesn't return ErrDestinationMismatch:", err)
+	}
+
+	if err := dp.UnregisterSocketCookie(dest.Label, dest.Domain, dest.Protocol, cookie); err != nil {
+		t.Fatal("Can't unregister socket:", err)
+	}
+	if cookie := mustRegisteredCookie(t, dp, dest); cookie != 0 {
+		t.Fatal("Socket wasn't unregistered")
+	}
+
+	err = dp.UnregisterSocketCookie(dest.Label, dest.Domain, dest.Protocol, cookie)
+	if !errors.Is(err, ErrDestinationMismatch) {
+		t.Fatal("Unregistering a missing socket doesn't return ErrDestinationMismatch:", err)
+	}
+
+	err = dp.UnregisterSocket(dest.Label, dest.Domain, dest.Protocol)
+	if !errors.Is(err, ErrSocketNotFound) {
+		t.Fatal("Unregistering a missing socket doesn't return ErrSocketNotFound:", err)
+	}
+}
+
+func TestSocketCookieText(t *testing.T) {
+	for _, cookie := range []SocketCookie{1, 0x4001, ^SocketCookie(0)} {
+		var have SocketCookie
+		if err := have.UnmarshalText([]byte(cookie.String())); err != nil {
+			t.Errorf("Can't parse %s: %s", cookie, err)
+		} else if have != cookie {
+			t.Errorf("Parsing %s returns %s", cookie, have)
+		}
+
+		text, err := cookie.MarshalText()
+		if err != nil {
+			t.Errorf("Can't marshal %s: %s", cookie, err)
+			continue
+		}
+
+		have = 0
+		if err := have.UnmarshalText(text); err != nil {
+			t.Errorf("Can't unmarshal %q: %s", text, err)
+		} else if have != cookie {
+			t.Errorf("Round trip of %s returns %s", cookie, have)
+		}
+	}
+
+	if _, err := SocketCookie(0).MarshalText(); err == nil {
+		t.Error("Marshaling the zero cookie doesn't return an error")
+	}
+
+	for _, text := range []string{"", "4001", "sk:", "sk:-", "sk:0", "sk:xyz", "sk:10000000000000000"} {
+		var cookie SocketCookie
+		if err := cookie.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("Accepted %q", text)
+		}
+	}
+}
+
 func TestRegisterUnixSocket(t *testing.T) {
 	netns := testutil.NewNetNS(t)
 	dp := mustCreateDispatcher(t, netns)
@@ -905,6 +1304,59 @@ func TestMetrics(t *testing.T) {
 	}
 }
 
+func TestSocketQueues(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	ln := testutil.Listen(t, netns, "tcp4", "127.0.0.1:0").(*net.TCPListener)
+	tcp := mustRegisterSocket(t, dp, "foo", ln)
+
+	conn := testutil.Listen(t, netns, "udp6", "[::1]:0").(*net.UDPConn)
+	udp := mustRegisterSocket(t, dp, "bar", conn)
+
+	const numConns = 2
+	testutil.JoinNetNS(t, netns, func() error {
+		for i := 0; i < numConns; i++ {
+			c, err := net.Dial("tcp4", ln.Addr().String())
+			if err != nil {
+				return err
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+
+		c, err := net.Dial("udp6", conn.LocalAddr().String())
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		_, err = c.Write([]byte("foo"))
+		return err
+	})
+
+	var queues map[Destination]SocketQueue
+	testutil.JoinNetNS(t, netns, func() (err error) {
+		queues, err = dp.SocketQueues()
+		return
+	})
+
+	if len(queues) != 2 {
+		t.Fatal("Expected two socket queues, got", len(queues))
+	}
+
+	if q := queues[*tcp]; q.Length != numConns {
+		t.Errorf("Expected %d connections in accept queue, got %d", numConns, q.Length)
+	} else if q.Limit == 0 {
+		t.Error("Expected non-zero accept backlog")
+	}
+
+	if q := queues[*udp]; q.Length == 0 {
+		t.Error("Expected non-empty receive queue")
+	} else if q.Limit == 0 {
+		t.Error("Expected non-zero receive buffer")
+	}
+}
+
 func TestBindingPrecedence(t *testing.T) {
 	netns := testutil.NewNetNS(t, "1.2.3.0/24", "4.3.2.0/24")
 	dp := mustCreateDispatcher(t, netns)
@@ -1124,12 +1576,23 @@ func mustRegisterSocket(tb testing.TB, dp *Dispatcher, label string, conn syscal
 	return dest
 }
 
+func mustRegisteredCookie(tb testing.TB, dp *Dispatcher, dest *Destination) SocketCookie {
+	tb.Helper()
+
+	_, cookies, err := dp.Destinations()
+	if err != nil {
+		tb.Fatal("Destinations:", err)
+	}
+
+	return cookies[*dest]
+}
+
 func mustCreateDispatcher(tb testing.TB, netns ns.NetNS) *Dispatcher {
 	tb.Helper()
 
 	var dp *Dispatcher
 	err := testutil.WithCapabilities(func() (err error) {
-		dp, err = CreateDispatcher(netns.Path(), "/sys/fs/bpf")
+		dp, err = CreateDispatcher(netns.Path(), "/sys/fs/bpf", "test")
 		return
 	}, CreateCapabilities...)
 	if err != nil {
@@ -0,0 +1,133 @@
+// Package fdpass implements the protocol used to register a socket with a
+// server by passing it via SCM_RIGHTS.
+//
+// A client connects to the server using a SOCK_SEQPACKET unix socket and
+// sends a single Request with the socket attached. The server answers with
+// a single Response.
+package fdpass
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular/internal/sysconn"
+
+	"golang.org/x/sys/unix"
+)
+
+// Network is the network to use with net.Dial and net.Listen.
+const Network = "unixpacket"
+
+const maxMessageSize = 4096
+
+// Request asks the server to register the attached socket.
+type Request struct {
+	Label string `json:"label"`
+}
+
+// Response is the result of registering a socket.
+type Response struct {
+	Destination *internal.Destination `json:"destination,omitempty"`
+	Cookie      internal.SocketCookie `json:"cookie,omitempty"`
+	Created     bool                  `json:"created,omitempty"`
+	Error       string                `json:"error,omitempty"`
+	// Denied is true if the client isn't allowed to register the label.
+	Denied bool `json:"denied,omitempty"`
+}
+
+// WriteRequest sends req together with conn.
+func WriteRequest(uc *net.UnixConn, req *Request, conn syscall.Conn) error {
+	msg, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	return sysconn.Control(conn, func(fd int) error {
+		_, _, err := uc.WriteMsgUnix(msg, unix.UnixRights(fd), nil)
+		return err
+	})
+}
+
+// ReadRequest receives a request and the attached file.
+//
+// The caller must close the file.
+func ReadRequest(uc *net.UnixConn) (*Request, *os.File, error) {
+	msg := make([]byte, maxMessageSize)
+	// Leave room for additional fds so that they can be closed.
+	oob := make([]byte, unix.CmsgSpace(4*4))
+
+	n, oobn, flags, _, err := uc.ReadMsgUnix(msg, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var fds []int
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse control message: %s", err)
+	}
+	for _, cmsg := range msgs {
+		rights, err := unix.ParseUnixRights(&cmsg)
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+
+	closeFds := func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}
+
+	switch {
+	case flags&(unix.MSG_TRUNC|unix.MSG_CTRUNC) != 0:
+		closeFds()
+		return nil, nil, errors.New("message is truncated")
+	case len(fds) != 1:
+		closeFds()
+		return nil, nil, fmt.Errorf("expected one file descriptor, got %d", len(fds))
+	}
+
+	file := os.NewFile(uintptr(fds[0]), "fd")
+
+	var req Request
+	if err := json.Unmarshal(msg[:n], &req); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("decode request: %s", err)
+	}
+
+	return &req, file, nil
+}
+
+// WriteResponse sends resp.
+func WriteResponse(uc *net.UnixConn, resp *Response) error {
+	msg, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	_, err = uc.Write(msg)
+	return err
+}
+
+// ReadResponse receives a response.
+func ReadResponse(uc *net.UnixConn) (*Response, error) {
+	msg := make([]byte, maxMessageSize)
+	n, err := uc.Read(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp Response
+	if err := json.Unmarshal(msg[:n], &resp); err != nil {
+		return nil, fmt.Errorf("decode response: %s", err)
+	}
+
+	return &resp, nil
+}
@@ -0,0 +1,118 @@
+package fdpass
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRequest(t *testing.T) {
+	client, server := mustSocketPair(t)
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if err := WriteRequest(client, &Request{"foo"}, ln.(*net.TCPListener)); err != nil {
+		t.Fatal("Write request:", err)
+	}
+
+	req, file, err := ReadRequest(server)
+	if err != nil {
+		t.Fatal("Read request:", err)
+	}
+	defer file.Close()
+
+	if req.Label != "foo" {
+		t.Error("Expected label foo, got", req.Label)
+	}
+
+	var want, have unix.Stat_t
+	if err := unix.Fstat(int(file.Fd()), &have); err != nil {
+		t.Fatal(err)
+	}
+
+	lnFile, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lnFile.Close()
+
+	if err := unix.Fstat(int(lnFile.Fd()), &want); err != nil {
+		t.Fatal(err)
+	}
+
+	if want.Ino != have.Ino {
+		t.Error("Received file doesn't refer to the listener")
+	}
+}
+
+func TestRequestWithoutFile(t *testing.T) {
+	client, server := mustSocketPair(t)
+
+	if _, err := client.Write([]byte(`{"label":"foo"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ReadRequest(server); err == nil {
+		t.Fatal("Accepted request without file descriptor")
+	}
+}
+
+func TestResponse(t *testing.T) {
+	client, server := mustSocketPair(t)
+
+	if err := WriteResponse(server, &Response{Cookie: 42, Created: true}); err != nil {
+		t.Fatal("Write response:", err)
+	}
+
+	resp, err := ReadResponse(client)
+	if err != nil {
+		t.Fatal("Read response:", err)
+	}
+
+	if resp.Cookie != 42 || !resp.Created {
+		t.Errorf("Response doesn't match: %+v", resp)
+	}
+
+	// The cookie is omitted from responses without a socket.
+	if err := WriteResponse(server, &Response{Error: "foo"}); err != nil {
+		t.Fatal("Write response:", err)
+	}
+
+	resp, err = ReadResponse(client)
+	if err != nil {
+		t.Fatal("Read response:", err)
+	}
+
+	if resp.Cookie != 0 || resp.Error != "foo" {
+		t.Errorf("Response doesn't match: %+v", resp)
+	}
+}
+
+func mustSocketPair(tb testing.TB) (client, server *net.UnixConn) {
+	tb.Helper()
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(file)
+		file.Close()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() { conn.Close() })
+		conns[i] = conn.(*net.UnixConn)
+	}
+
+	return conns[0], conns[1]
+}
@@ -3,7 +3,10 @@ package internal
 import (
 	"fmt"
 	"path/filepath"
+	"runtime"
+	"unsafe"
 
+	"github.com/cilium/ebpf/link"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"golang.org/x/sys/unix"
 )
@@ -32,6 +35,55 @@ func openNetNS(path, bpfFsPath string) (ns.NetNS, string, error) {
 	return ns, filepath.Join(bpfFsPath, dir), nil
 }
 
-func linkPath(base string) string           { return filepath.Join(base, "link") }
-func programPath(base string) string        { return filepath.Join(base, "program") }
-func programUpgradePath(base string) string { return filepath.Join(base, "program-upgrade") }
+// inNetNS executes fn in the network namespace at path.
+//
+// fn is invoked directly if the current thread already is a member of the
+// namespace. Otherwise, entering the namespace requires CAP_SYS_ADMIN.
+func inNetNS(path string, fn func() error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	target, err := ns.GetNS(path)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	current, err := ns.GetCurrentNS()
+	if err != nil {
+		return err
+	}
+	defer current.Close()
+
+	var targetStat, currentStat unix.Stat_t
+	if err := unix.Fstat(int(target.Fd()), &targetStat); err != nil {
+		return fmt.Errorf("stat netns: %s", err)
+	}
+	if err := unix.Fstat(int(current.Fd()), &currentStat); err != nil {
+		return fmt.Errorf("stat current netns: %s", err)
+	}
+
+	if targetStat.Dev == currentStat.Dev && targetStat.Ino == currentStat.Ino {
+		return fn()
+	}
+
+	return target.Do(func(ns.NetNS) error { return fn() })
+}
+
+// detachLink forcefully detaches a link via BPF_LINK_DETACH.
+func detachLink(l *link.NetNsLink) error {
+	const bpfLinkDetach = 34 // BPF_LINK_DETACH
+
+	attr := struct{ LinkFD uint32 }{uint32(l.FD())}
+	_, _, errno := unix.Syscall(unix.SYS_BPF, bpfLinkDetach, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	runtime.KeepAlive(l)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func linkPath(base string) string            { return filepath.Join(base, "link") }
+func programPath(base string) string         { return filepath.Join(base, "program") }
+func programUpgradePath(base string) string  { return filepath.Join(base, "program-upgrade") }
+func programPreviousPath(base string) string { return filepath.Join(base, "program-previous") }
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// bindingOwnersSpec describes a map from binding to the owner of the binding.
+//
+// The map isn't used by the BPF program, it's created from user space.
+var bindingOwnersSpec = &ebpf.MapSpec{
+	Name:      "binding_owners",
+	Type:      ebpf.Hash,
+	KeySize:   uint32(binary.Size(bindingKey{})),
+	ValueSize: uint32(binary.Size(label{})),
+	Flags:     unix.BPF_F_NO_PREALLOC,
+	Pinning:   ebpf.PinByName,
+}
+
+func newOwner(owner string) (*label, error) {
+	var lbl label
+	if strings.ContainsRune(owner, 0) {
+		return nil, fmt.Errorf("owner contains null byte")
+	}
+	if max := len(lbl); len(owner) > max {
+		return nil, fmt.Errorf("owner exceeds maximum length of %d bytes", max)
+	}
+
+	copy(lbl[:], owner)
+	return &lbl, nil
+}
+
+// createBindingOwners creates and pins the binding owner map, unless it
+// already exists.
+//
+// Creating maps requires privileges, so this happens when the dispatcher is
+// created or upgraded.
+func createBindingOwners(pinPath string, maxEntries uint32) error {
+	spec := bindingOwnersSpec.Copy()
+	spec.MaxEntries = maxEntries
+	owners, err := ebpf.NewMapWithOptions(spec, ebpf.MapOptions{PinPath: pinPath})
+	if err != nil {
+		return fmt.Errorf("create binding owners: %s", err)
+	}
+	return owners.Close()
+}
+
+// openBindingOwners opens the binding owner map.
+//
+// Returns a nil map if the map doesn't exist, which happens if the dispatcher
+// was created by an older version and hasn't been upgraded.
+func (d *Dispatcher) openBindingOwners(readOnly bool) (*ebpf.Map, error) {
+	path := filepath.Join(d.Path, bindingOwnersSpec.Name)
+	owners, err := ebpf.LoadPinnedMap(path, &ebpf.LoadPinOptions{ReadOnly: readOnly})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("load binding owners: %s", err)
+	}
+	return owners, nil
+}
+
+// setBindingOwner records the owner of a binding. An empty owner removes
+// any previous owner.
+func (d *Dispatcher) setBindingOwner(key *bindingKey, owner string) error {
+	value, err := newOwner(owner)
+	if err != nil {
+		return err
+	}
+
+	owners, err := d.openBindingOwners(false)
+	if err != nil {
+		return err
+	}
+	if owners == nil && owner != "" {
+		return fmt.Errorf("dispatcher doesn't support owners, upgrade it first")
+	} else if owners == nil {
+		return nil
+	}
+	defer owners.Close()
+
+	if owner == "" {
+		err := owners.Delete(key)
+		if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("delete owner: %s", err)
+		}
+		return nil
+	}
+
+	if err := owners.Put(key, value); err != nil {
+		return fmt.Errorf("set owner: %s", err)
+	}
+	return nil
+}
+
+// bindingOwners returns the owners of all bindings which have one.
+func (d *Dispatcher) bindingOwners() (map[bindingKey]string, error) {
+	owners, err := d.openBindingOwners(true)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[bindingKey]string)
+	if owners == nil {
+		return result, nil
+	}
+	defer owners.Close()
+
+	var (
+		key   bindingKey
+		value label
+		iter  = owners.Iterate()
+	)
+	for iter.Next(&key, &value) {
+		result[key] = value.String()
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("iterate binding owners: %s", err)
+	}
+
+	return result, nil
+}
@@ -1,62 +1,352 @@
 package pidfd
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cloudflare/tubular/internal/sysconn"
 
 	"golang.org/x/sys/unix"
 )
 
+// ErrProcessExited is returned if the target process exits while waiting
+// for files.
+var ErrProcessExited = errors.New("process exited")
+
+// ErrNoFiles is returned by Signal if none of the files of the target
+// process match.
+var ErrNoFiles = errors.New("no matching files")
+
+// Fd is an open file of another process.
+type Fd struct {
+	// The file descriptor in the other process.
+	Number int
+	// A duplicate of the file descriptor in this process.
+	File *os.File
+}
+
 // Files enumerates all open files of another process.
 //
-// filter controls which files will be returned.
-func Files(pid int, ps ...sysconn.Predicate) (files []*os.File, err error) {
-	const maxFDGap = 32
+// filter controls which files will be returned. If some file descriptors
+// can't be examined, the matching files are returned together with an
+// *FdError. The caller must close the returned files in either case.
+func Files(pid int, ps ...sysconn.Predicate) ([]*os.File, error) {
+	fds, err := Fds(pid, ps...)
+	return fdFiles(fds), err
+}
+
+func fdFiles(fds []Fd) []*os.File {
+	var files []*os.File
+	for _, fd := range fds {
+		files = append(files, fd.File)
+	}
+	return files
+}
+
+// Fds is like Files, except that it also returns the file descriptor
+// numbers in the other process.
+func Fds(pid int, ps ...sysconn.Predicate) ([]Fd, error) {
+	pidfd, err := open(pid)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(pidfd)
+
+	return pidfdFds(pid, pidfd, ps...)
+}
+
+// WaitFiles is like Files, except that it waits until at least one file
+// matches or some file descriptors can't be examined.
+//
+// The process is polled at interval until ctx is done. Returns
+// ErrProcessExited if the process exits in the meantime.
+func WaitFiles(ctx context.Context, pid int, interval time.Duration, ps ...sysconn.Predicate) ([]*os.File, error) {
+	pidfd, err := open(pid)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(pidfd)
+
+	for {
+		fds, err := pidfdFds(pid, pidfd, ps...)
+		if errors.Is(err, unix.ESRCH) {
+			return nil, ErrProcessExited
+		} else if err != nil || len(fds) > 0 {
+			return fdFiles(fds), err
+		}
 
-	defer func() {
+		timeout := interval
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+			timeout = time.Until(deadline)
+		}
+
+		// A pidfd becomes readable once the process exits.
+		exited, err := pollReadable(pidfd, timeout)
 		if err != nil {
-			for _, file := range files {
-				file.Close()
-			}
+			return nil, err
+		} else if exited {
+			return nil, ErrProcessExited
 		}
-	}()
 
-	if pid == 0 || pid == os.Getpid() {
-		// Retrieving files from the current process makes the loop below
-		// never finish.
-		return nil, fmt.Errorf("can't retrieve files from the same process")
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 	}
+}
 
-	pidfd, err := unix.PidfdOpen(pid, 0)
+// Signal sends sig to a process, but only if at least one of its files
+// matches.
+//
+// Unlike kill(2) this can't signal an unrelated process if pid is reused,
+// provided that the files identify the process.
+func Signal(pid int, sig unix.Signal, ps ...sysconn.Predicate) error {
+	pidfd, err := open(pid)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer unix.Close(pidfd)
 
-	for i, gap := 0, 0; i < int(^uint(0)>>1) && gap < maxFDGap; i++ {
+	fds, err := pidfdFds(pid, pidfd, ps...)
+	for _, fd := range fds {
+		fd.File.Close()
+	}
+
+	// Files which couldn't be examined don't matter if others match.
+	var fe *FdError
+	if errors.As(err, &fe) && len(fds) > 0 {
+		err = nil
+	}
+
+	if err != nil {
+		return err
+	} else if len(fds) == 0 {
+		return ErrNoFiles
+	}
+
+	_, _, errno := unix.Syscall6(unix.SYS_PIDFD_SEND_SIGNAL, uintptr(pidfd), uintptr(sig), 0, 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("pidfd_send_signal: %w", errno)
+	}
+
+	return nil
+}
+
+func open(pid int) (int, error) {
+	if pid == 0 || pid == os.Getpid() {
+		// Retrieving files from the current process creates new fds
+		// while enumerating them.
+		return -1, fmt.Errorf("can't retrieve files from the same process")
+	}
+
+	return unix.PidfdOpen(pid, 0)
+}
+
+// FdError is returned if some file descriptors of a process couldn't be
+// examined. The file descriptors which were examined and matched are
+// returned alongside it.
+type FdError struct {
+	// Errors by file descriptor number.
+	Fds map[int]error
+	// Number of file descriptors which weren't examined since the process
+	// has more than maxFds. Without procfs this counts the unexamined
+	// numbers below RLIMIT_NOFILE, which may not all be open.
+	Remaining int
+}
+
+func (fe *FdError) Error() string {
+	var skipped []string
+	for _, fd := range fe.sortedFds() {
+		skipped = append(skipped, fmt.Sprintf("%d (%s)", fd, fe.Fds[fd]))
+	}
+
+	if fe.Remaining > 0 {
+		skipped = append(skipped, fmt.Sprintf("%d above the limit of %d", fe.Remaining, maxFds))
+	}
+
+	return "skipped fds: " + strings.Join(skipped, ", ")
+}
+
+// Unwrap returns the error for the lowest file descriptor.
+func (fe *FdError) Unwrap() error {
+	if fds := fe.sortedFds(); len(fds) > 0 {
+		return fe.Fds[fds[0]]
+	}
+	return nil
+}
+
+func (fe *FdError) sortedFds() []int {
+	fds := make([]int, 0, len(fe.Fds))
+	for fd := range fe.Fds {
+		fds = append(fds, fd)
+	}
+	sort.Ints(fds)
+	return fds
+}
+
+// maxFds limits how many file descriptors are examined per process.
+var maxFds = 1 << 16
+
+// procPath is where procfs is mounted.
+var procPath = "/proc"
+
+// pidfdFds returns the matching fds of a process. If some fds were skipped
+// it returns the matching ones together with an *FdError.
+func pidfdFds(pid, pidfd int, ps ...sysconn.Predicate) ([]Fd, error) {
+	numbers, err := procFds(pid, pidfd)
+	if errors.Is(err, os.ErrNotExist) {
+		numbers = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var (
+		skipped   = make(map[int]error)
+		remaining int
+	)
+
+	if numbers != nil {
+		if len(numbers) > maxFds {
+			remaining = len(numbers) - maxFds
+			numbers = numbers[:maxFds]
+		}
+	} else {
+		numbers, remaining, err = guessFds(pid, pidfd)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var fds []Fd
+	for _, i := range numbers {
 		target, err := unix.PidfdGetfd(pidfd, i, 0)
 		if errors.Is(err, unix.EBADF) {
-			gap++
+			// The fd was closed in the meantime.
+			continue
+		} else if errors.Is(err, unix.ESRCH) {
+			for _, fd := range fds {
+				fd.File.Close()
+			}
+			return nil, fmt.Errorf("target fd %d: %w", i, err)
+		} else if err != nil {
+			skipped[i] = err
 			continue
 		}
-		if err != nil {
-			return nil, fmt.Errorf("target fd %d: %s", i, err)
-		}
-		gap = 0
 
 		keep, err := sysconn.FilterFd(target, ps...)
 		if err != nil {
 			unix.Close(target)
-			return nil, fmt.Errorf("target fd %d: %w", i, err)
+			skipped[i] = err
 		} else if keep {
-			files = append(files, os.NewFile(uintptr(target), ""))
+			fds = append(fds, Fd{i, os.NewFile(uintptr(target), "")})
 		} else {
 			unix.Close(target)
 		}
 	}
 
-	return files, nil
+	if len(skipped) > 0 || remaining > 0 {
+		return fds, &FdError{skipped, remaining}
+	}
+
+	return fds, nil
+}
+
+// procFds lists the file descriptors of a process via procfs.
+//
+// Returns an error wrapping os.ErrNotExist if procfs isn't available.
+func procFds(pid, pidfd int) ([]int, error) {
+	names, err := readDirNames(filepath.Join(procPath, strconv.Itoa(pid), "fd"))
+	if err != nil {
+		return nil, err
+	}
+
+	// The pid might have been reused by the time the directory was read.
+	// The pidfd refers to the original process, so make sure it's still
+	// alive.
+	if exited, err := pollReadable(pidfd, 0); err != nil {
+		return nil, err
+	} else if exited {
+		return nil, unix.ESRCH
+	}
+
+	numbers := make([]int, 0, len(names))
+	for _, name := range names {
+		fd, err := strconv.Atoi(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fd %q in procfs", name)
+		}
+		numbers = append(numbers, fd)
+	}
+
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+func readDirNames(path string) ([]string, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	return dir.Readdirnames(-1)
+}
+
+// guessFds returns candidate file descriptors of a process if procfs isn't
+// available.
+//
+// All fds below the process' RLIMIT_NOFILE are candidates, but at most maxFds.
+// remaining is the number of candidates above maxFds.
+func guessFds(pid, pidfd int) (numbers []int, remaining int, _ error) {
+	var limit unix.Rlimit
+	if err := unix.Prlimit(pid, unix.RLIMIT_NOFILE, nil, &limit); err != nil {
+		return nil, 0, fmt.Errorf("get file limit: %w", err)
+	}
+
+	// Prlimit uses the pid, check that it still refers to the same process.
+	if exited, err := pollReadable(pidfd, 0); err != nil {
+		return nil, 0, err
+	} else if exited {
+		return nil, 0, unix.ESRCH
+	}
+
+	n := maxFds
+	if limit.Cur < uint64(n) {
+		n = int(limit.Cur)
+	} else if excess := limit.Cur - uint64(n); excess > math.MaxInt32 {
+		// File descriptors are ints, so this covers RLIM_INFINITY.
+		remaining = math.MaxInt32
+	} else {
+		remaining = int(excess)
+	}
+
+	numbers = make([]int, n)
+	for i := range numbers {
+		numbers[i] = i
+	}
+	return numbers, remaining, nil
+}
+
+func pollReadable(fd int, timeout time.Duration) (bool, error) {
+	if timeout < 0 {
+		timeout = 0
+	}
+
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		n, err := unix.Poll(fds, int(timeout.Milliseconds()))
+		if errors.Is(err, unix.EINTR) {
+			continue
+		} else if err != nil {
+			return false, fmt.Errorf("poll: %w", err)
+		}
+		return n > 0, nil
+	}
 }
@@ -1,9 +1,17 @@
 package pidfd
 
 import (
+	"context"
+	"errors"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/cloudflare/tubular/internal/testutil"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"golang.org/x/sys/unix"
 )
 
 func TestFiles(t *testing.T) {
@@ -28,3 +36,213 @@ func TestFiles(t *testing.T) {
 		t.Errorf("Expected %d files, got %d", want, len(files))
 	}
 }
+
+func TestFds(t *testing.T) {
+	child := testutil.SpawnChildWithFiles(t, testutil.OpenFiles(t, 2)...)
+
+	fds, err := Fds(child, func(fd int) (bool, error) { return true, nil })
+	if err != nil {
+		t.Fatal("Can't get fds of child process:", err)
+	}
+
+	var numbers []int
+	for _, fd := range fds {
+		fd.File.Close()
+		numbers = append(numbers, fd.Number)
+	}
+
+	if diff := cmp.Diff([]int{0, 1, 2, 3, 4}, numbers); diff != "" {
+		t.Errorf("Fd numbers don't match (-want +got):\n%s", diff)
+	}
+}
+
+func TestFdsSparse(t *testing.T) {
+	// Leave a gap that is larger than typical heuristics.
+	files := make([]*os.File, 200)
+	files[len(files)-1] = testutil.OpenFiles(t, 1)[0]
+	child := testutil.SpawnChildWithFiles(t, files...)
+
+	all := func(int) (bool, error) { return true, nil }
+	check := func(t *testing.T) {
+		t.Helper()
+
+		fds, err := Fds(child, all)
+		var fe *FdError
+		if errors.As(err, &fe) && len(fe.Fds) == 0 {
+			// RLIMIT_NOFILE is above maxFds, which doesn't matter here.
+			err = nil
+		}
+		if err != nil {
+			t.Fatal("Can't get fds of child process:", err)
+		}
+
+		var numbers []int
+		for _, fd := range fds {
+			fd.File.Close()
+			numbers = append(numbers, fd.Number)
+		}
+
+		if diff := cmp.Diff([]int{0, 1, 2, 3 + len(files) - 1}, numbers); diff != "" {
+			t.Errorf("Fd numbers don't match (-want +got):\n%s", diff)
+		}
+	}
+
+	t.Run("procfs", check)
+	t.Run("no procfs", func(t *testing.T) {
+		defer func(path string) { procPath = path }(procPath)
+		procPath = t.TempDir()
+		check(t)
+	})
+}
+
+func TestFdsErrors(t *testing.T) {
+	child := testutil.SpawnChildWithFiles(t, testutil.OpenFiles(t, 2)...)
+
+	defer func(limit int) { maxFds = limit }(maxFds)
+	maxFds = 4
+
+	var count int
+	fds, err := Fds(child, func(fd int) (bool, error) {
+		count++
+		if count == 2 {
+			return false, unix.EINVAL
+		}
+		return true, nil
+	})
+	for _, fd := range fds {
+		fd.File.Close()
+	}
+
+	var numbers []int
+	for _, fd := range fds {
+		numbers = append(numbers, fd.Number)
+	}
+	if diff := cmp.Diff([]int{0, 2, 3}, numbers); diff != "" {
+		t.Errorf("Matching fds aren't returned (-want +got):\n%s", diff)
+	}
+
+	var fe *FdError
+	if !errors.As(err, &fe) {
+		t.Fatal("Expected FdError, got", err)
+	}
+
+	if diff := cmp.Diff(map[int]error{1: unix.EINVAL}, fe.Fds, cmpopts.EquateErrors()); diff != "" {
+		t.Errorf("Skipped fds don't match (-want +got):\n%s", diff)
+	}
+
+	if fe.Remaining != 1 {
+		t.Error("Expected one remaining fd, got", fe.Remaining)
+	}
+
+	if !errors.Is(err, unix.EINVAL) {
+		t.Error("FdError doesn't wrap the error of the first fd")
+	}
+}
+
+func TestFdsErrorsNoProcfs(t *testing.T) {
+	child := testutil.SpawnChildWithFiles(t)
+
+	var limit unix.Rlimit
+	if err := unix.Prlimit(child, unix.RLIMIT_NOFILE, nil, &limit); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(path string) { procPath = path }(procPath)
+	procPath = t.TempDir()
+
+	defer func(limit int) { maxFds = limit }(maxFds)
+	maxFds = 2
+
+	fds, err := Fds(child, func(int) (bool, error) { return true, nil })
+	for _, fd := range fds {
+		fd.File.Close()
+	}
+
+	var fe *FdError
+	if !errors.As(err, &fe) {
+		t.Fatal("Expected FdError, got", err)
+	}
+
+	if want := int(limit.Cur) - maxFds; fe.Remaining != want {
+		t.Errorf("Expected %d remaining fds, got %d", want, fe.Remaining)
+	}
+}
+
+func TestWaitFiles(t *testing.T) {
+	child := testutil.SpawnChildWithFiles(t, testutil.OpenFiles(t, 1)...)
+
+	var count int
+	files, err := WaitFiles(context.Background(), child, time.Millisecond, func(fd int) (bool, error) {
+		count++
+		// Only match on the second pass.
+		return count > 4, nil
+	})
+	if err != nil {
+		t.Fatal("Can't wait for files:", err)
+	}
+	for _, file := range files {
+		file.Close()
+	}
+	if len(files) == 0 {
+		t.Error("Expected files")
+	}
+
+	none := func(int) (bool, error) { return false, nil }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := WaitFiles(ctx, child, 10*time.Millisecond, none); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected deadline exceeded, got", err)
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() { unix.Kill(child, unix.SIGKILL) })
+	start := time.Now()
+	_, err = WaitFiles(context.Background(), child, time.Minute, none)
+	if !errors.Is(err, ErrProcessExited) {
+		t.Error("Expected ErrProcessExited, got", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Error("Process exit wasn't detected promptly")
+	}
+}
+
+func TestSignal(t *testing.T) {
+	child := testutil.SpawnChildWithFiles(t)
+
+	none := func(int) (bool, error) { return false, nil }
+	if err := Signal(child, unix.SIGKILL, none); !errors.Is(err, ErrNoFiles) {
+		t.Fatal("Expected ErrNoFiles, got", err)
+	}
+
+	if err := unix.Kill(child, 0); err != nil {
+		t.Fatal("Process was signalled without matching files:", err)
+	}
+
+	failing := func(int) (bool, error) { return false, unix.EINVAL }
+	var fe *FdError
+	if err := Signal(child, unix.SIGKILL, failing); !errors.As(err, &fe) {
+		t.Fatal("Expected FdError, got", err)
+	}
+
+	// A file which can't be examined doesn't prevent the signal if
+	// another one matches.
+	var count int
+	some := func(int) (bool, error) {
+		count++
+		if count == 1 {
+			return false, unix.EINVAL
+		}
+		return true, nil
+	}
+	if err := Signal(child, unix.SIGKILL, some); err != nil {
+		t.Fatal("Can't signal process:", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for unix.Kill(child, 0) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Process didn't exit")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
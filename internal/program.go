@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cilium/ebpf"
+)
+
+const programVersionSize = 64
+
+// programVersionsSpec describes a map from program ID to the version of
+// tubular which loaded the program.
+//
+// The map isn't used by the BPF program, it's created from user space.
+var programVersionsSpec = &ebpf.MapSpec{
+	Name:       "program_versions",
+	Type:       ebpf.Hash,
+	KeySize:    4,
+	ValueSize:  programVersionSize,
+	MaxEntries: 8,
+	Pinning:    ebpf.PinByName,
+}
+
+// LoadedProgram describes a dispatcher program pinned in the state directory.
+type LoadedProgram struct {
+	ID  ebpf.ProgramID
+	Tag string
+	// The version of tubular which loaded the program. Empty if unknown.
+	Version string
+}
+
+func (lp *LoadedProgram) String() string {
+	version := lp.Version
+	if version == "" {
+		version = "unknown"
+	}
+	return fmt.Sprintf("#%d (tag %s, version %s)", lp.ID, lp.Tag, version)
+}
+
+// Programs returns the active and the previous dispatcher program.
+//
+// previous is nil if the dispatcher hasn't been upgraded.
+func (d *Dispatcher) Programs() (current, previous *LoadedProgram, err error) {
+	versions, err := openProgramVersions(d.Path, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if versions != nil {
+		defer versions.Close()
+	}
+
+	current, err = loadedProgram(programPath(d.Path), versions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("current program: %w", err)
+	}
+
+	previous, err = loadedProgram(programPreviousPath(d.Path), versions)
+	if errors.Is(err, os.ErrNotExist) {
+		return current, nil, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("previous program: %w", err)
+	}
+
+	return current, previous, nil
+}
+
+func loadedProgram(path string, versions *ebpf.Map) (*LoadedProgram, error) {
+	prog, err := ebpf.LoadPinnedProgram(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer prog.Close()
+
+	info, err := prog.Info()
+	if err != nil {
+		return nil, fmt.Errorf("get program info: %s", err)
+	}
+
+	id, _ := info.ID()
+	version, err := programVersion(versions, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoadedProgram{id, info.Tag, version}, nil
+}
+
+// openProgramVersions opens or creates the program version map.
+//
+// Returns a nil map if readOnly is true and the map doesn't exist.
+func openProgramVersions(pinPath string, readOnly bool) (*ebpf.Map, error) {
+	if readOnly {
+		path := filepath.Join(pinPath, programVersionsSpec.Name)
+		versions, err := ebpf.LoadPinnedMap(path, &ebpf.LoadPinOptions{ReadOnly: true})
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("load program versions: %s", err)
+		}
+		return versions, nil
+	}
+
+	versions, err := ebpf.NewMapWithOptions(programVersionsSpec.Copy(), ebpf.MapOptions{PinPath: pinPath})
+	if err != nil {
+		return nil, fmt.Errorf("create program versions: %s", err)
+	}
+	return versions, nil
+}
+
+func setProgramVersion(versions *ebpf.Map, id ebpf.ProgramID, version string) error {
+	var value [programVersionSize]byte
+	copy(value[:], version)
+
+	if err := versions.Put(uint32(id), value); err != nil {
+		return fmt.Errorf("set version of program #%d: %s", id, err)
+	}
+	return nil
+}
+
+func programVersion(versions *ebpf.Map, id ebpf.ProgramID) (string, error) {
+	if versions == nil {
+		return "", nil
+	}
+
+	var value [programVersionSize]byte
+	err := versions.Lookup(uint32(id), &value)
+	if errors.Is(err, ebpf.ErrKeyNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("get version of program #%d: %s", id, err)
+	}
+
+	return string(bytes.TrimRight(value[:], "\x00")), nil
+}
+
+// pruneProgramVersions removes the version of all programs not in keep.
+func pruneProgramVersions(versions *ebpf.Map, keep ...ebpf.ProgramID) error {
+	var (
+		id    uint32
+		value [programVersionSize]byte
+		stale []uint32
+		iter  = versions.Iterate()
+	)
+outer:
+	for iter.Next(&id, &value) {
+		for _, keepID := range keep {
+			if ebpf.ProgramID(id) == keepID {
+				continue outer
+			}
+		}
+		stale = append(stale, id)
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("iterate program versions: %s", err)
+	}
+
+	for _, id := range stale {
+		if err := versions.Delete(id); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("delete version of program #%d: %s", id, err)
+		}
+	}
+
+	return nil
+}
+
+func programID(prog *ebpf.Program) (ebpf.ProgramID, error) {
+	info, err := prog.Info()
+	if err != nil {
+		return 0, fmt.Errorf("get program info: %s", err)
+	}
+
+	id, _ := info.ID()
+	return id, nil
+}
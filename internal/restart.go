@@ -0,0 +1,299 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/tubular/internal/pidfd"
+	"github.com/cloudflare/tubular/internal/sysconn"
+
+	"golang.org/x/sys/unix"
+)
+
+// Takeover registers conns under label in place of the sockets of a previous
+// instance of a server, and then asks the previous instance to stop by
+// sending it SIGTERM.
+//
+// The previous instance is found via pidFile, which is updated to contain the
+// pid of the calling process. It's only signalled if it still holds one of
+// the replaced sockets, which guards against the pid having been reused.
+// This requires the same privileges as pidfd_getfd(2).
+//
+// If a socket can't be registered, the sockets which were registered before
+// it are removed again and the sockets of the previous instance are restored
+// by duplicating them from the previous instance. Sockets which can't be
+// restored remain replaced and are listed by the returned *TakeoverError.
+// The pid file isn't changed and the previous instance isn't signalled in
+// that case, so calling Takeover again completes the takeover.
+//
+// dp must be opened read-write. Returns the pid of the signalled instance, or
+// zero if there was none.
+func Takeover(dp *Dispatcher, pidFile, label string, conns ...syscall.Conn) (int, error) {
+	if len(conns) == 0 {
+		return 0, fmt.Errorf("takeover: no sockets")
+	}
+
+	dests := make([]*Destination, 0, len(conns))
+	seen := make(map[Destination]bool)
+	for _, conn := range conns {
+		dest, err := newDestinationFromConn(label, conn)
+		if err != nil {
+			return 0, fmt.Errorf("takeover: %w", err)
+		}
+
+		if seen[*dest] {
+			return 0, fmt.Errorf("takeover: multiple sockets for destination %s", dest)
+		}
+		seen[*dest] = true
+
+		dests = append(dests, dest)
+	}
+
+	previous, err := readPIDFile(pidFile)
+	if err != nil {
+		return 0, fmt.Errorf("takeover: %s", err)
+	}
+
+	_, current, err := dp.Destinations()
+	if err != nil {
+		return 0, fmt.Errorf("takeover: %s", err)
+	}
+
+	// The dispatcher is locked, so the cookies can't change until the sockets
+	// are replaced.
+	replaced := make(map[uint64]bool)
+	var done []takeoverStep
+	for i, conn := range conns {
+		cookie, err := socketCookie(conn)
+		if err != nil {
+			err = fmt.Errorf("takeover %s: %w", dests[i], err)
+			return 0, rollbackTakeover(dp, previous, label, done, err)
+		}
+
+		old := current[*dests[i]]
+		if old == 0 {
+			_, _, err = dp.RegisterSocket(label, conn)
+		} else {
+			_, err = dp.ReplaceSocket(label, conn, old)
+		}
+		if err != nil {
+			err = fmt.Errorf("takeover %s: %w", dests[i], err)
+			return 0, rollbackTakeover(dp, previous, label, done, err)
+		}
+
+		if old != 0 {
+			replaced[uint64(old)] = true
+		}
+		done = append(done, takeoverStep{dests[i], old, cookie})
+	}
+
+	if err := writePIDFile(pidFile, os.Getpid()); err != nil {
+		return 0, fmt.Errorf("takeover: %s", err)
+	}
+
+	if previous == 0 || previous == os.Getpid() || len(replaced) == 0 {
+		return 0, nil
+	}
+
+	err = pidfd.Signal(previous, unix.SIGTERM, sysconn.IgnoreENOTSOCK(sysconn.SocketCookies(replaced)))
+	if errors.Is(err, pidfd.ErrNoFiles) || errors.Is(err, unix.ESRCH) {
+		// The previous instance has exited, or the pid has been reused.
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("takeover: signal pid %d: %w", previous, err)
+	}
+
+	return previous, nil
+}
+
+// TakeoverError is returned by Takeover if it fails after replacing some
+// sockets and can't restore them.
+type TakeoverError struct {
+	// Replaced are the destinations which still refer to the new sockets.
+	Replaced []Destination
+	Err      error
+}
+
+func (te *TakeoverError) Error() string {
+	dests := make([]string, 0, len(te.Replaced))
+	for i := range te.Replaced {
+		dests = append(dests, te.Replaced[i].String())
+	}
+	return fmt.Sprintf("%s (sockets remain replaced: %s)", te.Err, strings.Join(dests, ", "))
+}
+
+func (te *TakeoverError) Unwrap() error {
+	return te.Err
+}
+
+// takeoverStep records a socket registered by Takeover.
+type takeoverStep struct {
+	dest     *Destination
+	old, new SocketCookie
+}
+
+// rollbackTakeover undoes steps, and returns err or a *TakeoverError if some
+// sockets of the previous instance can't be restored.
+func rollbackTakeover(dp *Dispatcher, previous int, label string, steps []takeoverStep, err error) error {
+	oldCookies := make(map[uint64]bool)
+	for _, step := range steps {
+		if step.old != 0 {
+			oldCookies[uint64(step.old)] = true
+		}
+	}
+
+	oldSockets := make(map[SocketCookie]*os.File)
+	if len(oldCookies) > 0 && previous != 0 {
+		// Files which can't be examined only limit what is restored.
+		files, _ := pidfd.Files(previous, sysconn.IgnoreENOTSOCK(sysconn.SocketCookies(oldCookies)))
+		for _, file := range files {
+			defer file.Close()
+
+			if cookie, err := socketCookie(file); err == nil {
+				oldSockets[cookie] = file
+			}
+		}
+	}
+
+	var replaced []Destination
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		if step.old == 0 {
+			err := dp.UnregisterSocketCookie(label, step.dest.Domain, step.dest.Protocol, step.new)
+			if err == nil {
+				continue
+			}
+		} else if file := oldSockets[step.old]; file != nil {
+			if _, err := dp.ReplaceSocket(label, file, step.new); err == nil {
+				continue
+			}
+		}
+
+		replaced = append(replaced, *step.dest)
+	}
+
+	if len(replaced) == 0 {
+		return err
+	}
+
+	return &TakeoverError{replaced, err}
+}
+
+func socketCookie(conn syscall.Conn) (SocketCookie, error) {
+	var cookie uint64
+	err := sysconn.Control(conn, func(fd int) (err error) {
+		cookie, err = unix.GetsockoptUint64(fd, unix.SOL_SOCKET, unix.SO_COOKIE)
+		return
+	})
+	if err != nil {
+		return 0, fmt.Errorf("getsockopt(SO_COOKIE): %w", err)
+	}
+	return SocketCookie(cookie), nil
+}
+
+func readPIDFile(path string) (int, error) {
+	contents, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return 0, fmt.Errorf("pid file %s: %s", path, err)
+	}
+
+	return pid, nil
+}
+
+// writePIDFile atomically replaces the contents of path with pid.
+func writePIDFile(path string, pid int) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := fmt.Fprintln(tmp, pid); err != nil {
+		return err
+	}
+
+	if err := tmp.Chmod(0644); err != nil {
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// WaitDrained waits until no traffic is queued on a socket which has been
+// replaced, after which it can be closed without dropping connections or
+// packets. The caller must keep accepting from or reading the socket
+// concurrently.
+//
+// The queue is checked at interval, and must be empty twice in a row, since
+// TCP connections which were in the middle of the handshake during the
+// replacement are still queued on the old socket.
+func WaitDrained(ctx context.Context, conn syscall.Conn, interval time.Duration) error {
+	var empty int
+	for {
+		length, err := sysconn.ControlInt(conn, queueLength)
+		if err != nil {
+			return err
+		}
+
+		if length > 0 {
+			empty = 0
+		} else if empty++; empty == 2 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// queueLength returns the number of connections waiting to be accepted for
+// a listening TCP socket, or the size of the next datagram for a UDP socket.
+func queueLength(fd int) (int, error) {
+	sotype, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil {
+		return 0, fmt.Errorf("getsockopt(SO_TYPE): %w", err)
+	}
+
+	switch sotype {
+	case unix.SOCK_STREAM:
+		info, err := unix.GetsockoptTCPInfo(fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+		if err != nil {
+			return 0, fmt.Errorf("getsockopt(TCP_INFO): %w", err)
+		}
+		// For listening sockets this is the length of the accept queue.
+		return int(info.Unacked), nil
+
+	case unix.SOCK_DGRAM:
+		n, err := unix.IoctlGetInt(fd, unix.SIOCINQ)
+		if err != nil {
+			return 0, fmt.Errorf("ioctl(SIOCINQ): %w", err)
+		}
+		return n, nil
+
+	default:
+		return 0, fmt.Errorf("socket type %d: %w", sotype, ErrBadSocketType)
+	}
+}
@@ -0,0 +1,287 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/tubular/internal/sysconn"
+	"github.com/cloudflare/tubular/internal/testutil"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"golang.org/x/sys/unix"
+)
+
+func TestTakeover(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+	pidFile := filepath.Join(t.TempDir(), "server.pid")
+
+	takeover := func(conn syscall.Conn) int {
+		t.Helper()
+
+		previous, err := Takeover(dp, pidFile, "server", conn)
+		if err != nil {
+			t.Fatal("Takeover:", err)
+		}
+
+		if pid := mustReadPIDFile(t, pidFile); pid != os.Getpid() {
+			t.Fatalf("Pid file contains %d instead of %d", pid, os.Getpid())
+		}
+
+		dest, err := NewDestination("server", conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cookie := mustRegisteredCookie(t, dp, dest); cookie != mustSocketCookie(t, conn) {
+			t.Fatal("Socket wasn't registered")
+		}
+
+		return previous
+	}
+
+	first := testutil.Listen(t, netns, "tcp4", "")
+	if previous := takeover(first); previous != 0 {
+		t.Fatal("Signalled previous instance", previous, "without a pid file")
+	}
+
+	// A previous instance which holds the registered socket.
+	child := testutil.SpawnChildWithFiles(t, mustFile(t, first))
+	mustWritePIDFile(t, pidFile, child)
+
+	if previous := takeover(testutil.Listen(t, netns, "tcp4", "")); previous != child {
+		t.Fatalf("Expected to signal %d, got %d", child, previous)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for unix.Kill(child, 0) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Previous instance wasn't stopped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// An unrelated process which reuses the pid of the previous instance.
+	unrelated := testutil.SpawnChildWithFiles(t)
+	mustWritePIDFile(t, pidFile, unrelated)
+
+	if previous := takeover(testutil.Listen(t, netns, "tcp4", "")); previous != 0 {
+		t.Fatal("Signalled unrelated process", previous)
+	}
+
+	if err := unix.Kill(unrelated, 0); err != nil {
+		t.Fatal("Unrelated process was stopped:", err)
+	}
+}
+
+func TestTakeoverRollback(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+	pidFile := filepath.Join(t.TempDir(), "server.pid")
+
+	old := testutil.Listen(t, netns, "tcp4", "")
+	if _, _, err := dp.RegisterSocket("server", old); err != nil {
+		t.Fatal(err)
+	}
+
+	dest, err := NewDestination("server", old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An unbound UDP socket passes validation, but can't be added to the
+	// sockmap.
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unbound := os.NewFile(uintptr(fd), "udp")
+	defer unbound.Close()
+
+	if err := unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_V6ONLY, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	udpDest, err := NewDestination("server", unbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("restored", func(t *testing.T) {
+		previous := testutil.SpawnChildWithFiles(t, mustFile(t, old))
+		mustWritePIDFile(t, pidFile, previous)
+
+		_, err := Takeover(dp, pidFile, "server", testutil.Listen(t, netns, "tcp4", ""), unbound)
+		if err == nil {
+			t.Fatal("Takeover with an unbound socket succeeded")
+		}
+
+		var takeoverErr *TakeoverError
+		if errors.As(err, &takeoverErr) {
+			t.Fatal("Takeover didn't restore sockets:", err)
+		}
+
+		if cookie := mustRegisteredCookie(t, dp, dest); cookie != mustSocketCookie(t, old) {
+			t.Error("Socket of the previous instance wasn't restored")
+		}
+
+		if pid := mustReadPIDFile(t, pidFile); pid != previous {
+			t.Error("Pid file was changed to", pid)
+		}
+
+		if err := unix.Kill(previous, 0); err != nil {
+			t.Error("Previous instance was stopped:", err)
+		}
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		// The previous instance doesn't hold its socket anymore.
+		mustWritePIDFile(t, pidFile, testutil.SpawnChildWithFiles(t))
+
+		conn := testutil.Listen(t, netns, "tcp4", "")
+		_, err := Takeover(dp, pidFile, "server", conn, unbound)
+
+		var takeoverErr *TakeoverError
+		if !errors.As(err, &takeoverErr) {
+			t.Fatal("Expected a TakeoverError, got", err)
+		}
+
+		if len(takeoverErr.Replaced) != 1 || takeoverErr.Replaced[0] != *dest {
+			t.Error("TakeoverError doesn't contain replaced destination:", takeoverErr.Replaced)
+		}
+
+		if cookie := mustRegisteredCookie(t, dp, dest); cookie != mustSocketCookie(t, conn) {
+			t.Error("Replaced socket isn't registered")
+		}
+	})
+
+	_, cookies, err := dp.Destinations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cookie := cookies[*udpDest]; cookie != 0 {
+		t.Error("Unbound socket is registered:", cookie)
+	}
+}
+
+func TestWaitDrained(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+
+	waitDrained := func(conn syscall.Conn) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		return WaitDrained(ctx, conn, time.Millisecond)
+	}
+
+	t.Run("tcp", func(t *testing.T) {
+		ln := testutil.Listen(t, netns, "tcp4", "").(*net.TCPListener)
+		client := mustDial(t, netns, "tcp4", ln.Addr().String())
+		defer client.Close()
+
+		if err := waitDrained(ln); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("Expected a timeout while a connection is queued, got", err)
+		}
+
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		if err := waitDrained(ln); err != nil {
+			t.Fatal("Can't drain socket:", err)
+		}
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		conn := testutil.Listen(t, netns, "udp4", "").(*net.UDPConn)
+		client := mustDial(t, netns, "udp4", conn.LocalAddr().String())
+		defer client.Close()
+
+		if _, err := client.Write([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := waitDrained(conn); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal("Expected a timeout while a datagram is queued, got", err)
+		}
+
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := waitDrained(conn); err != nil {
+			t.Fatal("Can't drain socket:", err)
+		}
+	})
+}
+
+// mustDial connects to a socket without expecting it to echo.
+func mustDial(tb testing.TB, netns ns.NetNS, network, address string) (conn net.Conn) {
+	tb.Helper()
+
+	testutil.JoinNetNS(tb, netns, func() (err error) {
+		conn, err = net.Dial(network, address)
+		return
+	})
+	return
+}
+
+func mustFile(tb testing.TB, conn syscall.Conn) *os.File {
+	tb.Helper()
+
+	file, err := conn.(interface{ File() (*os.File, error) }).File()
+	if err != nil {
+		tb.Fatal("File:", err)
+	}
+	tb.Cleanup(func() { file.Close() })
+	return file
+}
+
+func mustSocketCookie(tb testing.TB, conn syscall.Conn) SocketCookie {
+	tb.Helper()
+
+	var cookie uint64
+	err := sysconn.Control(conn, func(fd int) (err error) {
+		cookie, err = unix.GetsockoptUint64(fd, unix.SOL_SOCKET, unix.SO_COOKIE)
+		return
+	})
+	if err != nil {
+		tb.Fatal("SO_COOKIE:", err)
+	}
+	return SocketCookie(cookie)
+}
+
+func mustReadPIDFile(tb testing.TB, path string) int {
+	tb.Helper()
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return pid
+}
+
+func mustWritePIDFile(tb testing.TB, path string, pid int) {
+	tb.Helper()
+
+	if err := writePIDFile(path, pid); err != nil {
+		tb.Fatal(err)
+	}
+}
@@ -0,0 +1,212 @@
+// Package sockdiag retrieves socket information via NETLINK_SOCK_DIAG.
+package sockdiag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/cloudflare/tubular/internal/endian"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	sockDiagByFamily  = 20 // SOCK_DIAG_BY_FAMILY
+	inetDiagSkMemInfo = 7  // INET_DIAG_SKMEMINFO
+
+	// Indices into the INET_DIAG_SKMEMINFO array.
+	skMemInfoRcvbuf = 1 // SK_MEMINFO_RCVBUF
+	skMemInfoDrops  = 8 // SK_MEMINFO_DROPS
+)
+
+// States which can be passed to Dump.
+const (
+	StateListen = 1 << 10 // TCP_LISTEN
+	StateAll    = ^uint32(0)
+)
+
+// inetDiagSockID mirrors struct inet_diag_sockid.
+type inetDiagSockID struct {
+	SPort  [2]byte
+	DPort  [2]byte
+	Src    [16]byte
+	Dst    [16]byte
+	If     uint32
+	Cookie [2]uint32
+}
+
+// inetDiagReqV2 mirrors struct inet_diag_req_v2.
+type inetDiagReqV2 struct {
+	Family   uint8
+	Protocol uint8
+	Ext      uint8
+	Pad      uint8
+	States   uint32
+	ID       inetDiagSockID
+}
+
+// inetDiagMsg mirrors struct inet_diag_msg.
+type inetDiagMsg struct {
+	Family  uint8
+	State   uint8
+	Timer   uint8
+	Retrans uint8
+	ID      inetDiagSockID
+	Expires uint32
+	RQueue  uint32
+	WQueue  uint32
+	UID     uint32
+	Inode   uint32
+}
+
+// Socket contains diagnostic information about a single socket.
+type Socket struct {
+	Cookie uint64
+	State  uint8
+	// Number of bytes in the receive queue. For listening TCP sockets this
+	// is the number of connections waiting to be accepted.
+	RecvQueue uint32
+	// Number of bytes in the send queue. For listening TCP sockets this
+	// is the maximum accept backlog.
+	SendQueue uint32
+	// Size of the receive buffer in bytes.
+	RecvBuffer uint32
+	// Number of packets dropped by the socket.
+	Drops uint32
+}
+
+// Dump returns all sockets of the given family and protocol which are in one
+// of states.
+//
+// The sockets are enumerated in the network namespace of the calling thread.
+func Dump(family, protocol uint8, states uint32) ([]Socket, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		return nil, fmt.Errorf("create netlink socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	req := inetDiagReqV2{
+		Family:   family,
+		Protocol: protocol,
+		Ext:      1 << (inetDiagSkMemInfo - 1),
+		States:   states,
+	}
+
+	var buf bytes.Buffer
+	hdr := unix.NlMsghdr{
+		Len:   uint32(unix.SizeofNlMsghdr + binary.Size(req)),
+		Type:  sockDiagByFamily,
+		Flags: unix.NLM_F_REQUEST | unix.NLM_F_DUMP,
+		Seq:   1,
+	}
+	if err := binary.Write(&buf, endian.NativeEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, endian.NativeEndian, &req); err != nil {
+		return nil, err
+	}
+
+	if err := unix.Sendto(fd, buf.Bytes(), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+
+	var (
+		sockets []Socket
+		rbuf    = make([]byte, 32*1024)
+	)
+	for {
+		n, _, err := unix.Recvfrom(fd, rbuf, 0)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("receive response: %w", err)
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(rbuf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("parse response: %w", err)
+		}
+
+		for _, msg := range msgs {
+			switch msg.Header.Type {
+			case unix.NLMSG_DONE:
+				return sockets, nil
+
+			case unix.NLMSG_ERROR:
+				if len(msg.Data) < 4 {
+					return nil, fmt.Errorf("truncated netlink error")
+				}
+				errno := -int32(endian.NativeEndian.Uint32(msg.Data))
+				return nil, fmt.Errorf("dump sockets: %w", unix.Errno(errno))
+
+			case sockDiagByFamily:
+				sk, err := parseSocket(msg.Data)
+				if err != nil {
+					return nil, err
+				}
+				sockets = append(sockets, sk)
+
+			default:
+				return nil, fmt.Errorf("unexpected netlink message type %d", msg.Header.Type)
+			}
+		}
+	}
+}
+
+func parseSocket(data []byte) (Socket, error) {
+	var msg inetDiagMsg
+	size := binary.Size(msg)
+	if len(data) < size {
+		return Socket{}, fmt.Errorf("truncated inet_diag_msg")
+	}
+
+	if err := binary.Read(bytes.NewReader(data[:size]), endian.NativeEndian, &msg); err != nil {
+		return Socket{}, fmt.Errorf("read inet_diag_msg: %s", err)
+	}
+
+	sk := Socket{
+		Cookie:    uint64(msg.ID.Cookie[1])<<32 | uint64(msg.ID.Cookie[0]),
+		State:     msg.State,
+		RecvQueue: msg.RQueue,
+		SendQueue: msg.WQueue,
+	}
+
+	attrs := data[rtaAlign(size):]
+	for len(attrs) >= unix.SizeofRtAttr {
+		attrLen := int(endian.NativeEndian.Uint16(attrs[0:2]))
+		attrType := endian.NativeEndian.Uint16(attrs[2:4])
+		if attrLen < unix.SizeofRtAttr || attrLen > len(attrs) {
+			return Socket{}, fmt.Errorf("invalid attribute length %d", attrLen)
+		}
+
+		if attrType == inetDiagSkMemInfo {
+			payload := attrs[unix.SizeofRtAttr:attrLen]
+			meminfo := func(i int) uint32 {
+				if len(payload) < (i+1)*4 {
+					return 0
+				}
+				return endian.NativeEndian.Uint32(payload[i*4:])
+			}
+
+			sk.RecvBuffer = meminfo(skMemInfoRcvbuf)
+			sk.Drops = meminfo(skMemInfoDrops)
+		}
+
+		next := rtaAlign(attrLen)
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+
+	return sk, nil
+}
+
+func rtaAlign(n int) int {
+	return (n + unix.RTA_ALIGNTO - 1) &^ (unix.RTA_ALIGNTO - 1)
+}
@@ -0,0 +1,92 @@
+package sockdiag
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/cloudflare/tubular/internal/sysconn"
+	"github.com/cloudflare/tubular/internal/testutil"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"golang.org/x/sys/unix"
+)
+
+func TestDumpListener(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	ln := testutil.Listen(t, netns, "tcp4", "")
+	addr := ln.(net.Listener).Addr().String()
+
+	const numConns = 3
+	testutil.JoinNetNS(t, netns, func() error {
+		for i := 0; i < numConns; i++ {
+			conn, err := net.Dial("tcp4", addr)
+			if err != nil {
+				return err
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+		return nil
+	})
+
+	sk := mustFindSocket(t, netns, ln, unix.AF_INET, unix.IPPROTO_TCP, StateListen)
+	if sk.RecvQueue != numConns {
+		t.Errorf("Expected %d connections in the accept queue, got %d", numConns, sk.RecvQueue)
+	}
+	if sk.SendQueue == 0 {
+		t.Error("Expected a non-zero backlog")
+	}
+}
+
+func TestDumpUDP(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	conn := testutil.Listen(t, netns, "udp6", "")
+	addr := conn.(net.PacketConn).LocalAddr().String()
+
+	testutil.JoinNetNS(t, netns, func() error {
+		client, err := net.Dial("udp6", addr)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		_, err = client.Write([]byte("foo"))
+		return err
+	})
+
+	sk := mustFindSocket(t, netns, conn, unix.AF_INET6, unix.IPPROTO_UDP, StateAll)
+	if sk.RecvQueue == 0 {
+		t.Error("Expected a non-empty receive queue")
+	}
+	if sk.RecvBuffer == 0 {
+		t.Error("Expected a non-zero receive buffer")
+	}
+}
+
+func mustFindSocket(tb testing.TB, netns ns.NetNS, conn syscall.Conn, family, protocol uint8, states uint32) Socket {
+	tb.Helper()
+
+	var cookie uint64
+	err := sysconn.Control(conn, func(fd int) (err error) {
+		cookie, err = unix.GetsockoptUint64(fd, unix.SOL_SOCKET, unix.SO_COOKIE)
+		return
+	})
+	if err != nil {
+		tb.Fatal("SO_COOKIE:", err)
+	}
+
+	var sockets []Socket
+	testutil.JoinNetNS(tb, netns, func() (err error) {
+		sockets, err = Dump(family, protocol, states)
+		return
+	})
+
+	for _, sk := range sockets {
+		if sk.Cookie == cookie {
+			return sk
+		}
+	}
+
+	tb.Fatalf("Socket with cookie %d not found in %d sockets", cookie, len(sockets))
+	return Socket{}
+}
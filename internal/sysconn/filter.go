@@ -103,6 +103,37 @@ func FirstReuseport() Predicate {
 	}
 }
 
+// UniqueSocket filters out sockets which have been seen before, for example
+// because multiple processes share the same socket.
+func UniqueSocket() Predicate {
+	seen := make(map[uint64]bool)
+	return func(fd int) (bool, error) {
+		cookie, err := unix.GetsockoptUint64(fd, unix.SOL_SOCKET, unix.SO_COOKIE)
+		if err != nil {
+			return false, fmt.Errorf("getsockopt(SO_COOKIE): %w", err)
+		}
+
+		if seen[cookie] {
+			return false, nil
+		}
+
+		seen[cookie] = true
+		return true, nil
+	}
+}
+
+// SocketCookies keeps sockets with one of the given cookies.
+func SocketCookies(cookies map[uint64]bool) Predicate {
+	return func(fd int) (bool, error) {
+		cookie, err := unix.GetsockoptUint64(fd, unix.SOL_SOCKET, unix.SO_COOKIE)
+		if err != nil {
+			return false, fmt.Errorf("getsockopt(SO_COOKIE): %w", err)
+		}
+
+		return cookies[cookie], nil
+	}
+}
+
 // IgnoreENOTSOCK wraps a predicate and returns false instead of unix.ENOTSOCK.
 func IgnoreENOTSOCK(p Predicate) Predicate {
 	return func(fd int) (bool, error) {
@@ -116,6 +147,8 @@ func IgnoreENOTSOCK(p Predicate) Predicate {
 
 // InetListener returns a predicate that keeps listening TCP or connected UDP sockets.
 //
+// network is either "tcp", "udp" or "any".
+//
 // It filters out any files that are not sockets.
 func InetListener(network string) Predicate {
 	return func(fd int) (bool, error) {
@@ -143,6 +176,8 @@ func InetListener(network string) Predicate {
 				return false, nil
 			}
 
+		case "any":
+
 		default:
 			return false, fmt.Errorf("unrecognized network %q", network)
 		}
@@ -180,6 +215,29 @@ func InetListener(network string) Predicate {
 
 // LocalAddress filters for sockets with the given address and port.
 func LocalAddress(ip netaddr.IP, port int) Predicate {
+	return localAddress(func(fdIP netaddr.IP, fdPort int) bool {
+		return fdIP.Compare(ip) == 0 && fdPort == port
+	})
+}
+
+// LocalPrefixes filters for sockets with an address in one of prefixes
+// and the given port. A port of zero matches all ports.
+func LocalPrefixes(prefixes []netaddr.IPPrefix, port int) Predicate {
+	return localAddress(func(fdIP netaddr.IP, fdPort int) bool {
+		if port != 0 && fdPort != port {
+			return false
+		}
+
+		for _, prefix := range prefixes {
+			if prefix.Contains(fdIP) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func localAddress(match func(netaddr.IP, int) bool) Predicate {
 	return func(fd int) (bool, error) {
 		sa, err := unix.Getsockname(fd)
 		if err != nil {
@@ -201,14 +259,6 @@ func LocalAddress(ip netaddr.IP, port int) Predicate {
 			return false, nil
 		}
 
-		if fdIP.Compare(ip) != 0 {
-			return false, nil
-		}
-
-		if fdPort != port {
-			return false, nil
-		}
-
-		return true, nil
+		return match(fdIP, fdPort), nil
 	}
 }
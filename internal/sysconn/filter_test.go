@@ -12,6 +12,7 @@ import (
 	"github.com/cloudflare/tubular/internal/testutil"
 
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
 	"inet.af/netaddr"
 )
 
@@ -96,6 +97,63 @@ func TestFirstReuseport(t *testing.T) {
 	}
 }
 
+func TestUniqueSocket(t *testing.T) {
+	p := sysconn.UniqueSocket()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	file, err := conn.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if keep, err := sysconn.FilterConn(conn.(syscall.Conn), p); err != nil {
+		t.Fatal(err)
+	} else if !keep {
+		t.Fatal("Predicate wouldn't keep the first socket")
+	}
+
+	if keep, err := sysconn.FilterConn(file, p); err != nil {
+		t.Fatal(err)
+	} else if keep {
+		t.Fatal("Predicate would keep a duplicate of the socket")
+	}
+}
+
+func TestSocketCookies(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var cookie uint64
+	err = sysconn.Control(conn.(syscall.Conn), func(fd int) (err error) {
+		cookie, err = unix.GetsockoptUint64(fd, unix.SOL_SOCKET, unix.SO_COOKIE)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keep, err := sysconn.FilterConn(conn.(syscall.Conn), sysconn.SocketCookies(map[uint64]bool{cookie: true})); err != nil {
+		t.Fatal(err)
+	} else if !keep {
+		t.Fatal("Predicate wouldn't keep a socket with a matching cookie")
+	}
+
+	if keep, err := sysconn.FilterConn(conn.(syscall.Conn), sysconn.SocketCookies(map[uint64]bool{cookie + 1: true})); err != nil {
+		t.Fatal(err)
+	} else if keep {
+		t.Fatal("Predicate would keep a socket with a different cookie")
+	}
+}
+
 func TestLocalAddress(t *testing.T) {
 	type test struct {
 		name string
@@ -128,6 +186,35 @@ func TestLocalAddress(t *testing.T) {
 		)
 	}
 
+	addPrefix := func(network string, conn syscall.Conn, ip netaddr.IP, port int) {
+		valid = append(valid,
+			test{
+				fmt.Sprint(network, " prefix and port"),
+				sysconn.LocalPrefixes([]netaddr.IPPrefix{netaddr.IPPrefixFrom(ip, 8)}, port),
+				conn,
+				true,
+			},
+			test{
+				fmt.Sprint(network, " prefix and any port"),
+				sysconn.LocalPrefixes([]netaddr.IPPrefix{netaddr.IPPrefixFrom(ip, 0)}, 0),
+				conn,
+				true,
+			},
+			test{
+				fmt.Sprint(network, " drop prefix"),
+				sysconn.LocalPrefixes([]netaddr.IPPrefix{netaddr.IPPrefixFrom(ip.Next(), ip.BitLen())}, 0),
+				conn,
+				false,
+			},
+			test{
+				fmt.Sprint(network, " drop prefix port"),
+				sysconn.LocalPrefixes([]netaddr.IPPrefix{netaddr.IPPrefixFrom(ip, 0)}, port+1),
+				conn,
+				false,
+			},
+		)
+	}
+
 	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
 		tcp, err := net.Listen("tcp", addr)
 		if err != nil {
@@ -138,6 +225,7 @@ func TestLocalAddress(t *testing.T) {
 		addr := tcp.Addr().(*net.TCPAddr)
 		ip, _ := netaddr.FromStdIP(addr.IP)
 		addValid("tcp", tcp.(syscall.Conn), ip, addr.Port)
+		addPrefix("tcp "+addr.String(), tcp.(syscall.Conn), ip, addr.Port)
 	}
 
 	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
@@ -263,6 +351,18 @@ func TestListeningSocket(t *testing.T) {
 			tcpConn,
 			false,
 		},
+		{
+			"udp any",
+			sysconn.InetListener("any"),
+			udpConn,
+			true,
+		},
+		{
+			"tcp any",
+			sysconn.InetListener("any"),
+			tcpConn,
+			true,
+		},
 	}
 
 	for _, test := range tests {
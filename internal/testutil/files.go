@@ -162,6 +162,8 @@ func ReuseportSockets(tb testing.TB, network string) (a, b *os.File, ip net.IP,
 }
 
 // SpawnChildWithFiles creates a process that holds onto a bunch of files.
+//
+// A nil file leaves a gap in the file descriptor table of the child.
 func SpawnChildWithFiles(tb testing.TB, files ...*os.File) (pid int) {
 	tb.Helper()
 
@@ -184,6 +186,11 @@ func SpawnChildWithFiles(tb testing.TB, files ...*os.File) (pid int) {
 
 	fds := []uintptr{sysConnFd(tb, r), sysConnFd(tb, out), sysConnFd(tb, out)}
 	for _, file := range files {
+		if file == nil {
+			// StartProcess closes the fd in the child.
+			fds = append(fds, ^uintptr(0))
+			continue
+		}
 		fds = append(fds, sysConnFd(tb, file))
 	}
 
@@ -210,6 +217,16 @@ func SpawnChildWithFiles(tb testing.TB, files ...*os.File) (pid int) {
 	// Wait until cat reads from the stdin pipe, which signals that start up
 	// like the dynamic loader is done.
 	w.Write([]byte{'a'})
+	for {
+		n, err := unix.IoctlGetInt(int(r.Fd()), unix.TIOCINQ)
+		if err != nil {
+			tb.Fatal("TIOCINQ:", err)
+		}
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
 
 	return
 }
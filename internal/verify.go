@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+// Lookup is the input to a simulated socket lookup.
+type Lookup struct {
+	Protocol Protocol
+	IP       netaddr.IP
+	Port     uint16
+}
+
+// ParseLookup parses the format produced by Lookup.String, for example
+// "tcp:127.0.0.1:80" or "udp:[::1]:53".
+func ParseLookup(text string) (Lookup, error) {
+	i := strings.IndexByte(text, ':')
+	if i == -1 {
+		return Lookup{}, fmt.Errorf("lookup %q: missing protocol", text)
+	}
+
+	var proto Protocol
+	if err := proto.UnmarshalText([]byte(text[:i])); err != nil {
+		return Lookup{}, fmt.Errorf("lookup %q: %s", text, err)
+	}
+
+	ipPort, err := netaddr.ParseIPPort(text[i+1:])
+	if err != nil {
+		return Lookup{}, fmt.Errorf("lookup %q: %s", text, err)
+	}
+
+	return Lookup{proto, ipPort.IP(), ipPort.Port()}, nil
+}
+
+func (lt Lookup) String() string {
+	return fmt.Sprintf("%s:%s", lt.Protocol, netaddr.IPPortFrom(lt.IP, lt.Port))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (lt Lookup) MarshalText() ([]byte, error) {
+	return []byte(lt.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (lt *Lookup) UnmarshalText(text []byte) error {
+	lookup, err := ParseLookup(string(text))
+	if err != nil {
+		return err
+	}
+	*lt = lookup
+	return nil
+}
+
+// lookupResult is the outcome of a simulated socket lookup.
+type lookupResult struct {
+	Verdict uint32
+	Cookie  SocketCookie
+}
+
+func (lr lookupResult) String() string {
+	verdict := "drop"
+	if lr.Verdict == 1 {
+		verdict = "pass"
+	}
+	return fmt.Sprintf("%s (socket %s)", verdict, lr.Cookie)
+}
+
+// lookupCorpus generates lookups which exercise all bindings.
+func lookupCorpus(bindings *ebpf.Map) ([]Lookup, error) {
+	var (
+		key    bindingKey
+		value  bindingValue
+		corpus []Lookup
+		iter   = bindings.Iterate()
+	)
+	for iter.Next(&key, &value) {
+		bind := newBindingFromBPF("", &key)
+
+		port := bind.Port
+		if port == 0 {
+			// Any port will do for a wildcard binding.
+			port = 1
+		}
+
+		corpus = append(corpus, Lookup{bind.Protocol, bind.Prefix.IP(), port})
+		if last := bind.Prefix.Range().To(); last != bind.Prefix.IP() {
+			corpus = append(corpus, Lookup{bind.Protocol, last, port})
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("iterate bindings: %s", err)
+	}
+
+	return corpus, nil
+}
+
+// verifyPrograms checks that two dispatcher programs give the same result
+// for every lookup in corpus.
+func verifyPrograms(oldProg, newProg *ebpf.Program, corpus []Lookup) error {
+	for _, tuple := range corpus {
+		oldResult, err := testRunSkLookup(oldProg, tuple)
+		if err != nil {
+			return fmt.Errorf("current program: %w", err)
+		}
+
+		newResult, err := testRunSkLookup(newProg, tuple)
+		if err != nil {
+			return fmt.Errorf("new program: %w", err)
+		}
+
+		if oldResult != newResult {
+			return fmt.Errorf("lookup of %s: current program returns %s, new program returns %s: %w", tuple, oldResult, newResult, ErrVerificationFailed)
+		}
+	}
+
+	return nil
+}
+
+// skLookupContext mirrors struct bpf_sk_lookup.
+type skLookupContext struct {
+	Cookie         uint64
+	Family         uint32
+	Protocol       uint32
+	RemoteIP4      [4]byte
+	RemoteIP6      [16]byte
+	RemotePort     [2]byte
+	_              uint16
+	LocalIP4       [4]byte
+	LocalIP6       [16]byte
+	LocalPort      uint32
+	IngressIfindex uint32
+}
+
+// progTestRunAttr mirrors the BPF_PROG_TEST_RUN part of union bpf_attr.
+type progTestRunAttr struct {
+	ProgFD      uint32
+	Retval      uint32
+	DataSizeIn  uint32
+	DataSizeOut uint32
+	DataIn      uint64
+	DataOut     uint64
+	Repeat      uint32
+	Duration    uint32
+	CtxSizeIn   uint32
+	CtxSizeOut  uint32
+	CtxIn       uint64
+	CtxOut      uint64
+	Flags       uint32
+	CPU         uint32
+}
+
+// testRunSkLookup simulates a socket lookup using BPF_PROG_TEST_RUN.
+//
+// Support for sk_lookup programs was added in Linux 5.14, older kernels
+// return an error.
+func testRunSkLookup(prog *ebpf.Program, tuple Lookup) (lookupResult, error) {
+	ctx := skLookupContext{
+		Protocol:  uint32(tuple.Protocol),
+		LocalPort: uint32(tuple.Port),
+	}
+
+	if tuple.IP.Is4() {
+		ctx.Family = unix.AF_INET
+		ctx.LocalIP4 = tuple.IP.As4()
+	} else {
+		ctx.Family = unix.AF_INET6
+		ctx.LocalIP6 = tuple.IP.As16()
+	}
+
+	attr := progTestRunAttr{
+		ProgFD:     uint32(prog.FD()),
+		CtxSizeIn:  uint32(unsafe.Sizeof(ctx)),
+		CtxSizeOut: uint32(unsafe.Sizeof(ctx)),
+		CtxIn:      uint64(uintptr(unsafe.Pointer(&ctx))),
+		CtxOut:     uint64(uintptr(unsafe.Pointer(&ctx))),
+	}
+
+	_, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_TEST_RUN, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&ctx)
+	runtime.KeepAlive(prog)
+	if errno != 0 {
+		return lookupResult{}, fmt.Errorf("simulate lookup of %s: %w", tuple, errno)
+	}
+
+	return lookupResult{attr.Retval, SocketCookie(ctx.Cookie)}, nil
+}
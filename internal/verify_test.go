@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cloudflare/tubular/internal/testutil"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+)
+
+// errnoNotSupp is the kernel internal ENOTSUPP, returned if a program type
+// doesn't support BPF_PROG_TEST_RUN.
+const errnoNotSupp = unix.Errno(524)
+
+func TestParseLookup(t *testing.T) {
+	for _, text := range []string{"tcp:127.0.0.1:80", "udp:[::1]:53"} {
+		lookup, err := ParseLookup(text)
+		if err != nil {
+			t.Errorf("Can't parse %q: %s", text, err)
+			continue
+		}
+
+		if lookup.String() != text {
+			t.Errorf("Parsing %q returns %s", text, lookup)
+		}
+	}
+
+	for _, text := range []string{"", "tcp", "sctp:127.0.0.1:80", "tcp:127.0.0.1", "udp:::1:53"} {
+		if _, err := ParseLookup(text); err == nil {
+			t.Errorf("Accepted %q", text)
+		}
+	}
+}
+
+func TestVerifyPrograms(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+
+	mustAddBinding(t, dp, mustNewBinding(t, "foo", TCP, "127.0.0.0/24", 80))
+	mustAddBinding(t, dp, mustNewBinding(t, "bar", UDP, "::1", 0))
+
+	ln := testutil.Listen(t, netns, "tcp4", "127.0.0.1:0")
+	mustRegisterSocket(t, dp, "foo", ln)
+
+	_, cookies, err := dp.Destinations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prog, err := dp.Program()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prog.Close()
+
+	corpus, err := lookupCorpus(dp.bindings)
+	if err != nil {
+		t.Fatal("Can't generate corpus:", err)
+	}
+
+	if len(corpus) != 3 {
+		t.Fatalf("Expected three lookups in corpus, got %d: %v", len(corpus), corpus)
+	}
+
+	for _, tuple := range corpus {
+		result, err := testRunSkLookup(prog, tuple)
+		if errors.Is(err, errnoNotSupp) {
+			t.Skip("Kernel doesn't support BPF_PROG_TEST_RUN for sk_lookup")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := lookupResult{Verdict: 0}
+		if tuple.Protocol == TCP {
+			want = lookupResult{1, cookies[Destination{"foo", AF_INET, TCP}]}
+		}
+
+		if result != want {
+			t.Errorf("Lookup of %s returned %s instead of %s", tuple, result, want)
+		}
+	}
+
+	if err := verifyPrograms(prog, prog, corpus); err != nil {
+		t.Error("Verifying identical programs fails:", err)
+	}
+
+	pass, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:       ebpf.SkLookup,
+		AttachType: ebpf.AttachSkLookup,
+		License:    "MIT",
+		Instructions: asm.Instructions{
+			asm.Mov.Imm(asm.R0, 1),
+			asm.Return(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pass.Close()
+
+	if err := verifyPrograms(prog, pass, corpus); !errors.Is(err, ErrVerificationFailed) {
+		t.Error("Verifying diverging programs doesn't return ErrVerificationFailed:", err)
+	}
+}
+
+func TestDispatcherUpgradeVerified(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+	dp := mustCreateDispatcher(t, netns)
+	check := assertDispatcherState(t, dp, netns)
+	if err := dp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	corpus := []Lookup{{TCP, netaddr.MustParseIP("127.0.0.1"), 80}}
+	for _, corpus := range [][]Lookup{nil, corpus} {
+		err := testutil.WithCapabilities(func() error {
+			_, err := UpgradeDispatcherVerified(netns.Path(), "/sys/fs/bpf", "test", corpus)
+			return err
+		}, CreateCapabilities...)
+		if errors.Is(err, errnoNotSupp) {
+			t.Skip("Kernel doesn't support BPF_PROG_TEST_RUN for sk_lookup")
+		}
+		if err != nil {
+			t.Fatalf("Verified upgrade with corpus %v failed: %s", corpus, err)
+		}
+	}
+
+	dp = mustOpenDispatcher(t, nil, netns)
+	defer dp.Close()
+	check(dp)
+}
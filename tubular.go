@@ -0,0 +1,346 @@
+// Package tubular is a client for the tubular socket dispatcher.
+//
+// The package allows Go programs to manage bindings and to register sockets
+// without shelling out to tubectl. It operates on the same state as tubectl
+// and is safe to use concurrently with it.
+//
+// The identifiers exported from this package follow the Go 1 compatibility
+// promise: they won't be removed or changed in an incompatible way within
+// a major version, with the exception of methods on Dispatcher which are
+// documented as experimental. The package doesn't expose types of its
+// dependencies.
+//
+// Most operations require CAP_NET_ADMIN and CAP_SYS_ADMIN, or membership of
+// the group which owns the dispatcher state. See OpenDispatcher.
+package tubular
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"inet.af/netaddr"
+
+	"github.com/cloudflare/tubular/internal"
+)
+
+// Errors returned by the Dispatcher.
+//
+// Use errors.Is to check for them.
+var (
+	// The dispatcher is already loaded into a network namespace.
+	ErrLoaded = internal.ErrLoaded
+	// The dispatcher is not loaded into a network namespace.
+	ErrNotLoaded = internal.ErrNotLoaded
+	// A file descriptor passed to RegisterSocket isn't a socket.
+	ErrNotSocket = internal.ErrNotSocket
+	// A socket isn't AF_INET or AF_INET6.
+	ErrBadSocketDomain = internal.ErrBadSocketDomain
+	// A socket isn't SOCK_STREAM or SOCK_DGRAM.
+	ErrBadSocketType = internal.ErrBadSocketType
+	// A socket isn't IPPROTO_TCP or IPPROTO_UDP.
+	ErrBadSocketProtocol = internal.ErrBadSocketProtocol
+	// A socket isn't listening (TCP) or is connected (UDP).
+	ErrBadSocketState = internal.ErrBadSocketState
+	// The socket registered for a destination isn't the expected one, see
+	// ReplaceSocket and UnregisterSocketCookie. Also returned by
+	// RemoveBinding if the binding has a different label.
+	ErrDestinationMismatch = internal.ErrDestinationMismatch
+	// A binding passed to RemoveBinding doesn't exist.
+	ErrBindingNotFound = internal.ErrBindingNotFound
+	// Bindings passed to ReplaceBindings or ReplaceOwnedBindings contain
+	// duplicates or bindings which belong to a different owner.
+	ErrBindingConflict = internal.ErrBindingConflict
+	// No socket is registered for a destination passed to UnregisterSocket.
+	ErrSocketNotFound = internal.ErrSocketNotFound
+	// All destination IDs are in use, and AddBinding can't create a new
+	// destination.
+	ErrOutOfDestinationIDs = internal.ErrOutOfDestinationIDs
+	// The loaded dispatcher program is incompatible with this version of the
+	// package. Upgrade the dispatcher first.
+	ErrIncompatibleProgram = internal.ErrIncompatibleProgram
+	// UpgradeDispatcherVerified found a lookup which the new program
+	// handles differently.
+	ErrVerificationFailed = internal.ErrVerificationFailed
+)
+
+// Domain is the address family of a destination.
+type Domain uint8
+
+// Valid domains.
+const (
+	AF_INET  = Domain(internal.AF_INET)
+	AF_INET6 = Domain(internal.AF_INET6)
+)
+
+// UnmarshalText parses "ipv4" or "ipv6".
+func (d *Domain) UnmarshalText(text []byte) error {
+	return (*internal.Domain)(d).UnmarshalText(text)
+}
+
+// MarshalText encodes d in the format used by UnmarshalText.
+func (d Domain) MarshalText() ([]byte, error) {
+	return internal.Domain(d).MarshalText()
+}
+
+func (d Domain) String() string {
+	return internal.Domain(d).String()
+}
+
+// Protocol is the transport protocol of a binding or destination.
+type Protocol uint8
+
+// Valid protocols.
+const (
+	TCP = Protocol(internal.TCP)
+	UDP = Protocol(internal.UDP)
+)
+
+// UnmarshalText parses "tcp" or "udp".
+func (p *Protocol) UnmarshalText(text []byte) error {
+	return (*internal.Protocol)(p).UnmarshalText(text)
+}
+
+// MarshalText encodes p in the format used by UnmarshalText.
+func (p Protocol) MarshalText() ([]byte, error) {
+	return internal.Protocol(p).MarshalText()
+}
+
+func (p Protocol) String() string {
+	return internal.Protocol(p).String()
+}
+
+// SocketCookie uniquely identifies a socket in the kernel.
+//
+// Zero means that no socket is registered.
+type SocketCookie uint64
+
+func (c SocketCookie) String() string {
+	return internal.SocketCookie(c).String()
+}
+
+// MarshalText encodes c in the format produced by String. The zero cookie
+// can't be encoded.
+func (c SocketCookie) MarshalText() ([]byte, error) {
+	return internal.SocketCookie(c).MarshalText()
+}
+
+// UnmarshalText parses the format produced by String.
+func (c *SocketCookie) UnmarshalText(text []byte) error {
+	return (*internal.SocketCookie)(c).UnmarshalText(text)
+}
+
+// CreateDispatcher loads the dispatcher into a network namespace.
+//
+// version is recorded alongside the program and is returned by
+// Dispatcher.Programs.
+//
+// Returns ErrLoaded if the namespace already has the dispatcher enabled.
+func CreateDispatcher(netnsPath, bpfFsPath, version string) (*Dispatcher, error) {
+	return newDispatcher(internal.CreateDispatcher(netnsPath, bpfFsPath, version))
+}
+
+// OpenDispatcher opens the dispatcher state of a network namespace.
+//
+// bpfFsPath is usually /sys/fs/bpf. A read-only dispatcher can be opened
+// concurrently, while a read-write dispatcher is exclusive.
+//
+// Returns ErrNotLoaded if the dispatcher isn't loaded.
+func OpenDispatcher(netnsPath, bpfFsPath string, readOnly bool) (*Dispatcher, error) {
+	return newDispatcher(internal.OpenDispatcher(netnsPath, bpfFsPath, readOnly))
+}
+
+// CheckDispatcher returns an error if the loaded dispatcher isn't compatible
+// with this version of the package.
+func CheckDispatcher(netnsPath, bpfFsPath string) error {
+	return internal.CheckDispatcher(netnsPath, bpfFsPath)
+}
+
+// UnloadDispatcher removes the dispatcher and all its state from a network
+// namespace.
+//
+// Returns ErrNotLoaded if the dispatcher isn't loaded.
+func UnloadDispatcher(netnsPath, bpfFsPath string) error {
+	return internal.UnloadDispatcher(netnsPath, bpfFsPath)
+}
+
+// UnloadDispatcherChecked is like UnloadDispatcher, but calls check with a
+// read-only Dispatcher before removing any state. The unload is aborted if
+// check returns an error.
+func UnloadDispatcherChecked(netnsPath, bpfFsPath string, check func(*Dispatcher) error) error {
+	if check == nil {
+		return internal.UnloadDispatcherChecked(netnsPath, bpfFsPath, nil)
+	}
+
+	return internal.UnloadDispatcherChecked(netnsPath, bpfFsPath, func(dp *internal.Dispatcher) error {
+		return check(&Dispatcher{dp})
+	})
+}
+
+// UpgradeDispatcher replaces the dispatcher program while preserving state.
+//
+// Returns the ID of the new program.
+func UpgradeDispatcher(netnsPath, bpfFsPath, version string) (ProgramID, error) {
+	id, err := internal.UpgradeDispatcher(netnsPath, bpfFsPath, version)
+	return ProgramID(id), err
+}
+
+// UpgradeDispatcherVerified is like UpgradeDispatcher, but refuses to
+// upgrade if the new program steers traffic for the current bindings
+// differently.
+func UpgradeDispatcherVerified(netnsPath, bpfFsPath, version string) (ProgramID, error) {
+	id, err := internal.UpgradeDispatcherVerified(netnsPath, bpfFsPath, version, nil)
+	return ProgramID(id), err
+}
+
+// UpgradeDispatcherWithCorpus is like UpgradeDispatcherVerified, but
+// simulates the lookups in corpus instead of deriving them from the bindings.
+func UpgradeDispatcherWithCorpus(netnsPath, bpfFsPath, version string, corpus []Lookup) (ProgramID, error) {
+	lookups := make([]internal.Lookup, 0, len(corpus))
+	for _, lookup := range corpus {
+		lt, err := lookup.internal()
+		if err != nil {
+			return 0, err
+		}
+		lookups = append(lookups, lt)
+	}
+
+	id, err := internal.UpgradeDispatcherVerified(netnsPath, bpfFsPath, version, lookups)
+	return ProgramID(id), err
+}
+
+// RollbackDispatcher reverts to the program replaced by the last upgrade.
+//
+// Returns an error wrapping os.ErrNotExist if there is no such program.
+func RollbackDispatcher(netnsPath, bpfFsPath string) (ProgramID, error) {
+	id, err := internal.RollbackDispatcher(netnsPath, bpfFsPath)
+	return ProgramID(id), err
+}
+
+// NewDestination returns the destination which Dispatcher.RegisterSocket
+// uses for conn.
+//
+// Returns the same errors as RegisterSocket if the socket isn't supported.
+func NewDestination(label string, conn syscall.Conn) (*Destination, error) {
+	dest, err := internal.NewDestination(label, conn)
+	if err != nil {
+		return nil, err
+	}
+	return newDestination(dest), nil
+}
+
+// Takeover registers conns under label in place of the sockets of a
+// previous instance of a server, and then asks the previous instance to stop
+// by sending it SIGTERM.
+//
+// The previous instance is found via pidFile, which is updated to contain the
+// pid of the calling process. It's only signalled if it still holds one of
+// the replaced sockets, which guards against the pid having been reused.
+// This requires the same privileges as tubectl register-pid.
+//
+// The previous instance should use WaitDrained before closing its sockets,
+// and UnregisterSocketCookie if it cleans up after itself, so that it
+// doesn't remove the sockets of the new instance.
+//
+// If a socket can't be registered, the sockets registered before it are
+// removed again and those of the previous instance are restored. Sockets
+// which can't be restored are listed by a *TakeoverError. The pid file isn't
+// changed and the previous instance isn't signalled in that case, so calling
+// Takeover again completes the takeover.
+//
+// dp must be opened read-write. Returns the pid of the signalled instance, or
+// zero if there was none.
+func Takeover(dp *Dispatcher, pidFile, label string, conns ...syscall.Conn) (int, error) {
+	pid, err := internal.Takeover(dp.dp, pidFile, label, conns...)
+
+	var takeoverErr *internal.TakeoverError
+	if errors.As(err, &takeoverErr) {
+		replaced := make([]Destination, 0, len(takeoverErr.Replaced))
+		for i := range takeoverErr.Replaced {
+			replaced = append(replaced, *newDestination(&takeoverErr.Replaced[i]))
+		}
+		return pid, &TakeoverError{replaced, takeoverErr.Err}
+	}
+
+	return pid, err
+}
+
+// TakeoverError is returned by Takeover if it fails after replacing some
+// sockets and can't restore them.
+type TakeoverError struct {
+	// Replaced are the destinations which still refer to the new sockets.
+	Replaced []Destination
+	Err      error
+}
+
+func (te *TakeoverError) Error() string {
+	dests := make([]string, 0, len(te.Replaced))
+	for i := range te.Replaced {
+		dests = append(dests, te.Replaced[i].String())
+	}
+	return fmt.Sprintf("%s (sockets remain replaced: %s)", te.Err, strings.Join(dests, ", "))
+}
+
+func (te *TakeoverError) Unwrap() error {
+	return te.Err
+}
+
+// WaitDrained waits until no traffic is queued on a socket which has been
+// replaced, after which it can be closed without dropping connections or
+// packets. The caller must keep accepting from or reading the socket
+// concurrently.
+//
+// The queue is checked at interval, which should be at least as long as a
+// TCP handshake.
+func WaitDrained(ctx context.Context, conn syscall.Conn, interval time.Duration) error {
+	return internal.WaitDrained(ctx, conn, interval)
+}
+
+// Lookup is a protocol, IP and port used to simulate traffic, see
+// UpgradeDispatcherWithCorpus.
+type Lookup struct {
+	Protocol Protocol
+	IP       net.IP
+	Port     uint16
+}
+
+// ParseLookup parses a lookup like "tcp:127.0.0.1:80" or "udp:[::1]:53".
+func ParseLookup(text string) (Lookup, error) {
+	lt, err := internal.ParseLookup(text)
+	if err != nil {
+		return Lookup{}, err
+	}
+	return Lookup{Protocol(lt.Protocol), lt.IP.IPAddr().IP, lt.Port}, nil
+}
+
+func (lt Lookup) internal() (internal.Lookup, error) {
+	ip, ok := netaddr.FromStdIP(lt.IP)
+	if !ok {
+		return internal.Lookup{}, fmt.Errorf("lookup: invalid IP %s", lt.IP)
+	}
+	return internal.Lookup{Protocol: internal.Protocol(lt.Protocol), IP: ip, Port: lt.Port}, nil
+}
+
+func (lt Lookup) String() string {
+	return fmt.Sprintf("%s:%s", lt.Protocol, net.JoinHostPort(lt.IP.String(), strconv.Itoa(int(lt.Port))))
+}
+
+// MarshalText encodes lt in the format used by ParseLookup.
+func (lt Lookup) MarshalText() ([]byte, error) {
+	return []byte(lt.String()), nil
+}
+
+// UnmarshalText parses the format used by ParseLookup.
+func (lt *Lookup) UnmarshalText(text []byte) error {
+	lookup, err := ParseLookup(string(text))
+	if err != nil {
+		return err
+	}
+	*lt = lookup
+	return nil
+}
@@ -0,0 +1,269 @@
+// Package udp helps UDP servers reply from the address a client sent to.
+//
+// tubular delivers packets for many addresses and ports to a single socket.
+// A reply must come from the original destination of a packet, otherwise the
+// client drops it. Conn retrieves the original destination when reading and
+// uses it as the source when writing, for both IPv4 and IPv6 and for
+// bindings with a port wildcard.
+package udp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/cloudflare/tubular/internal/sysconn"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrNoDestination is returned by Conn.ReadFromWithDst if a packet doesn't
+// carry its original destination.
+var ErrNoDestination = errors.New("original destination missing")
+
+// Conn is a UDP socket which knows the original destination of packets.
+//
+// It embeds a *net.UDPConn, and can therefore be used as a net.PacketConn.
+// Replies must use WriteToFromSrc however.
+type Conn struct {
+	*net.UDPConn
+	domain int
+	port   int
+}
+
+// Listen creates a Conn bound to laddr.
+//
+// network must be either "udp4" or "udp6", since tubular doesn't support
+// dual-stack sockets.
+func Listen(network string, laddr *net.UDPAddr) (*Conn, error) {
+	switch network {
+	case "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := NewConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// NewConn enables the socket options required to retrieve the original
+// destination on an existing socket, for example one which was passed via
+// systemd socket activation.
+//
+// The Conn takes ownership of conn.
+func NewConn(conn *net.UDPConn) (*Conn, error) {
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected local address %s", conn.LocalAddr())
+	}
+
+	var domain int
+	err := sysconn.Control(conn, func(fd int) (err error) {
+		domain, err = setupSocket(fd)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{conn, domain, addr.Port}, nil
+}
+
+func setupSocket(fd int) (int, error) {
+	domain, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	if err != nil {
+		return 0, fmt.Errorf("getsockopt(SO_DOMAIN): %w", err)
+	}
+
+	type sockopt struct {
+		level, opt int
+		name       string
+	}
+
+	var opts []sockopt
+	switch domain {
+	case unix.AF_INET:
+		opts = []sockopt{
+			{unix.SOL_IP, unix.IP_RECVORIGDSTADDR, "IP_RECVORIGDSTADDR"},
+		}
+
+	case unix.AF_INET6:
+		v6only, err := unix.GetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_V6ONLY)
+		if err != nil {
+			return 0, fmt.Errorf("getsockopt(IPV6_V6ONLY): %w", err)
+		}
+		if v6only == 0 {
+			return 0, fmt.Errorf("dual-stack sockets aren't supported")
+		}
+
+		opts = []sockopt{
+			{unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, "IPV6_RECVORIGDSTADDR"},
+			// Required to reply from addresses which aren't assigned to an
+			// interface.
+			{unix.SOL_IPV6, unix.IPV6_FREEBIND, "IPV6_FREEBIND"},
+		}
+
+	default:
+		return 0, fmt.Errorf("unsupported domain %d", domain)
+	}
+
+	for _, opt := range opts {
+		if err := unix.SetsockoptInt(fd, opt.level, opt.opt, 1); err != nil {
+			return 0, fmt.Errorf("setsockopt(%s): %w", opt.name, err)
+		}
+	}
+
+	return domain, nil
+}
+
+// ReadFromWithDst is like ReadFrom, except that it also returns the original
+// destination of the packet.
+//
+// Returns ErrNoDestination if the destination isn't available.
+func (c *Conn) ReadFromWithDst(b []byte) (n int, addr, dst *net.UDPAddr, err error) {
+	oob := make([]byte, unix.CmsgSpace(unix.SizeofSockaddrInet6))
+	n, oobn, _, addr, err := c.ReadMsgUDP(b, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	scms, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("parse control messages: %w", err)
+	}
+
+	for i := range scms {
+		sa, err := unix.ParseOrigDstAddr(&scms[i])
+		if err != nil {
+			// Not the original destination.
+			continue
+		}
+
+		switch sa := sa.(type) {
+		case *unix.SockaddrInet4:
+			dst = &net.UDPAddr{IP: net.IP(sa.Addr[:]).To16(), Port: sa.Port}
+		case *unix.SockaddrInet6:
+			dst = &net.UDPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port}
+		}
+		return n, addr, dst, nil
+	}
+
+	return 0, nil, nil, ErrNoDestination
+}
+
+// WriteToFromSrc is like WriteTo, except that the packet is sent from src.
+//
+// src is usually the dst returned by ReadFromWithDst. Writing from a port
+// other than the one Conn is bound to requires a temporary socket, and is
+// therefore more expensive. The temporary socket is created in the network
+// namespace of the calling thread.
+func (c *Conn) WriteToFromSrc(b []byte, addr, src *net.UDPAddr) (int, error) {
+	if src.Port == c.port || src.Port == 0 {
+		return c.writeWithPktInfo(b, addr, src)
+	}
+
+	return c.writeFromPort(b, addr, src)
+}
+
+// writeWithPktInfo sends from the port of the socket and the IP of src.
+func (c *Conn) writeWithPktInfo(b []byte, addr, src *net.UDPAddr) (int, error) {
+	sa, err := sockaddr(c.domain, src)
+	if err != nil {
+		return 0, fmt.Errorf("source: %w", err)
+	}
+
+	var info []byte
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		info = unix.PktInfo4(&unix.Inet4Pktinfo{Spec_dst: sa.Addr})
+	case *unix.SockaddrInet6:
+		info = unix.PktInfo6(&unix.Inet6Pktinfo{Addr: sa.Addr})
+	}
+
+	n, _, err := c.WriteMsgUDP(b, info, addr)
+	return n, err
+}
+
+// writeFromPort sends b via a temporary socket bound to src.
+func (c *Conn) writeFromPort(b []byte, addr, src *net.UDPAddr) (int, error) {
+	srcSA, err := sockaddr(c.domain, src)
+	if err != nil {
+		return 0, fmt.Errorf("source: %w", err)
+	}
+
+	dstSA, err := sockaddr(c.domain, addr)
+	if err != nil {
+		return 0, fmt.Errorf("destination: %w", err)
+	}
+
+	fd, err := unix.Socket(c.domain, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, os.NewSyscallError("socket", err)
+	}
+	defer unix.Close(fd)
+
+	level, opt := unix.SOL_IP, unix.IP_FREEBIND
+	if c.domain == unix.AF_INET6 {
+		level, opt = unix.SOL_IPV6, unix.IPV6_FREEBIND
+		if err := unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_V6ONLY, 1); err != nil {
+			return 0, os.NewSyscallError("setsockopt(IPV6_V6ONLY)", err)
+		}
+	}
+
+	if err := unix.SetsockoptInt(fd, level, opt, 1); err != nil {
+		return 0, os.NewSyscallError("setsockopt(FREEBIND)", err)
+	}
+
+	// Another socket may be bound to the same address.
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		return 0, os.NewSyscallError("setsockopt(SO_REUSEADDR)", err)
+	}
+
+	if err := unix.Bind(fd, srcSA); err != nil {
+		return 0, fmt.Errorf("bind to %s: %w", src, err)
+	}
+
+	if err := unix.Sendto(fd, b, 0, dstSA); err != nil {
+		return 0, os.NewSyscallError("sendto", err)
+	}
+
+	return len(b), nil
+}
+
+func sockaddr(domain int, addr *net.UDPAddr) (unix.Sockaddr, error) {
+	switch domain {
+	case unix.AF_INET:
+		ip := addr.IP.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("%s isn't an IPv4 address", addr)
+		}
+
+		sa := &unix.SockaddrInet4{Port: addr.Port}
+		copy(sa.Addr[:], ip)
+		return sa, nil
+
+	case unix.AF_INET6:
+		ip := addr.IP.To16()
+		if ip == nil || addr.IP.To4() != nil {
+			return nil, fmt.Errorf("%s isn't an IPv6 address", addr)
+		}
+
+		sa := &unix.SockaddrInet6{Port: addr.Port}
+		copy(sa.Addr[:], ip)
+		return sa, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported domain %d", domain)
+	}
+}
@@ -0,0 +1,166 @@
+package udp
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/tubular"
+	"github.com/cloudflare/tubular/internal"
+	"github.com/cloudflare/tubular/internal/testutil"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+func TestConn(t *testing.T) {
+	netns := testutil.NewNetNS(t, "2001:db8::/64")
+	dp := mustCreateDispatcher(t, netns)
+
+	for _, tc := range []struct {
+		network, prefix string
+		// The IP the socket is bound to, and another IP in prefix.
+		local, other string
+	}{
+		{"udp4", "127.0.0.0/8", "127.0.0.1", "127.0.0.2"},
+		{"udp6", "2001:db8::/64", "2001:db8::1", "2001:db8::2"},
+	} {
+		t.Run(tc.network, func(t *testing.T) {
+			bind, err := tubular.NewBinding(tc.network, tubular.UDP, tc.prefix, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := dp.AddBinding(bind); err != nil {
+				t.Fatal("Can't add binding:", err)
+			}
+
+			conn := mustListen(t, netns, tc.network, net.JoinHostPort(tc.local, "0"))
+			if _, _, err := dp.RegisterSocket(tc.network, conn); err != nil {
+				t.Fatal("Can't register socket:", err)
+			}
+
+			// Replies from a port other than the one of the socket are
+			// required for port wildcards.
+			port := conn.LocalAddr().(*net.UDPAddr).Port
+			for _, ip := range []string{tc.local, tc.other} {
+				for _, port := range []int{port, 4242} {
+					dst := net.JoinHostPort(ip, strconv.Itoa(port))
+					t.Run(dst, func(t *testing.T) {
+						mustEcho(t, netns, conn, dst)
+					})
+				}
+			}
+		})
+	}
+}
+
+func TestListenUnsupported(t *testing.T) {
+	netns := testutil.NewNetNS(t)
+
+	testutil.JoinNetNS(t, netns, func() error {
+		if conn, err := Listen("udp", nil); err == nil {
+			conn.Close()
+			t.Error("Accepted dual-stack network")
+		}
+
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6unspecified})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		if _, err := NewConn(conn); err == nil {
+			t.Error("Accepted dual-stack socket")
+		}
+
+		return nil
+	})
+}
+
+func mustEcho(tb testing.TB, netns ns.NetNS, conn *Conn, dst string) {
+	tb.Helper()
+
+	var client net.Conn
+	testutil.JoinNetNS(tb, netns, func() (err error) {
+		client, err = net.Dial("udp", dst)
+		return
+	})
+	defer client.Close()
+
+	msg := []byte(dst)
+	if _, err := client.Write(msg); err != nil {
+		tb.Fatal("Write:", err)
+	}
+
+	buf := make([]byte, 128)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, have, err := conn.ReadFromWithDst(buf)
+	if err != nil {
+		tb.Fatal("ReadFromWithDst:", err)
+	}
+
+	if !bytes.Equal(buf[:n], msg) {
+		tb.Fatalf("Received %q instead of %q", buf[:n], msg)
+	}
+
+	if have.String() != client.RemoteAddr().String() {
+		tb.Fatalf("Destination is %s instead of %s", have, client.RemoteAddr())
+	}
+
+	testutil.JoinNetNS(tb, netns, func() error {
+		_, err := conn.WriteToFromSrc(buf[:n], addr, have)
+		return err
+	})
+
+	// The client is connected and therefore drops replies from other
+	// addresses.
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = client.Read(buf)
+	if err != nil {
+		tb.Fatal("Client didn't receive reply:", err)
+	}
+
+	if !bytes.Equal(buf[:n], msg) {
+		tb.Fatalf("Client received %q instead of %q", buf[:n], msg)
+	}
+}
+
+func mustListen(tb testing.TB, netns ns.NetNS, network, address string) *Conn {
+	tb.Helper()
+
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var conn *Conn
+	testutil.JoinNetNS(tb, netns, func() (err error) {
+		conn, err = Listen(network, addr)
+		return
+	})
+	tb.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func mustCreateDispatcher(tb testing.TB, netns ns.NetNS) *tubular.Dispatcher {
+	tb.Helper()
+
+	var dp *tubular.Dispatcher
+	err := testutil.WithCapabilities(func() (err error) {
+		dp, err = tubular.CreateDispatcher(netns.Path(), "/sys/fs/bpf", "test")
+		return
+	}, internal.CreateCapabilities...)
+	if err != nil {
+		tb.Fatal("Can't create dispatcher:", err)
+	}
+
+	tb.Cleanup(func() {
+		os.RemoveAll(dp.Path())
+		dp.Close()
+	})
+	return dp
+}